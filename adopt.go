@@ -0,0 +1,130 @@
+package restful
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// batch size of adoption backfill
+const adoptBatchSize = 500
+
+// AdoptResult is the result of adopting a pre-existing table
+type AdoptResult struct {
+	Backfilled  int `json:"backfilled"`   // docs with btime, mtime or seq backfilled
+	IDConverted int `json:"id_converted"` // docs with ObjectId '_id' converted to hex string
+	Failed      int `json:"failed"`
+	Conflicted  int `json:"conflicted"` // docs with ObjectId '_id' kept, a different doc exists with the hex string id
+}
+
+// Adopt backfills internal fields of legacy docs in a pre-existing table in batches,
+// missing btime is the creation time of ObjectId '_id' or now, missing mtime is btime, missing seq is 1,
+// and ObjectId '_id' is converted to hex string as ids generated by the package
+func (p *Processor) Adopt(db, table string) (*AdoptResult, error) {
+	dbs := gCfg.MgoSess.Clone()
+	defer dbs.Close()
+	dbc := dbs.DB(db).C(table)
+
+	condition := bson.M{"$or": []interface{}{
+		bson.M{"btime": bson.M{"$exists": false}},
+		bson.M{"mtime": bson.M{"$exists": false}},
+		bson.M{"seq": bson.M{"$exists": false}},
+		bson.M{"_id": bson.M{"$type": "objectId"}},
+	}}
+	result := &AdoptResult{}
+	iter := dbc.Find(condition).Batch(adoptBatchSize).Iter()
+	bulk := dbc.Bulk()
+	bulk.Unordered()
+	pending := 0
+	var info bson.M
+	for iter.Next(&info) {
+		now := time.Now().Unix()
+		set := bson.M{}
+		btime, hasBtime := info["btime"]
+		oid, isOid := info["_id"].(bson.ObjectId)
+		if !hasBtime {
+			btime = now
+			if isOid {
+				btime = oid.Time().Unix()
+			}
+			set["btime"] = btime
+		}
+		if _, ok := info["mtime"]; !ok {
+			set["mtime"] = btime
+		}
+		if _, ok := info["seq"]; !ok {
+			set["seq"] = genSeq(0)
+		}
+
+		if isOid {
+			// '_id' can not be updated, insert a copy then remove the legacy one
+			for k, v := range set {
+				info[k] = v
+			}
+			info["_id"] = oid.Hex()
+			err := dbc.Insert(info)
+			if mgo.IsDup(err) {
+				// the copy inserted by an adoption interrupted before, or another doc using the id
+				var exist bson.M
+				if err = dbc.FindId(oid.Hex()).One(&exist); err == nil && !sameValue(exist, info) {
+					Log.Warnf("Adopt db=%s table=%s convert id %s conflict, legacy doc kept", db, table, oid.Hex())
+					result.Conflicted++
+					info = nil
+					continue
+				}
+			}
+			if err != nil {
+				Log.Warnf("Adopt db=%s table=%s convert id %s fail, err: %v", db, table, oid.Hex(), err)
+				result.Failed++
+			} else if err := dbc.RemoveId(oid); err != nil {
+				Log.Warnf("Adopt db=%s table=%s remove legacy id %s fail, err: %v", db, table, oid.Hex(), err)
+				result.Failed++
+			} else {
+				result.IDConverted++
+			}
+		} else if len(set) > 0 {
+			// skip docs written meanwhile
+			bulk.Update(bson.M{"_id": info["_id"], "seq": info["seq"]}, bson.M{"$set": set})
+			pending++
+			if pending >= adoptBatchSize {
+				result.add(bulk.Run())
+				result.Backfilled += pending
+				bulk = dbc.Bulk()
+				bulk.Unordered()
+				pending = 0
+			}
+		}
+		info = nil
+	}
+	if pending > 0 {
+		result.add(bulk.Run())
+		result.Backfilled += pending
+	}
+	if err := iter.Close(); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// add counts the failures of bulk run
+func (r *AdoptResult) add(_ *mgo.BulkResult, err error) {
+	if err == nil {
+		return
+	}
+	Log.Warnf("Adopt bulk update fail, err: %v", err)
+	if bulkErr, ok := err.(*mgo.BulkError); ok {
+		r.Failed += len(bulkErr.Cases())
+		r.Backfilled -= len(bulkErr.Cases())
+	}
+}
+
+// adoptTask adopts the default table in background
+func (p *Processor) adoptTask() {
+	query := url.Values{}
+	db := p.GetDbName(query)
+	table := p.GetTableName(query)
+	result, err := p.Adopt(db, table)
+	Log.Warnf("Adopt db=%s table=%s done, result: %+v, err: %v", db, table, result, err)
+}
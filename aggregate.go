@@ -0,0 +1,280 @@
+package restful
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// max stages of an aggregate pipeline
+const aggregateMaxStages = 10
+
+// max docs returned by an aggregate pipeline
+const aggregateMaxLimit = 10000
+
+// BuildAggregatePipeline build a safe aggregate pipeline from a whitelisted subset of stages:
+//
+//	{"$match": {filter}}, filter is built by BuildFilterObj, only allowed before $group
+//	{"$group": {"_id": "field", "out": {"$sum": "field"}, "n": {"$count": {}}}}, accumulators: $sum $avg $min $max $count
+//	{"$sort": {"field": 1, "out": -1}}
+//	{"$limit": 100}
+//
+// $group is required, so stored docs are never returned, and hidden fields can not be referenced by any stage
+func (fs *FieldSet) BuildAggregatePipeline(stages []interface{}) ([]bson.M, error) {
+	return fs.buildAggregatePipeline(stages, func(field string) bool { return !fs.IsFieldHidden(field) })
+}
+
+// buildAggregatePipeline build the aggregate pipeline, fields referenced by stages must be readable
+func (fs *FieldSet) buildAggregatePipeline(stages []interface{}, readable func(string) bool) ([]bson.M, error) {
+	if len(stages) == 0 || len(stages) > aggregateMaxStages {
+		return nil, fmt.Errorf("aggregate stages count should be 1 to %d", aggregateMaxStages)
+	}
+	pipeline := make([]bson.M, 0, len(stages))
+	// output fields of $group, nil if no $group stage yet
+	var groupFields map[string]bool
+	hasLimit := false
+	for i, stage := range stages {
+		m, ok := stage.(map[string]interface{})
+		if !ok || len(m) != 1 {
+			return nil, fmt.Errorf("aggregate stage[%d] should be a map with one key", i)
+		}
+		for op, value := range m {
+			switch op {
+			case "$match":
+				if groupFields != nil {
+					return nil, fmt.Errorf("aggregate stage[%d] $match after $group not support", i)
+				}
+				filter, ok := value.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("aggregate stage[%d] $match not map", i)
+				}
+				for k := range filter {
+					if !readable(k) {
+						return nil, fmt.Errorf("aggregate stage[%d] $match field %s not allowed", i, k)
+					}
+				}
+				cond := make(map[string]interface{})
+				if err := fs.BuildFilterObj(filter, cond); err != nil {
+					return nil, err
+				}
+				fs.InReplace(&cond)
+				pipeline = append(pipeline, bson.M{"$match": cond})
+			case "$group":
+				if groupFields != nil {
+					return nil, fmt.Errorf("aggregate stage[%d] multi $group not support", i)
+				}
+				group, ok := value.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("aggregate stage[%d] $group not map", i)
+				}
+				obj, fields, err := fs.buildAggregateGroup(group, readable)
+				if err != nil {
+					return nil, fmt.Errorf("aggregate stage[%d] %v", i, err)
+				}
+				groupFields = fields
+				pipeline = append(pipeline, bson.M{"$group": obj})
+			case "$sort":
+				sort, ok := value.(map[string]interface{})
+				if !ok || len(sort) == 0 {
+					return nil, fmt.Errorf("aggregate stage[%d] $sort invalid", i)
+				}
+				obj := bson.M{}
+				for k, v := range sort {
+					dir := CheckInt(v)
+					if dir == nil || (dir.(int64) != 1 && dir.(int64) != -1) {
+						return nil, fmt.Errorf("aggregate stage[%d] $sort field %s should be 1 or -1", i, k)
+					}
+					if groupFields != nil {
+						if !groupFields[k] {
+							return nil, fmt.Errorf("aggregate stage[%d] $sort field %s unknown", i, k)
+						}
+					} else {
+						if _, ok := fs.IsFieldMember(k); !ok {
+							return nil, fmt.Errorf("aggregate stage[%d] $sort field %s unknown", i, k)
+						}
+						if !readable(k) {
+							return nil, fmt.Errorf("aggregate stage[%d] $sort field %s not allowed", i, k)
+						}
+						k = fs.storageField(k)
+					}
+					obj[k] = dir
+				}
+				pipeline = append(pipeline, bson.M{"$sort": obj})
+			case "$limit":
+				limit := CheckInt(value)
+				if limit == nil || limit.(int64) <= 0 || limit.(int64) > aggregateMaxLimit {
+					return nil, fmt.Errorf("aggregate stage[%d] $limit should be 1 to %d", i, aggregateMaxLimit)
+				}
+				hasLimit = true
+				pipeline = append(pipeline, bson.M{"$limit": limit})
+			default:
+				return nil, fmt.Errorf("aggregate stage[%d] %s not support", i, op)
+			}
+		}
+	}
+	if groupFields == nil {
+		return nil, fmt.Errorf("aggregate need $group")
+	}
+	if !hasLimit {
+		pipeline = append(pipeline, bson.M{"$limit": aggregateMaxLimit})
+	}
+	return pipeline, nil
+}
+
+// buildAggregateGroup build the $group stage, returns the output fields
+func (fs *FieldSet) buildAggregateGroup(group map[string]interface{}, readable func(string) bool) (bson.M, map[string]bool, error) {
+	obj := bson.M{}
+	fields := map[string]bool{"_id": true}
+	id, ok := group["_id"]
+	if !ok {
+		return nil, nil, fmt.Errorf("$group need _id")
+	}
+	switch v := id.(type) {
+	case nil:
+		obj["_id"] = nil
+	case string:
+		if _, ok := fs.IsFieldMember(v); !ok {
+			return nil, nil, fmt.Errorf("$group _id field %s unknown", v)
+		}
+		if !readable(v) {
+			return nil, nil, fmt.Errorf("$group _id field %s not allowed", v)
+		}
+		obj["_id"] = "$" + fs.storageField(v)
+	case []interface{}:
+		keys := bson.M{}
+		for _, elem := range v {
+			k := GetString(elem)
+			if _, ok := fs.IsFieldMember(k); !ok || k == "" {
+				return nil, nil, fmt.Errorf("$group _id field %v unknown", elem)
+			}
+			if !readable(k) {
+				return nil, nil, fmt.Errorf("$group _id field %s not allowed", k)
+			}
+			keys[k] = "$" + fs.storageField(k)
+			fields["_id."+k] = true
+		}
+		obj["_id"] = keys
+	default:
+		return nil, nil, fmt.Errorf("$group _id invalid")
+	}
+	for out, acc := range group {
+		if out == "_id" {
+			continue
+		}
+		m, ok := acc.(map[string]interface{})
+		if !ok || len(m) != 1 {
+			return nil, nil, fmt.Errorf("$group field %s should be a map with one accumulator", out)
+		}
+		for op, operand := range m {
+			if op == "$count" {
+				obj[out] = bson.M{"$sum": 1}
+				continue
+			}
+			if op != "$sum" && op != "$avg" && op != "$min" && op != "$max" {
+				return nil, nil, fmt.Errorf("$group field %s accumulator %s not support", out, op)
+			}
+			k := GetString(operand)
+			kind, ok := fs.IsFieldMember(k)
+			if !ok || k == "" {
+				return nil, nil, fmt.Errorf("$group field %s operand %v unknown", out, operand)
+			}
+			if !readable(k) {
+				return nil, nil, fmt.Errorf("$group field %s operand %s not allowed", out, k)
+			}
+			if (op == "$sum" || op == "$avg") && (kind < KindInt || kind > KindFloat) {
+				return nil, nil, fmt.Errorf("$group field %s operand %s not number", out, k)
+			}
+			obj[out] = bson.M{op: "$" + fs.storageField(k)}
+		}
+		fields[out] = true
+	}
+	return obj, fields, nil
+}
+
+// BuildSummaryGroup build the $group stage computing summary over all docs matched
+// summary is like {"score": "avg", "price": "sum"}, ops: sum avg min max, fields must be number
+// returns the output key in $group of each field, since the field may contain dot
+func (fs *FieldSet) BuildSummaryGroup(summary map[string]interface{}) (bson.M, map[string]string, error) {
+	obj := bson.M{"_id": nil}
+	keys := make(map[string]string, len(summary))
+	i := 0
+	for k, value := range summary {
+		op := GetString(value)
+		if op != "sum" && op != "avg" && op != "min" && op != "max" {
+			return nil, nil, fmt.Errorf("summary field %s op %v not support", k, value)
+		}
+		kind, ok := fs.IsFieldMember(k)
+		if !ok {
+			return nil, nil, fmt.Errorf("summary field %s unknown", k)
+		}
+		if fs.IsFieldHidden(k) {
+			return nil, nil, fmt.Errorf("summary field %s not allowed", k)
+		}
+		if (kind < KindInt || kind > KindFloat) && kind != KindDuration && kind != KindDecimal {
+			return nil, nil, fmt.Errorf("summary field %s not number", k)
+		}
+		key := fmt.Sprintf("f%d", i)
+		obj[key] = bson.M{"$" + op: "$" + fs.storageField(k)}
+		keys[k] = key
+		i++
+	}
+	return obj, keys, nil
+}
+
+func (p *Processor) defaultAggregate() Handler {
+	return func(vars map[string]string, query url.Values, body []byte) *Rsp {
+		begin := time.Now()
+		reqID := query.Get("reqid")
+		if reqID == "" {
+			reqID = "sys_" + RandString(8)
+		}
+		Log.Debugf("[req] %v POST %v/__aggregate query=%v", reqID, p.URLPath, query)
+
+		info, err := ParseBody(body)
+		if err != nil {
+			Log.Warnf("[rsp] %v POST %v/__aggregate unmarshal fail %v [%v]", reqID, p.URLPath, err, p.maskBody(body))
+			return genRsp(http.StatusBadRequest, "invalid Body", nil)
+		}
+		stages, ok := info["pipeline"].([]interface{})
+		if !ok {
+			Log.Warnf("[rsp] %v POST %v/__aggregate need pipeline", reqID, p.URLPath)
+			return genRsp(http.StatusBadRequest, "need pipeline", nil)
+		}
+		pipeline, err := p.FieldSet.buildAggregatePipeline(stages, func(field string) bool {
+			return p.isFieldReadable(query, field)
+		})
+		if err != nil {
+			Log.Warnf("[rsp] %v POST %v/__aggregate pipeline invalid, %v", reqID, p.URLPath, err)
+			return genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+		// soft deleted docs excluded before all stages
+		if deleted := p.excludeDeleted(bson.M{}, query); len(deleted) > 0 {
+			pipeline = append([]bson.M{{"$match": deleted}}, pipeline...)
+		}
+		Log.Debugf("[req] %v pipeline=%v", reqID, pipeline)
+
+		dbs := readSession()
+		defer dbs.Close()
+		dbc := dbs.DB(p.GetDbName(query)).C(p.GetTableName(query))
+
+		var results []interface{}
+		err = dbc.Pipe(pipeline).All(&results)
+		if err != nil {
+			Log.Warnf("[rsp] %v POST %v/__aggregate db access fail, err=%v", reqID, p.URLPath, err)
+			return genRsp(http.StatusInternalServerError, "db access fail", nil)
+		}
+		if results == nil {
+			results = make([]interface{}, 0)
+		}
+		for i := range results {
+			results[i] = outDecimals(results[i])
+		}
+
+		costMs := time.Since(begin).Nanoseconds() / int64(time.Millisecond)
+		Log.Warnf("[rsp] %v success, cost %vms", reqID, costMs)
+		return genRsp(http.StatusOK, "aggregate ok", results)
+	}
+}
@@ -0,0 +1,34 @@
+package restful
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// Any fields are interface{} or json.RawMessage in DataStruct, e.g.: schemaless extension blobs
+// stored verbatim without type checking, and filtered by deep paths into them, e.g.: filter={"ext.color":"red"}
+var rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+
+// CheckAny check the value of any field, nil returned if any key of objects in it starts with '$' or contains '.',
+// which are operators in conditions, or rejected by db in docs written
+func CheckAny(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, elem := range v {
+			if strings.HasPrefix(k, "$") || strings.Contains(k, ".") {
+				return nil
+			}
+			if elem != nil && CheckAny(elem) == nil {
+				return nil
+			}
+		}
+	case []interface{}:
+		for _, elem := range v {
+			if elem != nil && CheckAny(elem) == nil {
+				return nil
+			}
+		}
+	}
+	return value
+}
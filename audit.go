@@ -0,0 +1,58 @@
+package restful
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/url"
+	"time"
+)
+
+// AuditRecord is a read access of a document recorded when Processor.AuditReads
+type AuditRecord struct {
+	Time   int64  `json:"time"` // unix timestamp in milliseconds
+	Biz    string `json:"biz"`
+	DB     string `json:"db"`
+	Table  string `json:"table"`
+	ID     string `json:"id"`
+	Caller string `json:"caller"`
+	// caller got by GlobalConfig.GetCaller, or declared by client with URL Query 'caller' and can not be trusted
+	Verified bool     `json:"verified"`
+	ReqID    string   `json:"reqid"`
+	Fields   []string `json:"fields"` // fields selected, nil if all
+}
+
+// AuditSink receives the audit records, it is called in the request goroutine,
+// should be fast or hand the record over to another goroutine
+type AuditSink func(record *AuditRecord)
+
+// auditReads sends a record of each doc read to the audit sink if read audit enabled
+// docs are rendered with 'id' field
+func (p *Processor) auditReads(reqID string, query url.Values, docs []interface{}) {
+	if !p.AuditReads || gCfg.AuditSink == nil || len(docs) == 0 {
+		return
+	}
+	if p.AuditSampleRate > 0 && p.AuditSampleRate < 1 && rand.Float64() >= p.AuditSampleRate {
+		return
+	}
+	var fields []string
+	if query.Get("select") != "" {
+		var entries []interface{}
+		json.Unmarshal([]byte(query.Get("select")), &entries)
+		fields = p.FieldSet.SelectedFields(SelectEntryNames(entries))
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	for _, doc := range docs {
+		info := docMap(doc)
+		gCfg.AuditSink(&AuditRecord{
+			Time:     now,
+			Biz:      p.Biz,
+			DB:       p.GetDbName(query),
+			Table:    p.GetTableName(query),
+			ID:       GetString(info["id"]),
+			Caller:   query.Get("caller"),
+			Verified: gCfg.GetCaller != nil,
+			ReqID:    reqID,
+			Fields:   fields,
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package restful
+
+import (
+	"encoding/base64"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Binary fields are []byte in DataStruct, e.g.: thumbnail, key
+// stored as BinData in db, rendered and accepted as base64 string, size limited by `restful:"maxlen=N"` tag in bytes
+
+// CheckBinary check value type
+// if value is a base64 string, or bytes, return BYTES value
+// if value is not any type represent BINARY, return nil
+func CheckBinary(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return v
+	case bson.Binary:
+		return v.Data
+	case string:
+		if b, err := base64.StdEncoding.DecodeString(v); err == nil {
+			return b
+		}
+		if b, err := base64.RawStdEncoding.DecodeString(v); err == nil {
+			return b
+		}
+	}
+	return nil
+}
@@ -0,0 +1,535 @@
+package restful
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// Building blocks of the default handlers
+// a custom handler can override one step and call the rest
+
+// ParseBody parses the JSON body of request to an object
+func ParseBody(body []byte) (map[string]interface{}, error) {
+	var info map[string]interface{}
+	if err := json.Unmarshal(body, &info); err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, fmt.Errorf("body is not object")
+	}
+	return info, nil
+}
+
+// ValidateCreate checks the doc to be created by POST or PUT, and adapts MongoDB '_id' field
+func (p *Processor) ValidateCreate(info map[string]interface{}) error {
+	err := p.FieldSet.CheckObject(info, false)
+	if err != nil {
+		return err
+	}
+	err = p.FieldSet.checkMinItems(info)
+	if err != nil {
+		return err
+	}
+	p.applyKeywords(info)
+	p.FieldSet.replaceID(&info)
+	return nil
+}
+
+// ValidateUpdate checks the fields to be updated by PATCH, and adapts MongoDB '_id' field
+func (p *Processor) ValidateUpdate(info map[string]interface{}) error {
+	err := p.FieldSet.CheckObject(info, true)
+	if err != nil {
+		return err
+	}
+	p.FieldSet.replaceID(&info)
+	return nil
+}
+
+// ApplyInternalFields sets btime, mtime and seq of the doc to be written
+// old is the doc stored with btime and seq, nil if creating
+func ApplyInternalFields(info map[string]interface{}, old map[string]interface{}) {
+	now := time.Now().Unix()
+	info["btime"] = now
+	info["mtime"] = now
+	info["seq"] = genSeq(0)
+	if old == nil {
+		return
+	}
+	if v, ok := old["btime"]; ok {
+		info["btime"] = v
+	}
+	if v, ok := old["seq"]; ok {
+		if seq, err := nextSeq(GetString(v)); err == nil {
+			info["seq"] = seq
+		}
+	}
+}
+
+// ExecuteFindPage queries a page of docs by URL Query params like GetPage
+// custom handler can modify query before or rsp after calling it
+func (p *Processor) ExecuteFindPage(reqID string, query url.Values) *Rsp {
+	var err error
+	size := 0
+	page := 0
+	size, err = strconv.Atoi(query.Get("size"))
+	if err != nil || (size <= 0 && size != -1) {
+		Log.Warnf("[rsp] %v GET %v size error", reqID, p.URLPath)
+		return genRsp(http.StatusBadRequest, "need size or size invalid", nil)
+	}
+	if maxSize := p.getMaxPageSize(); maxSize > 0 {
+		if size == -1 && !p.AllowAllPage {
+			Log.Warnf("[rsp] %v GET %v size -1 not allowed", reqID, p.URLPath)
+			return genRsp(http.StatusBadRequest, fmt.Sprintf("size -1 not allowed, max size %d", maxSize), nil)
+		}
+		if size > maxSize {
+			size = maxSize
+		}
+	}
+
+	explain := false
+	if v, err := strconv.ParseBool(query.Get("explain")); err == nil && v {
+		if !gCfg.AdminEnable {
+			Log.Warnf("[rsp] %v GET %v explain not allowed", reqID, p.URLPath)
+			return genRsp(http.StatusForbidden, "explain not allowed", nil)
+		}
+		explain = true
+	}
+
+	keyset := query.Get("after") != ""
+	if keyset && query.Get("page") == "" {
+		query.Set("page", "1")
+	}
+	page, err = strconv.Atoi(query.Get("page"))
+	if err != nil || page <= 0 || (keyset && page != 1) {
+		Log.Warnf("[rsp] %v GET %v page error", reqID, p.URLPath)
+		return genRsp(http.StatusBadRequest, "need page or page invalid", nil)
+	}
+
+	pageRsp := func(msg string, data RspGetPageData) *Rsp {
+		if p.PageMetadata {
+			data.setPagination(page, size, keyset)
+		}
+		return genRsp(http.StatusOK, msg, data)
+	}
+
+	// build condition
+	condition, scores, empty, errRsp := p.buildScoredCondition(reqID, query)
+	if errRsp != nil {
+		return errRsp
+	}
+	if empty {
+		infos := make([]interface{}, 0)
+		return pageRsp("no results found", RspGetPageData{Total: 0, Hits: infos})
+	}
+
+	// build sort
+	sort, errRsp := p.buildSort(reqID, query, scores != nil)
+	if errRsp != nil {
+		return errRsp
+	}
+	// results searched by es are in relevance order by default
+	if scores != nil && len(sort) == 0 && !keyset {
+		sort = append(sort, bson.DocElem{Name: scoreField, Value: int64(-1)})
+	}
+	withScore := false
+	if v, err := strconv.ParseBool(query.Get("with_score")); err == nil {
+		withScore = v
+	}
+	byScore := false
+	for _, elem := range sort {
+		if elem.Name == scoreField {
+			byScore = true
+		}
+	}
+
+	// build keyset pagination
+	findCondition := condition
+	if keyset {
+		if hasNear(condition) {
+			Log.Warnf("[rsp] %v GET %v after with near", reqID, p.URLPath)
+			return genRsp(http.StatusBadRequest, "after not support with near", nil)
+		}
+		if byScore {
+			Log.Warnf("[rsp] %v GET %v after with order by %v", reqID, p.URLPath, scoreField)
+			return genRsp(http.StatusBadRequest, "after not support when order by "+scoreField, nil)
+		}
+		var after map[string]interface{}
+		err := json.Unmarshal([]byte(query.Get("after")), &after)
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v unmarshal after error: %v", reqID, p.URLPath, err)
+			return genRsp(http.StatusBadRequest, "after invalid", nil)
+		}
+		sort = p.FieldSet.KeysetOrder(sort)
+		afterCondition, err := p.FieldSet.BuildKeysetObj(after, sort)
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v after param invalid, %v", reqID, p.URLPath, err)
+			return genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+		if afterCondition != nil {
+			findCondition = bson.M{"$and": []interface{}{condition, afterCondition}}
+		}
+	}
+	// reject unindexed query, explain is still allowed to find out why
+	if !explain {
+		if err := p.checkIndexedQuery(condition, sort); err != nil {
+			Log.Warnf("[rsp] %v GET %v %v", reqID, p.URLPath, err)
+			return genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+	}
+	orderFields := p.FieldSet.OrderArray2Slice(&sort)
+
+	// build select
+	selector, errRsp := p.buildSelector(reqID, query)
+	if errRsp != nil {
+		return errRsp
+	}
+	if byScore && hasSlice(selector) {
+		Log.Warnf("[rsp] %v GET %v slice with order by %v", reqID, p.URLPath, scoreField)
+		return genRsp(http.StatusBadRequest, "slice not support when order by "+scoreField, nil)
+	}
+
+	// build summary
+	var summaryGroup bson.M
+	var summaryKeys map[string]string
+	if query.Get("summary") != "" {
+		var summary map[string]interface{}
+		err := json.Unmarshal([]byte(query.Get("summary")), &summary)
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v unmarshal summary error: %v", reqID, p.URLPath, err)
+			return genRsp(http.StatusBadRequest, "summary invalid", nil)
+		}
+		summaryGroup, summaryKeys, err = p.FieldSet.BuildSummaryGroup(summary)
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v summary param invalid, %v", reqID, p.URLPath, err)
+			return genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+		for field := range summary {
+			if !p.isFieldReadable(query, field) {
+				Log.Warnf("[rsp] %v GET %v summary field %s not allowed", reqID, p.URLPath, field)
+				return genRsp(http.StatusBadRequest, fmt.Sprintf("summary field %s not allowed", field), nil)
+			}
+		}
+	}
+
+	Log.Debugf("[req] %v condition=%v order=%v select=%v", reqID, condition, orderFields, selector)
+
+	// ensure index
+	if p.Indexes != nil && len(p.Indexes) > 0 {
+		getIndexEnsureList().Push(&IndexToEnsureStruct{
+			DB:        p.GetDbName(query),
+			Table:     p.GetTableName(query),
+			Processor: p,
+		})
+	}
+
+	dbs := readSession()
+	defer dbs.Close()
+	dbc := dbs.DB(p.GetDbName(query)).C(p.GetTableName(query))
+	collation := p.getCollation(query)
+
+	// results query
+	var pipeline []bson.M
+	var q *mgo.Query
+	switch {
+	case byScore:
+		pipeline = buildScorePipeline(condition, scores, p.FieldSet.storageSort(sort), selector, withScore, size, page)
+	case p.AllowDiskUse && len(sort) > 0 && !hasNear(findCondition) && !hasSlice(selector):
+		// find can not sort on disk, an aggregate can
+		pipeline = buildSortPipeline(findCondition, p.FieldSet.storageSort(sort), selector, size, page)
+	case size == -1:
+		q = dbc.Find(findCondition).Collation(collation).Sort(orderFields...).Select(selector)
+	default:
+		q = dbc.Find(findCondition).Collation(collation).Skip(size * (page - 1)).Limit(size).Sort(orderFields...).Select(selector)
+	}
+	if q != nil {
+		limitRegex(q, findCondition)
+	}
+	newPipe := func() *mgo.Pipe {
+		pipe := limitRegexPipe(dbc.Pipe(pipeline).Collation(collation), pipeline)
+		if !byScore {
+			pipe = pipe.AllowDiskUse()
+		}
+		return pipe
+	}
+
+	// explain, instead of results
+	if explain {
+		data := RspExplainData{Condition: findCondition, Order: orderFields, Select: selector, Pipeline: pipeline}
+		if q != nil {
+			err = q.Explain(&data.Plan)
+		} else {
+			err = newPipe().Explain(&data.Plan)
+		}
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v explain error: %v", reqID, p.URLPath, err)
+			return genRsp(http.StatusInternalServerError, "db access fail", nil)
+		}
+		data.Plan = winningPlan(data.Plan)
+		return genRsp(http.StatusOK, "explain ok", data)
+	}
+
+	// count, total is -1 if skipped
+	total := -1
+	skipCount := p.SkipCount
+	if v, err := strconv.ParseBool(query.Get("total")); err == nil {
+		skipCount = !v
+	}
+	if !skipCount {
+		total, err = limitRegex(dbc.Find(countCondition(condition)), condition).Collation(collation).Count()
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v get page count error: %v", reqID, p.URLPath, err)
+			return genRsp(http.StatusInternalServerError, "db access fail", nil)
+		}
+		if total <= 0 {
+			infos := make([]interface{}, 0)
+			return pageRsp("no results found", RspGetPageData{Total: 0, Hits: infos})
+		}
+	}
+
+	// results
+	var infos []interface{}
+	if q != nil {
+		err = q.All(&infos)
+	} else {
+		err = newPipe().All(&infos)
+	}
+	if isSortMemoryError(err) {
+		Log.Warnf("[rsp] %v GET %v get page results sort exceeded memory: %v", reqID, p.URLPath, err)
+		return genRsp(http.StatusBadRequest, "sort exceeded memory limit, order by indexed fields or use a smaller size", nil)
+	}
+	if err != nil {
+		Log.Warnf("[rsp] %v GET %v get page results error: %v", reqID, p.URLPath, err)
+		return genRsp(http.StatusInternalServerError, "db access fail", nil)
+	}
+
+	// cursor by the doc stored, before fields of sort hidden or redacted
+	var next map[string]interface{}
+	if keyset && size > 0 && len(infos) == size {
+		next = p.FieldSet.KeysetCursor(docMap(infos[len(infos)-1]), sort)
+	}
+	if err = p.FieldSet.OutReplaceArray(infos); err != nil {
+		Log.Warnf("[rsp] %v GET %v %v", reqID, p.URLPath, err)
+		return genRsp(http.StatusInternalServerError, "migrate fail", nil)
+	}
+	p.redactFields(query, infos)
+	p.auditReads(reqID, query, infos)
+	if query.Get("expand") != "" {
+		err = p.ExpandReferences(dbs, query, infos)
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v expand error, %v", reqID, p.URLPath, err)
+			return genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+	}
+	if isExtJSON(query) {
+		infos = ToExtJSON(infos).([]interface{})
+	}
+
+	if infos == nil {
+		infos = make([]interface{}, 0)
+	}
+	data := RspGetPageData{Total: int64(total), Hits: infos, Next: next}
+	if summaryGroup != nil {
+		var result map[string]interface{}
+		err = dbc.Pipe([]bson.M{{"$match": countCondition(condition)}, {"$group": summaryGroup}}).Collation(collation).One(&result)
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v get page summary error: %v", reqID, p.URLPath, err)
+			return genRsp(http.StatusInternalServerError, "db access fail", nil)
+		}
+		data.Summary = make(map[string]interface{}, len(summaryKeys))
+		for field, key := range summaryKeys {
+			data.Summary[field] = result[key]
+			// sum of decimals is exact
+			if d, ok := result[key].(bson.Decimal128); ok {
+				data.Summary[field] = Decimal(d.String())
+			}
+		}
+	}
+
+	return pageRsp("get page ok", data)
+}
+
+// buildSort builds the sort by URL Query param order, order by relevance score allowed if scored
+func (p *Processor) buildSort(reqID string, query url.Values, scored bool) (bson.D, *Rsp) {
+	sort := make(bson.D, 0, 0)
+	if query.Get("order") != "" {
+		var order []string
+		err := json.Unmarshal([]byte(query.Get("order")), &order)
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v unmarshal order error: %v", reqID, p.URLPath, err)
+			return nil, genRsp(http.StatusBadRequest, "order invalid", nil)
+		}
+		if scored {
+			err = p.FieldSet.BuildSearchOrderArray(order, &sort)
+		} else {
+			err = p.FieldSet.BuildOrderArray(order, &sort)
+		}
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v order param invalid, %v", reqID, p.URLPath, err)
+			return nil, genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+	}
+	return sort, nil
+}
+
+// buildSelector builds the projection by URL Query params select and slice
+func (p *Processor) buildSelector(reqID string, query url.Values) (map[string]interface{}, *Rsp) {
+	selector := make(map[string]interface{})
+	if query.Get("select") != "" {
+		var entries []interface{}
+		err := json.Unmarshal([]byte(query.Get("select")), &entries)
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v unmarshal select error: %v", reqID, p.URLPath, err)
+			return nil, genRsp(http.StatusBadRequest, "select invalid", nil)
+		}
+		err = p.FieldSet.BuildSelectEntries(entries, selector)
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v select param invalid, %v", reqID, p.URLPath, err)
+			return nil, genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+	} else {
+		p.FieldSet.recordRead(nil)
+	}
+	if query.Get("slice") != "" {
+		var slice map[string]interface{}
+		err := json.Unmarshal([]byte(query.Get("slice")), &slice)
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v unmarshal slice error: %v", reqID, p.URLPath, err)
+			return nil, genRsp(http.StatusBadRequest, "slice invalid", nil)
+		}
+		err = p.FieldSet.BuildSliceObj(slice, selector)
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v slice param invalid, %v", reqID, p.URLPath, err)
+			return nil, genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+	}
+	p.FieldSet.InReplace(&selector)
+	return selector, nil
+}
+
+// buildScorePipeline builds the pipeline to sort docs by relevance scores of es and other fields
+// the score is returned in each doc as _score field if withScore, sort is by the names stored
+func buildScorePipeline(condition map[string]interface{}, scores *searchScores, sort bson.D, selector map[string]interface{}, withScore bool, size, page int) []bson.M {
+	pipeline := []bson.M{
+		{"$match": countCondition(condition)},
+		{"$addFields": bson.M{scoreField: bson.M{"$let": bson.M{
+			"vars": bson.M{"i": bson.M{"$indexOfArray": []interface{}{scores.IDs, "$_id"}}},
+			"in":   bson.M{"$cond": []interface{}{bson.M{"$gte": []interface{}{"$$i", 0}}, bson.M{"$arrayElemAt": []interface{}{scores.Scores, "$$i"}}, 0}},
+		}}}},
+		{"$sort": sort},
+	}
+	if size > 0 {
+		pipeline = append(pipeline, bson.M{"$skip": size * (page - 1)}, bson.M{"$limit": size})
+	}
+	// score is excluded implicitly by an inclusion projection, or explicitly
+	project := bson.M{scoreField: 0}
+	inclusion := false
+	for k, v := range selector {
+		if v == 1 {
+			inclusion = true
+			delete(project, scoreField)
+		}
+		project[k] = v
+	}
+	if withScore {
+		delete(project, scoreField)
+		if inclusion {
+			project[scoreField] = 1
+		}
+	}
+	if len(project) > 0 {
+		pipeline = append(pipeline, bson.M{"$project": project})
+	}
+	return pipeline
+}
+
+// buildSortPipeline builds the pipeline of find with sort by the names stored, for sorting on disk
+func buildSortPipeline(condition map[string]interface{}, sort bson.D, selector map[string]interface{}, size, page int) []bson.M {
+	pipeline := []bson.M{
+		{"$match": condition},
+		{"$sort": sort},
+	}
+	if size > 0 {
+		pipeline = append(pipeline, bson.M{"$skip": size * (page - 1)}, bson.M{"$limit": size})
+	}
+	if len(selector) > 0 {
+		pipeline = append(pipeline, bson.M{"$project": selector})
+	}
+	return pipeline
+}
+
+// hasSlice check the projection has $slice or not, which differs in pipeline
+func hasSlice(selector map[string]interface{}) bool {
+	for _, v := range selector {
+		if _, ok := v.(bson.M); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isSortMemoryError check the error is db rejecting a sort exceeding memory limit without index
+func isSortMemoryError(err error) bool {
+	if qe, ok := err.(*mgo.QueryError); ok && (qe.Code == 292 || qe.Code == 16819 || qe.Code == 16820) {
+		return true
+	}
+	return err != nil && (strings.Contains(err.Error(), "Sort exceeded memory limit") || strings.Contains(err.Error(), "Sort operation used more than the maximum"))
+}
+
+// SyncSearch syncs the search content of the doc written to es
+// data is the doc written by POST or PUT, doc is read from db by vars["id"] for PATCH
+func (p *Processor) SyncSearch(method string, vars map[string]string, query url.Values, data map[string]interface{}) {
+	var err error
+	db := p.GetDbName(query)
+	table := p.GetTableName(query)
+	refresh := p.getEsRefresh(query)
+	switch method {
+	case "POST":
+		fallthrough
+	case "PUT":
+		if gCfg.EsEnable {
+			id := GetString(data["_id"])
+			content := p.FieldSet.BuildSearchContent(data, p.SearchFields)
+			if content != "" {
+				err = esUpsert(db, table, id, content, refresh)
+			} else {
+				err = esRemove(db, table, id, refresh)
+			}
+		}
+	case "PATCH":
+		if gCfg.EsEnable {
+			dbs := gCfg.MgoSess.Clone()
+			defer dbs.Close()
+			dbc := dbs.DB(p.GetDbName(query)).C(p.GetTableName(query))
+			id := vars["id"]
+			var info map[string]interface{}
+			err = dbc.Find(bson.M{"_id": id}).One(&info)
+			if err != nil {
+				Log.Warnf("SyncSearch [%v][%v] db fail %v", p.Biz, method, err)
+				return
+			}
+			p.FieldSet.apiNames(info)
+			content := p.FieldSet.BuildSearchContent(info, p.SearchFields)
+			if content != "" {
+				err = esUpsert(db, table, id, content, refresh)
+			} else {
+				err = esRemove(db, table, id, refresh)
+			}
+		}
+	case "DELETE":
+		if gCfg.EsEnable {
+			id := vars["id"]
+			err = esRemove(db, table, id, refresh)
+		}
+	}
+	if err != nil {
+		Log.Warnf("SyncSearch [%v][%v] es access fail %v", p.Biz, method, err)
+	}
+}
@@ -0,0 +1,131 @@
+package restful
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/globalsign/mgo"
+)
+
+func (p *Processor) defaultClone() Handler {
+	return func(vars map[string]string, query url.Values, body []byte) *Rsp {
+		var err error
+		id := vars["id"]
+
+		begin := time.Now()
+		reqID := query.Get("reqid")
+		if reqID == "" {
+			reqID = "sys_" + RandString(8)
+		}
+		Log.Debugf("[req] %v POST %v/%v/__clone query=%v", reqID, p.URLPath, id, query)
+
+		// fields overridden in the new doc, body can be empty
+		info := make(map[string]interface{})
+		if len(body) > 0 {
+			info, err = ParseBody(body)
+			if err != nil {
+				Log.Warnf("[rsp] %v POST %v/%v/__clone unmarshal fail %v [%v]", reqID, p.URLPath, id, err, p.maskBody(body))
+				return genRsp(http.StatusBadRequest, "invalid Body", nil)
+			}
+		}
+		if newID, ok := info["id"]; ok {
+			v := GetString(newID)
+			if v == "" {
+				Log.Warnf("[rsp] %v POST %v/%v/__clone custom id empty", reqID, p.URLPath, id)
+				return genRsp(http.StatusBadRequest, "custom id empty", nil)
+			}
+			if StringLength(v) > 128 {
+				Log.Warnf("[rsp] %v POST %v/%v/__clone custom id too long", reqID, p.URLPath, id)
+				return genRsp(http.StatusBadRequest, "custom id too long", nil)
+			}
+		} else {
+			info["id"] = GenUniqueID()
+		}
+		err = p.CheckWriteRoles(query, info)
+		if err != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__clone %v", reqID, p.URLPath, id, err)
+			return genRsp(http.StatusForbidden, err.Error(), nil)
+		}
+		err = p.ApplyProfile(query, info, true)
+		if err != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__clone profile check fail, err=%v", reqID, p.URLPath, id, err)
+			return genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+
+		dbs := gCfg.MgoSess.Clone()
+		defer dbs.Close()
+		dbc := dbs.DB(p.GetDbName(query)).C(p.GetTableName(query))
+
+		var doc map[string]interface{}
+		err = dbc.Find(p.excludeDeleted(map[string]interface{}{"_id": id}, url.Values{})).One(&doc)
+		if err != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__clone get id=%s error, %v", reqID, p.URLPath, id, id, err)
+			if err == mgo.ErrNotFound {
+				return genRsp(http.StatusNotFound, "id not found", nil)
+			}
+			return genRsp(http.StatusInternalServerError, "db access fail", nil)
+		}
+		if _, err = p.FieldSet.Migrate(doc); err != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__clone %v", reqID, p.URLPath, id, err)
+			return genRsp(http.StatusInternalServerError, err.Error(), nil)
+		}
+		p.FieldSet.apiNames(doc)
+
+		// the merged doc is checked as POST, internal and read only fields are not cloned,
+		// passwords not overridden keep the hashes of the source
+		delete(doc, "_id")
+		for _, field := range internalFields {
+			delete(doc, field)
+		}
+		for _, field := range p.ReadOnlyFields {
+			removePath(doc, field)
+		}
+		hashes := make(map[string]interface{})
+		for _, field := range p.PasswordFields {
+			if v, ok := doc[field]; ok {
+				hashes[field] = v
+				delete(doc, field)
+			}
+		}
+		for k, v := range info {
+			doc[k] = v
+		}
+		err = p.ValidateCreate(doc)
+		if err != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__clone invalid field exists, biz=%v err=%v", reqID, p.URLPath, id, p.Biz, err)
+			return genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+		err = p.hashPasswords(doc)
+		if err != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__clone %v", reqID, p.URLPath, id, err)
+			return genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+		p.keepPasswords(doc, hashes)
+		ApplyInternalFields(doc, nil)
+		p.applySchemaVersion(doc)
+		if errRsp := p.validateDocument(nil, doc); errRsp != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__clone invalid doc, err=%v", reqID, p.URLPath, id, errRsp.Msg)
+			return errRsp
+		}
+
+		sorted := p.FieldSet.InSort(&doc)
+		err = dbc.Insert(&sorted)
+		if err != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__clone db access fail, err=%v", reqID, p.URLPath, id, err)
+			if field := p.duplicateField(err); field != "" {
+				return genRsp(http.StatusConflict, "duplicate "+field, nil)
+			}
+			if mgo.IsDup(err) {
+				return genRsp(http.StatusConflict, "duplicate id", nil)
+			}
+			return genRsp(http.StatusInternalServerError, "db access fail", nil)
+		}
+
+		p.writeDone("POST", map[string]string{}, query, doc)
+
+		costMs := time.Since(begin).Nanoseconds() / int64(time.Millisecond)
+		Log.Warnf("[rsp] %v success, cost %vms", reqID, costMs)
+		return genRsp(http.StatusOK, "clone ok", map[string]interface{}{"id": doc["_id"], "seq": doc["seq"]})
+	}
+}
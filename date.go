@@ -0,0 +1,32 @@
+package restful
+
+import (
+	"reflect"
+	"time"
+)
+
+// the layout of date stored
+const dateLayout = "2006-01-02"
+
+// Date is the type of calendar date field in DataStruct, stored as "YYYY-MM-DD"
+// unlike timestamps, it does not shift across timezones, e.g.: birthday
+type Date string
+
+var dateType = reflect.TypeOf(Date(""))
+
+// CheckDate check value type
+// if value is a date "YYYY-MM-DD", or a RFC3339 time whose date is taken in its own timezone, return the date string
+// if value is not any type represent DATE, return nil
+func CheckDate(value interface{}) interface{} {
+	s, ok := value.(string)
+	if !ok {
+		return nil
+	}
+	if t, err := time.Parse(dateLayout, s); err == nil {
+		return t.Format(dateLayout)
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.Format(dateLayout)
+	}
+	return nil
+}
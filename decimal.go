@@ -0,0 +1,100 @@
+package restful
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Decimal is the type of decimal field in DataStruct, stored as MongoDB Decimal128
+// rendered and accepted as an exact string like "19.99" instead of float, e.g.: price
+type Decimal string
+
+var decimalType = reflect.TypeOf(Decimal(""))
+
+// CheckDecimal check value type
+// if value is a decimal string like "19.99", an integer, or a float in its shortest form, return DECIMAL128 value
+// if value is not any type represent DECIMAL, or NaN or Infinity, return nil
+func CheckDecimal(value interface{}) interface{} {
+	var s string
+	switch v := value.(type) {
+	case bson.Decimal128:
+		return v
+	case string:
+		s = v
+	case Decimal:
+		s = string(v)
+	case float32:
+		s = strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		n := CheckInt(value)
+		if n == nil {
+			return nil
+		}
+		s = fmt.Sprint(n)
+	}
+	s = strings.TrimSpace(s)
+	d, err := bson.ParseDecimal128(s)
+	if err != nil {
+		return nil
+	}
+	switch strings.ToLower(d.String()) {
+	case "nan", "inf", "-inf":
+		return nil
+	}
+	return d
+}
+
+// decimalFields get the paths of decimal fields, converted to strings when rendered
+func (fs *FieldSet) decimalFields() []string {
+	r := make([]string, 0)
+	for _, name := range fs.FSli {
+		if fs.FMap[name].Kind == KindDecimal {
+			r = append(r, name)
+		}
+	}
+	return r
+}
+
+// outDecimal converts the Decimal128 value of path in doc to Decimal string, through objects and arrays of objects
+func outDecimal(doc interface{}, path string) {
+	switch v := doc.(type) {
+	case []interface{}:
+		for _, elem := range v {
+			outDecimal(elem, path)
+		}
+	case map[string]interface{}, bson.M:
+		m := docMap(v)
+		pos := strings.Index(path, ".")
+		if pos == -1 {
+			if d, ok := m[path].(bson.Decimal128); ok {
+				m[path] = Decimal(d.String())
+			}
+			return
+		}
+		outDecimal(m[path[:pos]], path[pos+1:])
+	}
+}
+
+// outDecimals replaces all decimals in value with Decimal, for results not of the struct like aggregations
+func outDecimals(value interface{}) interface{} {
+	switch v := value.(type) {
+	case bson.Decimal128:
+		return Decimal(v.String())
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = outDecimals(elem)
+		}
+	case map[string]interface{}, bson.M:
+		m := docMap(v)
+		for k, elem := range m {
+			m[k] = outDecimals(elem)
+		}
+	}
+	return value
+}
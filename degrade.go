@@ -0,0 +1,117 @@
+package restful
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/globalsign/mgo"
+)
+
+// interval of checking the primary of db
+const primaryCheckInterval = 3 * time.Second
+
+// seconds suggested to retry writes in read-only mode
+const readOnlyRetryAfter = 10
+
+// unix timestamp since when db is read-only, 0 if primary available
+var gReadOnlySince int64
+
+// unix timestamp of the last check of primary
+var gPrimaryChecked int64
+
+// RspStatusData is the returning structure in `data` field of GET /__status
+type RspStatusData struct {
+	ReadOnly bool  `json:"read_only"` // primary unavailable, reads served by secondaries and writes rejected
+	Since    int64 `json:"since,omitempty"`
+	Checked  int64 `json:"checked"` // unix timestamp of the last check of primary
+}
+
+// isReadOnly check db is degraded to read-only or not
+func isReadOnly() bool {
+	return atomic.LoadInt64(&gReadOnlySince) > 0
+}
+
+// readSession clones the session for reads, reading from secondaries if degraded to read-only,
+// then the session is copied and refreshed, so the socket reserved to the unavailable primary is not kept
+func readSession() *mgo.Session {
+	if isReadOnly() {
+		dbs := gCfg.MgoSess.Copy()
+		dbs.SetMode(mgo.SecondaryPreferred, true)
+		return dbs
+	}
+	return gCfg.MgoSess.Clone()
+}
+
+// primaryMonitorTask checks the primary of db, degrades to read-only if unavailable
+func primaryMonitorTask() {
+	for {
+		dbs := gCfg.MgoSess.Copy()
+		dbs.SetMode(mgo.Primary, true)
+		dbs.SetSyncTimeout(primaryCheckInterval)
+		dbs.SetSocketTimeout(primaryCheckInterval)
+		err := dbs.Ping()
+		dbs.Close()
+
+		now := time.Now().Unix()
+		atomic.StoreInt64(&gPrimaryChecked, now)
+		if err != nil {
+			if atomic.CompareAndSwapInt64(&gReadOnlySince, 0, now) {
+				Log.Warnf("db primary unavailable, degrade to read-only, err: %v", err)
+			}
+		} else if old := atomic.SwapInt64(&gReadOnlySince, 0); old > 0 {
+			Log.Warnf("db primary available, recover from read-only since %v", old)
+		}
+		time.Sleep(primaryCheckInterval)
+	}
+}
+
+// readOnlyRsp is the response of writes rejected in read-only mode
+func readOnlyRsp() *Rsp {
+	rsp := genRsp(http.StatusServiceUnavailable, "cluster read-only", nil)
+	rsp.SetHeader("Retry-After", strconv.Itoa(readOnlyRetryAfter))
+	return rsp
+}
+
+// degradeHandler rejects writes in read-only mode
+func degradeHandler(h Handler) Handler {
+	if !gCfg.DegradeReadOnly {
+		return h
+	}
+	return func(vars map[string]string, query url.Values, body []byte) *Rsp {
+		if isReadOnly() {
+			Log.Warnf("[rsp] %v write rejected, cluster read-only", query.Get("reqid"))
+			return readOnlyRsp()
+		}
+		return h(vars, query, body)
+	}
+}
+
+// degradeTrigger wraps the trigger handler like degradeHandler, except verify_password,
+// which only reads and keeps authenticating callers when read-only
+func degradeTrigger(h Handler) Handler {
+	degraded := degradeHandler(h)
+	return func(vars map[string]string, query url.Values, body []byte) *Rsp {
+		var req struct {
+			Type string `json:"type"`
+		}
+		if json.Unmarshal(body, &req) == nil && req.Type == "verify_password" {
+			return h(vars, query, body)
+		}
+		return degraded(vars, query, body)
+	}
+}
+
+func defaultStatus() Handler {
+	return func(vars map[string]string, query url.Values, body []byte) *Rsp {
+		data := RspStatusData{
+			ReadOnly: isReadOnly(),
+			Since:    atomic.LoadInt64(&gReadOnlySince),
+			Checked:  atomic.LoadInt64(&gPrimaryChecked),
+		}
+		return genRsp(http.StatusOK, "status ok", data)
+	}
+}
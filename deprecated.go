@@ -0,0 +1,85 @@
+package restful
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// deprecatedHandler adds warnings to the response of writes succeeded with deprecated fields,
+// and counts the writes of each deprecated field
+func (p *Processor) deprecatedHandler(h Handler) Handler {
+	if len(p.deprecatedWrites) == 0 {
+		return h
+	}
+	return func(vars map[string]string, query url.Values, body []byte) *Rsp {
+		rsp := h(vars, query, body)
+		if rsp == nil || rsp.Code != http.StatusOK {
+			return rsp
+		}
+		var info map[string]interface{}
+		if err := json.Unmarshal(body, &info); err != nil {
+			return rsp
+		}
+		fields := p.deprecatedFieldsIn(info, "")
+		for _, field := range fields {
+			atomic.AddInt64(p.deprecatedWrites[field], 1)
+			rsp.Warnings = append(rsp.Warnings, fmt.Sprintf("field %s is deprecated", field))
+		}
+		if len(fields) > 0 {
+			Log.Debugf("%v deprecated fields %v written", p.Biz, fields)
+		}
+		return rsp
+	}
+}
+
+// deprecatedFieldsIn get the deprecated fields written in info, keys can be paths like a.b or update operators like $push
+func (p *Processor) deprecatedFieldsIn(info map[string]interface{}, prefix string) []string {
+	found := make(map[string]bool)
+	for k, value := range info {
+		if prefix == "" && strings.HasPrefix(k, "$") {
+			if m, ok := value.(map[string]interface{}); ok {
+				for _, field := range p.deprecatedFieldsIn(m, "") {
+					found[field] = true
+				}
+			}
+			continue
+		}
+		path := prefix + k
+		deprecated := false
+		// the field or its parent deprecated
+		for i := 0; i <= len(path); i++ {
+			if i == len(path) || path[i] == '.' {
+				if _, ok := p.deprecatedWrites[path[:i]]; ok {
+					found[path[:i]] = true
+					deprecated = true
+					break
+				}
+			}
+		}
+		if m, ok := value.(map[string]interface{}); ok && !deprecated {
+			for _, field := range p.deprecatedFieldsIn(m, path+".") {
+				found[field] = true
+			}
+		}
+	}
+	fields := make([]string, 0, len(found))
+	for field := range found {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// DeprecatedWrites returns the writes of each deprecated field since started
+func (p *Processor) DeprecatedWrites() map[string]int64 {
+	writes := make(map[string]int64)
+	for field, n := range p.deprecatedWrites {
+		writes[field] = atomic.LoadInt64(n)
+	}
+	return writes
+}
@@ -0,0 +1,174 @@
+package restful
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// validateDocument runs Processor.ValidateDocument on the doc written, after fields checked
+// old is the doc stored, nil if creating, and new is the doc after written, both with '_id' field and names in API
+func (p *Processor) validateDocument(old, new map[string]interface{}) *Rsp {
+	if p.ValidateDocument == nil {
+		return nil
+	}
+	if err := p.ValidateDocument(old, new); err != nil {
+		return genRsp(http.StatusBadRequest, err.Error(), nil)
+	}
+	return nil
+}
+
+// checkDocumentUpdate runs Processor.ValidateDocument on the doc stored and the doc after update applied,
+// the doc stored is migrated to the current schema version first
+// info replacing the doc if update is nil, as PUT, the doc not found is created by info,
+// the seq of the doc validated is required by guard, so the doc written is not validated against a stale one
+func (p *Processor) checkDocumentUpdate(dbc *mgo.Collection, id interface{}, info map[string]interface{}, update map[string]interface{}, guard *writeGuard) *Rsp {
+	if p.ValidateDocument == nil {
+		return nil
+	}
+	var old map[string]interface{}
+	err := dbc.Find(bson.M{"_id": id}).One(&old)
+	if err == mgo.ErrNotFound {
+		if update != nil {
+			// PATCH fails by id not found
+			return nil
+		}
+		guard.add(bson.M{"seq": bson.M{"$exists": false}}, "doc modified concurrently")
+		return p.validateDocument(nil, info)
+	}
+	if err != nil {
+		return genRsp(http.StatusInternalServerError, "db access fail", nil)
+	}
+	guard.add(bson.M{"seq": old["seq"]}, "doc modified concurrently")
+	// validated by the current schema version
+	if _, err = p.FieldSet.Migrate(old); err != nil {
+		return genRsp(http.StatusInternalServerError, "migrate fail", nil)
+	}
+	p.FieldSet.apiNames(old)
+	if update == nil {
+		return p.validateDocument(old, info)
+	}
+	doc := copyValue(old).(map[string]interface{})
+	applyUpdate(doc, update)
+	return p.validateDocument(old, doc)
+}
+
+// copyValue deep copies objects and arrays of value
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}, bson.M:
+		m := docMap(v)
+		c := make(map[string]interface{}, len(m))
+		for k, elem := range m {
+			c[k] = copyValue(elem)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, elem := range v {
+			c[i] = copyValue(elem)
+		}
+		return c
+	}
+	return value
+}
+
+// setPath sets the value of path in doc, creating objects through
+func setPath(doc map[string]interface{}, path string, value interface{}) {
+	pos := strings.Index(path, ".")
+	if pos == -1 {
+		doc[path] = value
+		return
+	}
+	var sub map[string]interface{}
+	switch v := doc[path[:pos]].(type) {
+	case map[string]interface{}:
+		sub = v
+	case bson.M:
+		sub = v
+	default:
+		sub = make(map[string]interface{})
+		doc[path[:pos]] = sub
+	}
+	setPath(sub, path[pos+1:], value)
+}
+
+// applyUpdate applies the update of PATCH built to the doc in memory, as MongoDB does
+func applyUpdate(doc map[string]interface{}, update map[string]interface{}) {
+	for op, v := range update {
+		for k, value := range docMap(v) {
+			old, _ := lookupPath(doc, k)
+			switch op {
+			case "$set":
+				setPath(doc, k, value)
+			case "$unset":
+				removePath(doc, k)
+			case "$inc":
+				setPath(doc, k, addNumber(old, value))
+			case "$push", "$addToSet":
+				arr, _ := old.([]interface{})
+				arr = append([]interface{}{}, arr...)
+				each, _ := docMap(value)["$each"].([]interface{})
+				for _, elem := range each {
+					if op == "$addToSet" && containsValue(arr, elem) {
+						continue
+					}
+					arr = append(arr, elem)
+				}
+				setPath(doc, k, arr)
+			case "$pull":
+				arr, ok := old.([]interface{})
+				if !ok {
+					continue
+				}
+				pulled := []interface{}{value}
+				if in, ok := docMap(value)["$in"].([]interface{}); ok {
+					pulled = in
+				}
+				kept := make([]interface{}, 0, len(arr))
+				for _, elem := range arr {
+					if !containsValue(pulled, elem) {
+						kept = append(kept, elem)
+					}
+				}
+				setPath(doc, k, kept)
+			}
+		}
+	}
+}
+
+// addNumber adds the delta to the number, absent as 0, int if both int
+func addNumber(n, delta interface{}) interface{} {
+	_, floatN := n.(float64)
+	_, floatDelta := delta.(float64)
+	if !floatN && !floatDelta {
+		a, b := CheckInt(n), CheckInt(delta)
+		if a == nil {
+			a = int64(0)
+		}
+		if b == nil {
+			return n
+		}
+		return a.(int64) + b.(int64)
+	}
+	x, y := CheckFloat(n), CheckFloat(delta)
+	if x == nil {
+		x = float64(0)
+	}
+	if y == nil {
+		return n
+	}
+	return x.(float64) + y.(float64)
+}
+
+// containsValue check the array contains the value or not, ignoring number types
+func containsValue(arr []interface{}, value interface{}) bool {
+	for _, elem := range arr {
+		if sameValue(elem, value) {
+			return true
+		}
+	}
+	return false
+}
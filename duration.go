@@ -0,0 +1,29 @@
+package restful
+
+import (
+	"reflect"
+	"time"
+)
+
+// Duration is the type of duration field in DataStruct, stored as integer seconds
+// "90s", "1h30m" or integer seconds accepted when written or filtered, e.g.: timeout
+type Duration int64
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// CheckDuration check value type
+// if value is a duration string like "1h30m" in whole seconds, or integer seconds, return INT64 seconds
+// if value is not any type represent DURATION, return nil
+func CheckDuration(value interface{}) interface{} {
+	if s, ok := value.(string); ok {
+		d, err := time.ParseDuration(s)
+		if err != nil || d%time.Second != 0 {
+			return nil
+		}
+		return int64(d / time.Second)
+	}
+	if CheckIntegral(value, false) != "" {
+		return nil
+	}
+	return CheckInt(value)
+}
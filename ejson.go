@@ -0,0 +1,208 @@
+package restful
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// the time format of $date in extended JSON
+const extJSONDateFormat = "2006-01-02T15:04:05.999Z07:00"
+
+// isExtJSON check the request wants MongoDB Extended JSON or not
+// e.g.: /path?ejson=true
+func isExtJSON(query url.Values) bool {
+	return strings.ToLower(query.Get("ejson")) == "true"
+}
+
+// ToExtJSON converts the values read from db to MongoDB Extended JSON v2 (relaxed mode)
+// so Mongo-specific types like Decimal128, dates and binary can be round-tripped
+func ToExtJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case bson.M:
+		m := make(map[string]interface{}, len(v))
+		for k, elem := range v {
+			m[k] = ToExtJSON(elem)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, elem := range v {
+			m[k] = ToExtJSON(elem)
+		}
+		return m
+	case bson.D:
+		m := make(map[string]interface{}, len(v))
+		for _, elem := range v {
+			m[elem.Name] = ToExtJSON(elem.Value)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, 0, len(v))
+		for _, elem := range v {
+			a = append(a, ToExtJSON(elem))
+		}
+		return a
+	case time.Time:
+		return map[string]interface{}{"$date": v.UTC().Format(extJSONDateFormat)}
+	case bson.Decimal128:
+		return map[string]interface{}{"$numberDecimal": v.String()}
+	case Decimal:
+		return map[string]interface{}{"$numberDecimal": string(v)}
+	case bson.ObjectId:
+		return map[string]interface{}{"$oid": v.Hex()}
+	case []byte:
+		return map[string]interface{}{"$binary": map[string]interface{}{
+			"base64":  base64.StdEncoding.EncodeToString(v),
+			"subType": "00",
+		}}
+	case bson.Binary:
+		return map[string]interface{}{"$binary": map[string]interface{}{
+			"base64":  base64.StdEncoding.EncodeToString(v.Data),
+			"subType": fmt.Sprintf("%02x", v.Kind),
+		}}
+	case bson.MongoTimestamp:
+		return map[string]interface{}{"$timestamp": map[string]interface{}{
+			"t": uint64(v) >> 32,
+			"i": uint32(v),
+		}}
+	case bson.RegEx:
+		return map[string]interface{}{"$regularExpression": map[string]interface{}{
+			"pattern": v.Pattern,
+			"options": v.Options,
+		}}
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return map[string]interface{}{"$numberDouble": strconv.FormatFloat(v, 'g', -1, 64)}
+		}
+	}
+	return value
+}
+
+// FromExtJSON converts the values in MongoDB Extended JSON v2 (canonical or relaxed mode) to the types stored in db
+func FromExtJSON(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) == 1 {
+			for k, elem := range v {
+				if strings.HasPrefix(k, "$") {
+					return fromExtJSONWrapper(k, elem)
+				}
+			}
+		}
+		m := make(map[string]interface{}, len(v))
+		for k, elem := range v {
+			e, err := FromExtJSON(elem)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = e
+		}
+		return m, nil
+	case []interface{}:
+		a := make([]interface{}, 0, len(v))
+		for _, elem := range v {
+			e, err := FromExtJSON(elem)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, e)
+		}
+		return a, nil
+	}
+	return value, nil
+}
+
+func fromExtJSONWrapper(k string, value interface{}) (interface{}, error) {
+	switch k {
+	case "$date":
+		switch v := value.(type) {
+		case string:
+			t, err := time.Parse(extJSONDateFormat, v)
+			if err != nil {
+				return nil, fmt.Errorf("$date %v invalid", v)
+			}
+			return t, nil
+		case map[string]interface{}:
+			n, err := strconv.ParseInt(GetString(v["$numberLong"]), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("$date %v invalid", v)
+			}
+			return time.Unix(n/1000, n%1000*1e6).UTC(), nil
+		}
+		return nil, fmt.Errorf("$date %v invalid", value)
+	case "$numberDecimal":
+		d, err := bson.ParseDecimal128(GetString(value))
+		if err != nil {
+			return nil, fmt.Errorf("$numberDecimal %v invalid", value)
+		}
+		return d, nil
+	case "$numberLong":
+		n, err := strconv.ParseInt(GetString(value), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("$numberLong %v invalid", value)
+		}
+		return n, nil
+	case "$numberInt":
+		n, err := strconv.ParseInt(GetString(value), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("$numberInt %v invalid", value)
+		}
+		return int32(n), nil
+	case "$numberDouble":
+		f, err := strconv.ParseFloat(GetString(value), 64)
+		if err != nil {
+			return nil, fmt.Errorf("$numberDouble %v invalid", value)
+		}
+		return f, nil
+	case "$oid":
+		s := GetString(value)
+		if !bson.IsObjectIdHex(s) {
+			return nil, fmt.Errorf("$oid %v invalid", value)
+		}
+		return bson.ObjectIdHex(s), nil
+	case "$binary":
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("$binary %v invalid", value)
+		}
+		data, err := base64.StdEncoding.DecodeString(GetString(m["base64"]))
+		if err != nil {
+			return nil, fmt.Errorf("$binary %v invalid", value)
+		}
+		kind, err := hex.DecodeString(GetString(m["subType"]))
+		if err != nil || len(kind) != 1 {
+			return nil, fmt.Errorf("$binary %v subType invalid", value)
+		}
+		if kind[0] == 0 {
+			return data, nil
+		}
+		return bson.Binary{Kind: kind[0], Data: data}, nil
+	case "$timestamp":
+		m, ok := value.(map[string]interface{})
+		t, i := CheckUint(m["t"]), CheckUint(m["i"])
+		if !ok || t == nil || i == nil {
+			return nil, fmt.Errorf("$timestamp %v invalid", value)
+		}
+		return bson.MongoTimestamp(t.(uint64)<<32 | uint64(uint32(i.(uint64)))), nil
+	case "$regularExpression":
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("$regularExpression %v invalid", value)
+		}
+		return bson.RegEx{Pattern: GetString(m["pattern"]), Options: GetString(m["options"])}, nil
+	}
+	// not a type wrapper, e.g. an operator
+	e, err := FromExtJSON(value)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{k: e}, nil
+}
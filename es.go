@@ -2,40 +2,38 @@ package restful
 
 import (
 	"bytes"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
 
-var gEsURL = "http://127.0.0.1:9200"
-var gEsUser = ""
-var gEsPwd = ""
 var gEsIndex = "restful"
 var gEsIndexAnalyzer = "ik_max_word"
 var gEsIndexSearchAnalyzer = "ik_max_word"
 
-var gEsIndexConfigFmt = `{
-    "mappings":{
-        "_doc":{
-            "properties":{
-                "db":{
-                    "type": "keyword"
-                },
-                "table":{
-                    "type": "keyword"
-                },
-                "content":{
-                    "type": "text",
-                    "analyzer": "%s",
-                    "search_analyzer": "%s"
-                }
-            }
+// mapping of the index, typed by _doc for es before 7, see esCluster.typeless
+var gEsIndexMappingFmt = `{
+    "properties":{
+        "db":{
+            "type": "keyword"
+        },
+        "table":{
+            "type": "keyword"
+        },
+        "content":{
+            "type": "text",
+            "analyzer": "%s",
+            "search_analyzer": "%s"
         }
-    },
+    }
+}`
+
+var gEsIndexConfigFmt = `{
+    "mappings": %s,
     "settings":{
         "index":{
             "number_of_shards" : 1,
@@ -45,16 +43,112 @@ var gEsIndexConfigFmt = `{
     }
 }`
 
-func initEsParam(url, user, pwd, index, analyzer, searchAnalyzer string) error {
-	if url != "" {
-		gEsURL = url
-		gEsURL = strings.TrimSuffix(gEsURL, "/")
+// A set of es refresh policy after data write
+const (
+	EsRefreshNone      = "none"      // do not refresh, data searchable after es refresh interval
+	EsRefreshWaitFor   = "wait_for"  // wait for es refresh before write request returns
+	EsRefreshImmediate = "immediate" // refresh es immediately, heavy for es
+)
+
+func isEsRefreshValid(refresh string) bool {
+	switch refresh {
+	case EsRefreshNone, EsRefreshWaitFor, EsRefreshImmediate:
+		return true
+	}
+	return false
+}
+
+func getEsRefreshParam(refresh string) string {
+	switch refresh {
+	case EsRefreshWaitFor:
+		return "?refresh=wait_for"
+	case EsRefreshImmediate:
+		return "?refresh=true"
+	}
+	return ""
+}
+
+// esCluster describes the distribution and major version of es cluster, which decide the apis used
+type esCluster struct {
+	Distribution string // elasticsearch or opensearch
+	Major        int    // major version
+}
+
+// es cluster detected when init, or set by GlobalConfig.EsVersion
+var gEsCluster = esCluster{Distribution: "elasticsearch", Major: 7}
+
+// typeless check mapping types removed or not, since es 7 and in all opensearch versions
+func (c esCluster) typeless() bool {
+	return c.Distribution == "opensearch" || c.Major >= 7
+}
+
+// parseEsVersion parse the version like "8", "7.17.0", "opensearch" or "opensearch 2.11.0"
+func parseEsVersion(version string) (esCluster, error) {
+	c := esCluster{Distribution: "elasticsearch"}
+	fields := strings.Fields(strings.ToLower(version))
+	if len(fields) > 0 && (fields[0] == "opensearch" || fields[0] == "elasticsearch") {
+		c.Distribution = fields[0]
+		fields = fields[1:]
 	}
-	if user != "" {
-		gEsUser = user
+	if len(fields) == 0 {
+		if c.Distribution == "opensearch" {
+			c.Major = 1
+			return c, nil
+		}
+		return c, fmt.Errorf("es version %s invalid", version)
 	}
-	if pwd != "" {
-		gEsPwd = pwd
+	major, err := strconv.Atoi(strings.SplitN(fields[0], ".", 2)[0])
+	if err != nil || major <= 0 {
+		return c, fmt.Errorf("es version %s invalid", version)
+	}
+	c.Major = major
+	return c, nil
+}
+
+// esDetectVersion get the version of es cluster by its root api
+func esDetectVersion() (esCluster, error) {
+	statusCode, rspData, err := esDo("GET", "/", nil)
+	if err != nil {
+		return esCluster{}, fmt.Errorf("detect es version err: %v", err)
+	}
+	var rsp struct {
+		Version struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+	if statusCode != http.StatusOK || json.Unmarshal(rspData, &rsp) != nil {
+		return esCluster{}, fmt.Errorf("detect es version err: %s", string(rspData))
+	}
+	return parseEsVersion(strings.TrimSpace(rsp.Version.Distribution + " " + rsp.Version.Number))
+}
+
+// esIndexConfig get the config of index creating, mappings typed or not by the cluster
+func esIndexConfig(c esCluster) string {
+	mapping := fmt.Sprintf(gEsIndexMappingFmt, gEsIndexAnalyzer, gEsIndexSearchAnalyzer)
+	if !c.typeless() {
+		mapping = fmt.Sprintf(`{"_doc": %s}`, mapping)
+	}
+	return fmt.Sprintf(gEsIndexConfigFmt, mapping)
+}
+
+// initEsParam init es endpoints and index, version like "8" or "opensearch" is detected if empty
+func initEsParam(urls []string, user, pwd, version, index, analyzer, searchAnalyzer string) error {
+	if err := initEsEndpoints(urls, user, pwd); err != nil {
+		return err
+	}
+	if version != "" {
+		c, err := parseEsVersion(version)
+		if err != nil {
+			return err
+		}
+		gEsCluster = c
+	} else if c, err := esDetectVersion(); err != nil {
+		// root api may be denied to the user, typeless as es 7 and later
+		Log.Warnf("%v, typeless mappings as elasticsearch 7 assumed, set GlobalConfig.EsVersion if not", err)
+		gEsCluster = esCluster{Distribution: "elasticsearch", Major: 7}
+	} else {
+		gEsCluster = c
 	}
 	if index != "" {
 		gEsIndex = index
@@ -65,23 +159,19 @@ func initEsParam(url, user, pwd, index, analyzer, searchAnalyzer string) error {
 	if searchAnalyzer != "" {
 		gEsIndexSearchAnalyzer = searchAnalyzer
 	}
-	indexCfg := fmt.Sprintf(gEsIndexConfigFmt, gEsIndexAnalyzer, gEsIndexSearchAnalyzer)
-	return esEnsureIndex(indexCfg)
+	return esEnsureIndex(esIndexConfig(gEsCluster))
 }
 
+// esEnsureIndex creates the index if not exists
+// es 7 accepts typeless mappings too, so include_type_name, removed by es 8 and opensearch, is never sent
 func esEnsureIndex(indexCfg string) error {
-	url := fmt.Sprintf("%s/%s?include_type_name=true", gEsURL, gEsIndex)
-	header := make(map[string]string)
-	header["Content-Type"] = "application/json; charset=utf-8"
-	if gEsUser != "" || gEsPwd != "" {
-		header["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(gEsUser+":"+gEsPwd))
-	}
-	statusCode, _, err := httpDo(url, "", "GET", header, nil)
+	path := fmt.Sprintf("/%s", gEsIndex)
+	statusCode, _, err := esDo("GET", path, nil)
 	if err != nil {
 		return fmt.Errorf("ensure es index get err: %v", err)
 	}
 	if statusCode == http.StatusNotFound {
-		statusCode, indexPutRspData, err := httpDo(url, "", "PUT", header, []byte(indexCfg))
+		statusCode, indexPutRspData, err := esDo("PUT", path, []byte(indexCfg))
 		if err != nil {
 			return fmt.Errorf("ensure es index http err: %v", err)
 		}
@@ -102,7 +192,8 @@ type SearchResponse struct {
 	Hits struct {
 		Total int64 `json:"total"`
 		Hits  []struct {
-			ID     string `json:"_id"`
+			ID     string  `json:"_id"`
+			Score  float64 `json:"_score"`
 			Source struct {
 				Db      string `json:"db"`
 				Table   string `json:"table"`
@@ -112,7 +203,7 @@ type SearchResponse struct {
 	} `json:"hits"`
 }
 
-func esUpsert(db, table, id, content string) error {
+func esUpsert(db, table, id, content, refresh string) error {
 	req := map[string]interface{}{
 		"db":      db,
 		"table":   table,
@@ -120,13 +211,8 @@ func esUpsert(db, table, id, content string) error {
 	}
 	reqData, _ := json.Marshal(req)
 	docID := fmt.Sprintf("%s_%s_%s", db, table, id)
-	destURL := fmt.Sprintf("%s/%s/_doc/%s", gEsURL, gEsIndex, docID)
-	header := make(map[string]string)
-	header["Content-Type"] = "application/json; charset=utf-8"
-	if gEsUser != "" || gEsPwd != "" {
-		header["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(gEsUser+":"+gEsPwd))
-	}
-	statusCode, rspData, err := httpDo(destURL, "", "PUT", header, reqData)
+	path := fmt.Sprintf("/%s/_doc/%s%s", gEsIndex, docID, getEsRefreshParam(refresh))
+	statusCode, rspData, err := esDo("PUT", path, reqData)
 	if err != nil {
 		return err
 	}
@@ -141,15 +227,10 @@ func esUpsert(db, table, id, content string) error {
 	return nil
 }
 
-func esRemove(db, table, id string) error {
+func esRemove(db, table, id, refresh string) error {
 	docID := fmt.Sprintf("%s_%s_%s", db, table, id)
-	destURL := fmt.Sprintf("%s/%s/_doc/%s", gEsURL, gEsIndex, docID)
-	header := make(map[string]string)
-	header["Content-Type"] = "application/json; charset=utf-8"
-	if gEsUser != "" || gEsPwd != "" {
-		header["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(gEsUser+":"+gEsPwd))
-	}
-	statusCode, rspData, err := httpDo(destURL, "", "DELETE", header, nil)
+	path := fmt.Sprintf("/%s/_doc/%s%s", gEsIndex, docID, getEsRefreshParam(refresh))
+	statusCode, rspData, err := esDo("DELETE", path, nil)
 	if err != nil {
 		return err
 	}
@@ -165,6 +246,12 @@ func esRemove(db, table, id string) error {
 }
 
 func esSearch(db, table, search string, size, offset int) ([]string, error) {
+	ids, _, err := esSearchScores(db, table, search, size, offset)
+	return ids, err
+}
+
+// esSearchScores searches docs of table, returns ids and their relevance scores in relevance order
+func esSearchScores(db, table, search string, size, offset int) ([]string, []float64, error) {
 	req := map[string]interface{}{
 		"track_scores": true,
 		"query": map[string]interface{}{
@@ -188,32 +275,108 @@ func esSearch(db, table, search string, size, offset int) ([]string, error) {
 	}
 
 	reqData, _ := json.Marshal(req)
-	url := fmt.Sprintf("%s/%s/_search?rest_total_hits_as_int=true", gEsURL, gEsIndex)
-	header := make(map[string]string)
-	header["Content-Type"] = "application/json; charset=utf-8"
-	if gEsUser != "" || gEsPwd != "" {
-		header["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(gEsUser+":"+gEsPwd))
-	}
-	statusCode, rspData, err := httpDo(url, "", "GET", header, reqData)
+	path := fmt.Sprintf("/%s/_search?rest_total_hits_as_int=true", gEsIndex)
+	statusCode, rspData, err := esDo("GET", path, reqData)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	var rsp SearchResponse
 	err = json.Unmarshal(rspData, &rsp)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if statusCode != http.StatusOK {
-		return nil, fmt.Errorf("EsSearch error %v", rsp.Error.Reason)
+		return nil, nil, fmt.Errorf("EsSearch error %v", rsp.Error.Reason)
 	}
 
 	docIDs := make([]string, 0, len(rsp.Hits.Hits))
+	scores := make([]float64, 0, len(rsp.Hits.Hits))
 	for i := range rsp.Hits.Hits {
 		idPrefix := fmt.Sprintf("%s_%s_", db, table)
 		docIDs = append(docIDs, strings.TrimPrefix(rsp.Hits.Hits[i].ID, idPrefix))
+		scores = append(scores, rsp.Hits.Hits[i].Score)
+	}
+	return docIDs, scores, nil
+}
+
+// esTable describes a db table in es
+type esTable struct {
+	Db    string
+	Table string
+}
+
+// esHit describes a doc hit in es
+type esHit struct {
+	Db    string
+	Table string
+	ID    string
+}
+
+func esSearchTables(tables []esTable, search string, size, offset int) ([]esHit, int64, error) {
+	should := make([]map[string]interface{}, 0, len(tables))
+	for _, t := range tables {
+		should = append(should, map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": []map[string]interface{}{
+					{"term": map[string]interface{}{"db": t.Db}},
+					{"term": map[string]interface{}{"table": t.Table}},
+				},
+			},
+		})
+	}
+	req := map[string]interface{}{
+		"track_scores": true,
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": map[string]interface{}{
+					"bool": map[string]interface{}{
+						"should":               should,
+						"minimum_should_match": 1,
+					},
+				},
+				"must": map[string]interface{}{
+					"match": map[string]interface{}{
+						"content": map[string]interface{}{
+							"query":    search,
+							"operator": "and",
+						},
+					},
+				},
+			},
+		},
+		"_source": []string{"db", "table"},
+		"size":    size,
+		"from":    offset,
+	}
+
+	reqData, _ := json.Marshal(req)
+	path := fmt.Sprintf("/%s/_search?rest_total_hits_as_int=true", gEsIndex)
+	statusCode, rspData, err := esDo("GET", path, reqData)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var rsp SearchResponse
+	err = json.Unmarshal(rspData, &rsp)
+	if err != nil {
+		return nil, 0, err
+	}
+	if statusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("EsSearch error %v", rsp.Error.Reason)
+	}
+
+	hits := make([]esHit, 0, len(rsp.Hits.Hits))
+	for i := range rsp.Hits.Hits {
+		src := rsp.Hits.Hits[i].Source
+		idPrefix := fmt.Sprintf("%s_%s_", src.Db, src.Table)
+		hits = append(hits, esHit{
+			Db:    src.Db,
+			Table: src.Table,
+			ID:    strings.TrimPrefix(rsp.Hits.Hits[i].ID, idPrefix),
+		})
 	}
-	return docIDs, nil
+	return hits, rsp.Hits.Total, nil
 }
 
 var gNetClient = &http.Client{
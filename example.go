@@ -0,0 +1,92 @@
+package restful
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+// Example is an example of a Restful resource returned by introspection, e.g. OPTIONS
+type Example struct {
+	Name  string                 `json:"name"`
+	Doc   map[string]interface{} `json:"doc,omitempty"`   // example document
+	Query string                 `json:"query,omitempty"` // example URL Query of GET list, e.g.: filter={"star":5}&order=["-age"]
+}
+
+// CheckDocument check the doc read from db matches the fields or not
+// unlike CheckObject, read only and create only are ignored and the doc is not modified
+func (fs *FieldSet) CheckDocument(doc map[string]interface{}) error {
+	return fs.checkDocument(doc, "")
+}
+
+func (fs *FieldSet) checkDocument(doc map[string]interface{}, prefix string) error {
+	for k, value := range doc {
+		full := prefix + k
+		kind, ok := fs.IsFieldMember(full)
+		if !ok {
+			return fmt.Errorf("field %s unknown", full)
+		}
+		if value == nil {
+			continue
+		}
+		v := ParseKindValue(value, kind)
+		if v == nil {
+			return fmt.Errorf("field %s type mismatch", full)
+		}
+		switch kind {
+		case KindObject:
+			if err := fs.checkDocument(v.(map[string]interface{}), full+"."); err != nil {
+				return err
+			}
+		case KindArrayObject:
+			for _, elem := range v.([]interface{}) {
+				if err := fs.checkDocument(elem.(map[string]interface{}), full+"."); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkExamples check the example docs and queries match the fields or not
+func (p *Processor) checkExamples(report *InitReport) {
+	for _, example := range p.Examples {
+		if example.Doc != nil {
+			// round trip as json, the same as a doc received
+			var doc map[string]interface{}
+			buf, err := json.Marshal(example.Doc)
+			if err == nil {
+				err = json.Unmarshal(buf, &doc)
+			}
+			if err == nil {
+				err = p.FieldSet.CheckDocument(doc)
+			}
+			if err != nil {
+				report.Add(p.Biz, "example %s doc invalid: %s", example.Name, err.Error())
+			}
+		}
+		if example.Query != "" {
+			query, err := url.ParseQuery(example.Query)
+			if err != nil {
+				report.Add(p.Biz, "example %s query invalid: %s", example.Name, err.Error())
+				continue
+			}
+			// search depends on es or db, skipped
+			query.Del("search")
+			if _, _, errRsp := p.buildCondition("init", query); errRsp != nil {
+				report.Add(p.Biz, "example %s query invalid: %s", example.Name, errRsp.Msg)
+			}
+			if query.Get("select") != "" {
+				var selSlice []string
+				err := json.Unmarshal([]byte(query.Get("select")), &selSlice)
+				if err == nil {
+					err = p.FieldSet.BuildSelectObj(selSlice, make(map[string]interface{}))
+				}
+				if err != nil {
+					report.Add(p.Biz, "example %s query select invalid", example.Name)
+				}
+			}
+		}
+	}
+}
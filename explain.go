@@ -0,0 +1,27 @@
+package restful
+
+import (
+	"github.com/globalsign/mgo/bson"
+)
+
+// RspExplainData is the returning structure in `data` field of GET /{biz}?explain=true
+type RspExplainData struct {
+	Condition map[string]interface{} `json:"condition"`          // condition built from filters
+	Order     []string               `json:"order"`              // sort built from order
+	Select    map[string]interface{} `json:"select"`             // projection built from select and slice
+	Pipeline  []bson.M               `json:"pipeline,omitempty"` // aggregate run instead of find, e.g. order by _score
+	Plan      interface{}            `json:"plan"`               // winning plan of db query planner
+}
+
+// winningPlan get the winning plan from the explain result of db, or the whole result if not found
+func winningPlan(explain interface{}) interface{} {
+	m := docMap(explain)
+	// pipeline explain has stages, the first is the cursor
+	if stages, ok := m["stages"].([]interface{}); ok && len(stages) > 0 {
+		m = docMap(docMap(stages[0])["$cursor"])
+	}
+	if planner, ok := docMap(m["queryPlanner"])["winningPlan"]; ok {
+		return planner
+	}
+	return explain
+}
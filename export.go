@@ -0,0 +1,189 @@
+package restful
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// docs fetched in one batch of cursor when exporting
+const exportBatchSize = 500
+
+// ExportColumns get the flattened columns of CSV export, object fields are expanded to their members
+// fields are selected fields, all fields if empty
+func (fs *FieldSet) ExportColumns(fields []string) []string {
+	columns := make([]string, 0)
+	for _, name := range fs.FSli {
+		if len(fields) > 0 {
+			selected := false
+			for _, field := range fields {
+				if name == field || strings.HasPrefix(name, field+".") {
+					selected = true
+					break
+				}
+			}
+			if !selected {
+				continue
+			}
+		}
+		// members of object are columns
+		if fs.FMap[name].Kind == KindObject {
+			continue
+		}
+		// members of array or map of object are in the json cell of the field
+		if i := strings.LastIndex(name, "."); i > 0 {
+			if kind := fs.FMap[name[:i]].Kind; kind == KindArrayObject || kind == KindMapObject {
+				continue
+			}
+		}
+		columns = append(columns, name)
+	}
+	return columns
+}
+
+// exportCell get the value of column in doc as CSV cell
+// arrays and maps are encoded as json
+func exportCell(doc map[string]interface{}, column string) string {
+	var value interface{} = doc
+	for _, k := range strings.Split(column, ".") {
+		m := docMap(value)
+		v, ok := m[k]
+		if !ok {
+			return ""
+		}
+		value = v
+	}
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool, int, int32, int64, uint32, uint64, float32, float64:
+		return fmt.Sprint(v)
+	}
+	buf, _ := json.Marshal(ToExtJSON(value))
+	return string(buf)
+}
+
+func (p *Processor) defaultExport() StreamHandler {
+	return func(vars map[string]string, query url.Values, r *http.Request, w http.ResponseWriter) *Rsp {
+		begin := time.Now()
+		reqID := query.Get("reqid")
+		if reqID == "" {
+			reqID = "sys_" + RandString(8)
+		}
+		Log.Debugf("[req] %v GET %v/__export query=%v", reqID, p.URLPath, query)
+
+		format := query.Get("format")
+		if format != "csv" && format != "ndjson" {
+			Log.Warnf("[rsp] %v GET %v/__export format %v invalid", reqID, p.URLPath, format)
+			return genRsp(http.StatusBadRequest, "format should be csv or ndjson", nil)
+		}
+
+		condition, empty, errRsp := p.buildCondition(reqID, query)
+		if errRsp != nil {
+			return errRsp
+		}
+		if err := p.checkIndexedQuery(condition, nil); err != nil {
+			Log.Warnf("[rsp] %v GET %v/__export %v", reqID, p.URLPath, err)
+			return genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+
+		var selSlice []string
+		selector := make(map[string]interface{})
+		if query.Get("select") != "" {
+			err := json.Unmarshal([]byte(query.Get("select")), &selSlice)
+			if err != nil {
+				Log.Warnf("[rsp] %v GET %v/__export unmarshal select error: %v", reqID, p.URLPath, err)
+				return genRsp(http.StatusBadRequest, "select invalid", nil)
+			}
+			err = p.FieldSet.BuildSelectObj(selSlice, selector)
+			if err != nil {
+				Log.Warnf("[rsp] %v GET %v/__export select param invalid, %v", reqID, p.URLPath, err)
+				return genRsp(http.StatusBadRequest, err.Error(), nil)
+			}
+			p.FieldSet.InReplace(&selector)
+		}
+		Log.Debugf("[req] %v condition=%v select=%v", reqID, condition, selector)
+
+		ext := format
+		contentType := "application/x-ndjson"
+		if format == "csv" {
+			contentType = "text/csv; charset=utf-8"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s\"", p.Biz, ext))
+		w.WriteHeader(http.StatusOK)
+		flusher, _ := w.(http.Flusher)
+
+		var columns []string
+		var csvWriter *csv.Writer
+		if format == "csv" {
+			columns = p.FieldSet.ExportColumns(p.FieldSet.SelectedFields(selSlice))
+			csvWriter = csv.NewWriter(w)
+			csvWriter.Write(columns)
+		}
+		extJSON := isExtJSON(query)
+
+		count := 0
+		if !empty {
+			dbs := readSession()
+			defer dbs.Close()
+			dbc := dbs.DB(p.GetDbName(query)).C(p.GetTableName(query))
+
+			iter := limitRegex(dbc.Find(countCondition(condition)), condition).Select(selector).Sort("_id").Batch(exportBatchSize).Iter()
+			var doc bson.M
+			for iter.Next(&doc) {
+				info := map[string]interface{}(doc)
+				if err := p.FieldSet.OutReplace(&info); err != nil {
+					// body is partially written, can only be logged
+					Log.Warnf("[rsp] %v GET %v/__export stopped after %d docs: %v", reqID, p.URLPath, count, err)
+					break
+				}
+				p.redactFields(query, []interface{}{info})
+				if csvWriter != nil {
+					row := make([]string, 0, len(columns))
+					for _, column := range columns {
+						row = append(row, exportCell(info, column))
+					}
+					csvWriter.Write(row)
+				} else {
+					var line []byte
+					if extJSON {
+						line, _ = json.Marshal(ToExtJSON(info))
+					} else {
+						line, _ = json.Marshal(info)
+					}
+					w.Write(append(line, '\n'))
+				}
+				count++
+				if count%exportBatchSize == 0 {
+					if csvWriter != nil {
+						csvWriter.Flush()
+					}
+					if flusher != nil {
+						flusher.Flush()
+					}
+				}
+				doc = nil
+			}
+			if err := iter.Close(); err != nil {
+				// body is partially written, can only be logged
+				Log.Warnf("[rsp] %v GET %v/__export iter error after %d docs: %v", reqID, p.URLPath, count, err)
+			}
+		}
+		if csvWriter != nil {
+			csvWriter.Flush()
+		}
+
+		costMs := time.Since(begin).Nanoseconds() / int64(time.Millisecond)
+		Log.Warnf("[rsp] %v success, %d docs exported, cost %vms", reqID, count, costMs)
+		return nil
+	}
+}
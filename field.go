@@ -2,8 +2,12 @@ package restful
 
 import (
 	"fmt"
+	"math"
 	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/globalsign/mgo/bson"
 )
@@ -17,6 +21,12 @@ const (
 	KindFloat       = uint(reflect.Float64)
 	KindString      = uint(reflect.String)
 	KindObject      = uint(reflect.Struct)
+	KindDate        = uint(100)
+	KindDuration    = uint(101)
+	KindGeo         = uint(102)
+	KindDecimal     = uint(103)
+	KindBinary      = uint(104)
+	KindAny         = uint(105)
 	KindSimpleEnd   = uint(999)
 	KindArrayBase   = uint(1000)
 	KindArrayBool   = KindArrayBase + KindBool
@@ -41,25 +51,148 @@ type Field struct {
 	Kind       uint // field's kind
 	CreateOnly bool // field can only be written when creating by POST or PUT
 	ReadOnly   bool // field can not be written or update, data should be loaded into DB by other ways
+	NFC        bool // string value will be normalized to unicode NFC form before written
+	Coerce     bool // string value will be converted to bool or number of the field's kind
+	Rounded    bool // float value will be rounded to Precision decimal places before written
+	Precision  int  // decimal places of float value if Rounded
+	Hidden     bool // field is stripped from responses even when stored
+	Wildcard   bool // object of recursive type below max depth, members are not validated
+
+	// constraints declared by `restful` tag, see tags.go
+	Min *float64 // min value of number, nil if unlimited
+	Max *float64 // max value of number, nil if unlimited
+
+	MinLen  *int           // min length of string in characters, or binary in bytes, nil if unlimited
+	MaxLen  *int           // max length of string in characters, or binary in bytes, nil if unlimited
+	Pattern *regexp.Regexp // regexp string should match, nil if any
+	Enum    []interface{}  // values allowed of string, int or uint, nil if any
+
+	MinItems *int // min number of array elements, nil if unlimited
+	MaxItems *int // max number of array elements, nil if unlimited
+
+	Trim     bool // string value is trimmed of leading and trailing whitespace before written
+	Lower    bool // string value is lowercased before written
+	Collapse bool // whitespace runs in string value are collapsed into one space before written
 }
 
 // FieldSet is a structure to store DataStruct fields parsing result
 type FieldSet struct {
 	FMap map[string]Field // fields map
 	FSli []string         // fields ordered
+
+	stats *fieldStats // sampled access statistics, nil if disabled
+
+	strictNumber bool           // reject non-integral or out of range numbers instead of truncating
+	hidden       []string       // fields stripped from responses
+	coerceFilter bool           // convert string value in filters to bool or number of the field's kind
+	timeRFC3339  bool           // render btime, mtime and dtime as RFC3339 strings
+	decimals     []string       // decimal fields rendered as strings
+	maxDepth     int            // depth of fields recursive types expanded to
+	building     []reflect.Type // struct types being built, for detecting recursive types
+	tagErrors    []string       // errors of `restful` tags parsed
+
+	validators map[string]Validator // business rules of fields, key: field
+
+	schemaVersion int               // schema version of docs written
+	migrations    map[int]Migration // migrations upgrading docs read, key: version migrated from
+
+	stores map[string]string // storage names of top level fields, key: name in API
+	names  map[string]string // names in API of fields stored by other names, key: storage name
 }
 
+// virtual field of relevance score in search
+const scoreField = "_score"
+
+// internal time fields, unix timestamps stored
+var timeFields = []string{"btime", "mtime", "dtime"}
+
+// FieldDesc describes a field in schema summary
+type FieldDesc struct {
+	Name       string        `json:"name"`
+	Kind       string        `json:"kind"`
+	CreateOnly bool          `json:"create_only,omitempty"`
+	ReadOnly   bool          `json:"read_only,omitempty"`
+	Wildcard   bool          `json:"wildcard,omitempty"`
+	Min        *float64      `json:"min,omitempty"`
+	Max        *float64      `json:"max,omitempty"`
+	MinLen     *int          `json:"min_len,omitempty"`
+	MaxLen     *int          `json:"max_len,omitempty"`
+	Pattern    string        `json:"pattern,omitempty"`
+	Enum       []interface{} `json:"enum,omitempty"`
+	MinItems   *int          `json:"min_items,omitempty"`
+	MaxItems   *int          `json:"max_items,omitempty"`
+}
+
+// KindName get the readable name of kind, e.g.: string, array<int>, map<object>
+func KindName(kind uint) string {
+	switch {
+	case kind > KindArrayBase && kind < KindArrayEnd:
+		return "array<" + KindName(kind-KindArrayBase) + ">"
+	case kind > KindMapBase && kind < KindMapEnd:
+		return "map<" + KindName(kind-KindMapBase) + ">"
+	}
+	switch kind {
+	case KindBool:
+		return "bool"
+	case KindInt:
+		return "int"
+	case KindUint:
+		return "uint"
+	case KindFloat:
+		return "float"
+	case KindString:
+		return "string"
+	case KindObject:
+		return "object"
+	case KindDate:
+		return "date"
+	case KindDuration:
+		return "duration"
+	case KindGeo:
+		return "geo"
+	case KindDecimal:
+		return "decimal"
+	case KindBinary:
+		return "binary"
+	case KindAny:
+		return "any"
+	}
+	return "invalid"
+}
+
+// depth of fields recursive types expanded to by default, e.g.: Category with Children []*Category
+const defaultMaxFieldDepth = 4
+
 // BuildFieldSet is a function to parsing the DataStruct
 func BuildFieldSet(typ reflect.Type) *FieldSet {
+	return BuildFieldSetDepth(typ, defaultMaxFieldDepth)
+}
+
+// BuildFieldSetDepth is a function to parsing the DataStruct, recursive types expanded to maxDepth of fields
+// objects of recursive types below maxDepth are wildcards, whose members are not validated
+func BuildFieldSetDepth(typ reflect.Type, maxDepth int) *FieldSet {
 	p := &FieldSet{
-		FMap: make(map[string]Field),
-		FSli: make([]string, 0),
+		FMap:     make(map[string]Field),
+		FSli:     make([]string, 0),
+		maxDepth: maxDepth,
 	}
 	p.FMap[""] = Field{Kind: KindObject}
 	build(typ, make([]string, 0, 0), p)
+	p.building = nil
+	p.decimals = p.decimalFields()
 	return p
 }
 
+// isBuilding check the struct type is being built by an outer field or not, i.e. recursive
+func (fs *FieldSet) isBuilding(t reflect.Type) bool {
+	for _, b := range fs.building {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
 func build(typ reflect.Type, prefix []string, p *FieldSet) {
 	t := typ
 	if typ.Kind() == reflect.Ptr {
@@ -82,14 +215,86 @@ func build(typ reflect.Type, prefix []string, p *FieldSet) {
 		if t.Kind() != reflect.Struct {
 			return
 		}
-		for i := 0; i < t.NumField(); i++ {
-			f := t.Field(i)
-			tag := strings.Split(f.Tag.Get("json"), ",")[0]
-			prefix = append(prefix, tag)
-			build(f.Type, prefix, p)
-			prefix = prefix[:len(prefix)-1]
+		if p.isBuilding(t) && len(prefix) >= p.maxDepth {
+			f := p.FMap[path]
+			f.Wildcard = true
+			p.FMap[path] = f
+			return
+		}
+		buildFields(t, prefix, p, nil)
+	}
+}
+
+// fieldName get the name of struct field stored, by json tag, bson tag, or lowercased Go name as mgo does
+// empty name returned for embedded struct promoted, false if the field is skipped, e.g. unexported or tagged "-"
+func fieldName(f reflect.StructField) (string, bool) {
+	if f.Anonymous && f.Tag.Get("json") == "" && f.Tag.Get("bson") == "" {
+		t := f.Type
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() == reflect.Struct {
+			return "", true
+		}
+	}
+	if f.PkgPath != "" {
+		return "", false
+	}
+	jsonTag := strings.Split(f.Tag.Get("json"), ",")[0]
+	if jsonTag != "" && jsonTag != "-" {
+		return jsonTag, true
+	}
+	bsonTag := strings.Split(f.Tag.Get("bson"), ",")[0]
+	if bsonTag == "-" {
+		return "", false
+	}
+	if bsonTag != "" {
+		return bsonTag, true
+	}
+	return strings.ToLower(f.Name), true
+}
+
+// buildFields builds the fields of struct, fields of embedded struct without json name are promoted like encoding/json
+// shadowed is the names of outer fields, which win over promoted fields of the same name
+func buildFields(t reflect.Type, prefix []string, p *FieldSet, shadowed map[string]bool) {
+	p.building = append(p.building, t)
+	defer func() {
+		p.building = p.building[:len(p.building)-1]
+	}()
+	names := make(map[string]bool, t.NumField()+len(shadowed))
+	for k := range shadowed {
+		names[k] = true
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if tag, ok := fieldName(t.Field(i)); ok && tag != "" {
+			names[tag] = true
 		}
 	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, ok := fieldName(f)
+		if !ok {
+			continue
+		}
+		if tag == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			// struct embedding itself promotes nothing more
+			if !p.isBuilding(ft) {
+				buildFields(ft, prefix, p, names)
+			}
+			continue
+		}
+		if shadowed[tag] {
+			continue
+		}
+		prefix = append(prefix, tag)
+		build(f.Type, prefix, p)
+		p.parseFieldTag(strings.Join(prefix, "."), f.Tag.Get("restful"))
+		prefix = prefix[:len(prefix)-1]
+	}
 }
 
 func parseKind(typ reflect.Type) uint {
@@ -97,6 +302,21 @@ func parseKind(typ reflect.Type) uint {
 	if t.Kind() == reflect.Ptr {
 		t = t.Elem()
 	}
+	if t == dateType {
+		return KindDate
+	}
+	if t == durationType {
+		return KindDuration
+	}
+	if t == decimalType {
+		return KindDecimal
+	}
+	if t == rawMessageType || t.Kind() == reflect.Interface {
+		return KindAny
+	}
+	if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+		return KindBinary
+	}
 	kind := t.Kind()
 	if kind == reflect.Array || kind == reflect.Slice {
 		elemKind := parseKind(t.Elem())
@@ -129,6 +349,9 @@ func parseKind(typ reflect.Type) uint {
 		return KindString
 	}
 	if kind == reflect.Struct {
+		if isGeoType(t) {
+			return KindGeo
+		}
 		return KindObject
 	}
 	return KindInvalid
@@ -142,6 +365,7 @@ func (fs *FieldSet) CheckObject(obj map[string]interface{}, dotOk bool) error {
 	if len(invalidFields) != 0 {
 		return fmt.Errorf("invalid fields %v", invalidFields)
 	}
+	fs.recordWrite(obj)
 	return nil
 }
 
@@ -168,6 +392,15 @@ func (fs *FieldSet) check(obj map[string]interface{}, prefix []string, dotOk boo
 			// map field
 			kind, ok = fs.IsMapMember(k)
 			if ok {
+				if fs.IsFieldCoerce(k[:strings.LastIndex(k, ".")]) {
+					value = CoerceKindValue(value, kind-KindMapBase)
+					obj[k] = value
+				}
+				if reason := fs.checkNumber(value, kind-KindMapBase); reason != "" {
+					invalidFields[k] = reason
+					delete(obj, k)
+					continue
+				}
 				// check map field type
 				v := ParseKindValue(value, kind-KindMapBase)
 				if v == nil {
@@ -186,6 +419,23 @@ func (fs *FieldSet) check(obj map[string]interface{}, prefix []string, dotOk boo
 					delete(obj, k)
 					continue
 				}
+				if fs.IsFieldNFC(k[:strings.LastIndex(k, ".")]) {
+					obj[k] = NormalizeNFC(v)
+				}
+				obj[k] = fs.FMap[k[:strings.LastIndex(k, ".")]].normalize(obj[k])
+				if f := fs.FMap[k[:strings.LastIndex(k, ".")]]; f.Rounded {
+					obj[k] = RoundFloat(v, f.Precision)
+				}
+				if reason := fs.FMap[k[:strings.LastIndex(k, ".")]].checkConstraint(obj[k]); reason != "" {
+					invalidFields[k] = reason
+					delete(obj, k)
+					continue
+				}
+				if reason := fs.validate(k[:strings.LastIndex(k, ".")], map[string]interface{}{k[strings.LastIndex(k, ".")+1:]: obj[k]}); reason != "" {
+					invalidFields[k] = reason
+					delete(obj, k)
+					continue
+				}
 				continue
 			}
 		}
@@ -218,6 +468,15 @@ func (fs *FieldSet) check(obj map[string]interface{}, prefix []string, dotOk boo
 				continue
 			}
 		}
+		if fs.IsFieldCoerce(full) {
+			value = CoerceKindValue(value, kind)
+			obj[k] = value
+		}
+		if reason := fs.checkNumber(value, kind); reason != "" {
+			invalidFields[full] = reason
+			delete(obj, full)
+			continue
+		}
 		// check field type
 		v := ParseKindValue(value, kind)
 		if v == nil {
@@ -225,6 +484,34 @@ func (fs *FieldSet) check(obj map[string]interface{}, prefix []string, dotOk boo
 			delete(obj, full)
 			continue
 		}
+		if kind == KindDate || kind == KindDuration || kind == KindGeo || kind == KindDecimal || kind == KindBinary {
+			obj[k] = v
+		}
+		if fs.IsFieldNFC(full) {
+			v = NormalizeNFC(v)
+			obj[k] = v
+		}
+		if f := fs.FMap[full]; f.Trim || f.Lower || f.Collapse {
+			v = f.normalize(v)
+			obj[k] = v
+		}
+		if f := fs.FMap[full]; f.Rounded {
+			v = RoundFloat(v, f.Precision)
+			obj[k] = v
+		}
+		if reason := fs.FMap[full].checkConstraint(v); reason != "" {
+			invalidFields[full] = reason
+			delete(obj, full)
+			continue
+		}
+		if reason := fs.validate(full, v); reason != "" {
+			invalidFields[full] = reason
+			delete(obj, full)
+			continue
+		}
+		if fs.FMap[full].Wildcard {
+			continue
+		}
 		switch kind {
 		case KindObject:
 			fs.check(v.(map[string]interface{}), path, dotOk, invalidFields)
@@ -236,6 +523,33 @@ func (fs *FieldSet) check(obj map[string]interface{}, prefix []string, dotOk boo
 	}
 }
 
+// Describe get the schema summary of fields ordered
+func (fs *FieldSet) Describe() []FieldDesc {
+	descs := make([]FieldDesc, 0, len(fs.FSli))
+	for _, name := range fs.FSli {
+		f := fs.FMap[name]
+		if f.Hidden {
+			continue
+		}
+		descs = append(descs, FieldDesc{
+			Name:       name,
+			Kind:       KindName(f.Kind),
+			CreateOnly: f.CreateOnly,
+			ReadOnly:   f.ReadOnly,
+			Wildcard:   f.Wildcard,
+			Min:        f.Min,
+			Max:        f.Max,
+			MinLen:     f.MinLen,
+			MaxLen:     f.MaxLen,
+			Pattern:    patternString(f.Pattern),
+			Enum:       f.Enum,
+			MinItems:   f.MinItems,
+			MaxItems:   f.MaxItems,
+		})
+	}
+	return descs
+}
+
 // IsFieldMember check field is a member of Struct or not
 func (fs *FieldSet) IsFieldMember(field string) (uint, bool) {
 	if _, ok := fs.FMap[field]; !ok {
@@ -260,6 +574,52 @@ func (fs *FieldSet) IsMapMember(field string) (uint, bool) {
 	return KindInvalid, false
 }
 
+// IsFieldPath check field is a member of Struct, or a deep path into it, e.g.: "comments.0.user_id", "extra.key.name"
+// segments of deep path can be keys of maps and indexes of arrays, kind of the element at path returned
+func (fs *FieldSet) IsFieldPath(field string) (uint, bool) {
+	if kind, ok := fs.IsFieldMember(field); ok {
+		return kind, true
+	}
+	path := ""
+	kind := KindObject
+	for _, seg := range strings.Split(field, ".") {
+		if seg == "" {
+			return KindInvalid, false
+		}
+		switch {
+		case kind > KindArrayBase && kind < KindArrayEnd && isDigits(seg):
+			kind = kind - KindArrayBase
+		case kind > KindMapBase && kind < KindMapEnd:
+			kind = kind - KindMapBase
+		case kind == KindObject || kind == KindArrayObject:
+			if path != "" {
+				path += "."
+			}
+			path += seg
+			f, ok := fs.FMap[path]
+			if !ok {
+				return KindInvalid, false
+			}
+			kind = f.Kind
+		case kind == KindAny:
+			// any path into verbatim value
+		default:
+			return KindInvalid, false
+		}
+	}
+	return kind, true
+}
+
+// isDigits check s is an index of array or not
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
 // IsFieldCreateOnly check field is create only or not
 func (fs *FieldSet) IsFieldCreateOnly(field string) bool {
 	if _, ok := fs.FMap[field]; ok {
@@ -276,6 +636,22 @@ func (fs *FieldSet) IsFieldReadOnly(field string) bool {
 	return false
 }
 
+// IsFieldNFC check field should be normalized to NFC form or not
+func (fs *FieldSet) IsFieldNFC(field string) bool {
+	if _, ok := fs.FMap[field]; ok {
+		return fs.FMap[field].NFC
+	}
+	return false
+}
+
+// IsFieldCoerce check string value of field should be converted to its kind or not
+func (fs *FieldSet) IsFieldCoerce(field string) bool {
+	if _, ok := fs.FMap[field]; ok {
+		return fs.FMap[field].Coerce
+	}
+	return false
+}
+
 // SetCreateOnlyFields set the fields create only
 func (fs *FieldSet) SetCreateOnlyFields(fields []string) {
 	fields = RemoveDupArray(fields)
@@ -302,84 +678,559 @@ func (fs *FieldSet) SetReadOnlyFields(fields []string) {
 	}
 }
 
-// InReplace adapted MongoDB '_id' field
-func (fs *FieldSet) InReplace(value *map[string]interface{}) {
-	// id --> _id
-	if v, ok := (*value)["id"]; ok {
-		(*value)["_id"] = v
-		delete(*value, "id")
+// SetHiddenFields set the fields stripped from responses
+func (fs *FieldSet) SetHiddenFields(fields []string) {
+	fs.hidden = RemoveDupArray(fields)
+	for _, field := range fs.hidden {
+		for k, f := range fs.FMap {
+			if k == field || strings.HasPrefix(k, field+".") {
+				f.Hidden = true
+				fs.FMap[k] = f
+			}
+		}
 	}
-	if v, ok := (*value)["$or"]; ok {
-		switch sli := v.(type) {
-		case []interface{}:
-			newOr := make([]map[string]interface{}, 0)
-			for _, elem := range sli {
-				switch m := elem.(type) {
-				case map[string]interface{}:
-					if vv, ok := m["id"]; ok {
-						m["_id"] = vv
-						delete(m, "id")
+}
+
+// IsFieldHidden check field is hidden or not, members of hidden field are hidden too
+func (fs *FieldSet) IsFieldHidden(field string) bool {
+	for _, h := range fs.hidden {
+		if field == h || strings.HasPrefix(field, h+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// isPathHidden check the path of condition or order is through a hidden field or not, indexes of arrays ignored
+// hidden fields include passwords, which can not be matched or ordered by, or their values leak by binary search
+func (fs *FieldSet) isPathHidden(path string) bool {
+	if len(fs.hidden) == 0 {
+		return false
+	}
+	segs := strings.Split(path, ".")
+	field := make([]string, 0, len(segs))
+	for _, seg := range segs {
+		if !isDigits(seg) {
+			field = append(field, seg)
+		}
+	}
+	return fs.IsFieldHidden(strings.Join(field, "."))
+}
+
+// SetNFCFields set the fields normalized to NFC form
+func (fs *FieldSet) SetNFCFields(fields []string) {
+	fields = RemoveDupArray(fields)
+	for _, field := range fields {
+		for k, f := range fs.FMap {
+			if k == field || strings.HasPrefix(k, field+".") {
+				f.NFC = true
+				fs.FMap[k] = f
+			}
+		}
+	}
+}
+
+// SetStrictNumber set the numbers of int and uint kinds checked strictly or not
+// non-integral, negative for uint and out of range numbers are rejected instead of truncated
+func (fs *FieldSet) SetStrictNumber(strict bool) {
+	fs.strictNumber = strict
+}
+
+// checkNumber check the numbers in value of number kinds
+// NaN and Inf are always rejected, int and uint kinds are checked strictly if strictNumber
+// return the reason if invalid, empty if valid
+func (fs *FieldSet) checkNumber(value interface{}, kind uint) string {
+	switch {
+	case KindArrayBase < kind && kind < KindArrayEnd:
+		if v, ok := value.([]interface{}); ok {
+			for i, elem := range v {
+				if reason := fs.checkNumber(elem, kind-KindArrayBase); reason != "" {
+					return fmt.Sprintf("element %d %s", i, reason)
+				}
+			}
+		}
+	case KindMapBase < kind && kind < KindMapEnd:
+		if v, ok := value.(map[string]interface{}); ok {
+			for k, elem := range v {
+				if reason := fs.checkNumber(elem, kind-KindMapBase); reason != "" {
+					return fmt.Sprintf("key %s %s", k, reason)
+				}
+			}
+		}
+	case kind == KindFloat:
+		return CheckFinite(value)
+	case kind == KindInt || kind == KindUint:
+		if fs.strictNumber {
+			return CheckIntegral(value, kind == KindUint)
+		}
+	}
+	return ""
+}
+
+// SetFloatPrecision set the decimal places of float fields rounded to, key: field, value: decimal places
+func (fs *FieldSet) SetFloatPrecision(precision map[string]int) {
+	for field, places := range precision {
+		for k, f := range fs.FMap {
+			if k == field || strings.HasPrefix(k, field+".") {
+				f.Rounded = true
+				f.Precision = places
+				fs.FMap[k] = f
+			}
+		}
+	}
+}
+
+// CheckFloatPrecision check the float precision in the config of Processor valid or not
+func (fs *FieldSet) CheckFloatPrecision(precision map[string]int) error {
+	for field, places := range precision {
+		kind, ok := fs.IsFieldMember(field)
+		if !ok {
+			return fmt.Errorf("float precision field %s unknown", field)
+		}
+		if kind != KindFloat && kind != KindArrayFloat && kind != KindMapFloat {
+			return fmt.Errorf("float precision field %s not float", field)
+		}
+		if places < 0 || places > 15 {
+			return fmt.Errorf("float precision field %s decimal places %d invalid", field, places)
+		}
+	}
+	return nil
+}
+
+// SetCoerceFields set the fields converting string value to its kind
+func (fs *FieldSet) SetCoerceFields(fields []string) {
+	fields = RemoveDupArray(fields)
+	for _, field := range fields {
+		for k, f := range fs.FMap {
+			if k == field || strings.HasPrefix(k, field+".") {
+				f.Coerce = true
+				fs.FMap[k] = f
+			}
+		}
+	}
+}
+
+// InReplace adapted MongoDB '_id' field, and fields stored by other names
+func (fs *FieldSet) InReplace(value *map[string]interface{}) {
+	fs.replaceID(value)
+	fs.storeNames(*value)
+	for _, op := range []string{"$or", "$and"} {
+		if v, ok := (*value)[op]; ok {
+			switch sli := v.(type) {
+			case []interface{}:
+				newOr := make([]map[string]interface{}, 0)
+				for _, elem := range sli {
+					switch m := elem.(type) {
+					case map[string]interface{}:
+						fs.InReplace(&m)
+						newOr = append(newOr, m)
 					}
-					newOr = append(newOr, m)
 				}
+				(*value)[op] = newOr
 			}
-			(*value)["$or"] = newOr
 		}
 	}
 }
 
-// OutReplace adapted MongoDB '_id' field
-func (fs *FieldSet) OutReplace(value *map[string]interface{}) {
+// replaceID adapted MongoDB '_id' field only, for docs written still checked by names in API
+func (fs *FieldSet) replaceID(value *map[string]interface{}) {
+	// id --> _id
+	if v, ok := (*value)["id"]; ok {
+		(*value)["_id"] = v
+		delete(*value, "id")
+	}
+}
+
+// OutReplace upgrades docs of older schema versions, adapted MongoDB '_id' field, and renders time fields as RFC3339 if set
+// the doc is still adapted if the migration fails, and the error returned
+func (fs *FieldSet) OutReplace(value *map[string]interface{}) error {
+	var err error
+	if fs.schemaVersion > 0 {
+		if _, err = fs.Migrate(*value); err != nil {
+			Log.Warnf("doc %v %v", (*value)["_id"], err)
+		}
+	}
 	// _id --> id
 	if v, ok := (*value)["_id"]; ok {
 		(*value)["id"] = v
 		delete(*value, "_id")
 	}
+	fs.apiNames(*value)
+	for _, field := range fs.hidden {
+		removePath(*value, field)
+	}
+	for _, field := range fs.decimals {
+		outDecimal(*value, field)
+	}
+	if fs.timeRFC3339 {
+		for _, field := range timeFields {
+			if n := CheckInt((*value)[field]); n != nil {
+				(*value)[field] = time.Unix(n.(int64), 0).UTC().Format(time.RFC3339)
+			}
+		}
+	}
+	return err
 }
 
-// OutReplaceArray adapted MongoDB '_id' field for ARRAY
-func (fs *FieldSet) OutReplaceArray(values []interface{}) {
+// removePath removes the field of path in doc, through objects and arrays of objects
+func removePath(doc interface{}, path string) {
+	switch v := doc.(type) {
+	case []interface{}:
+		for _, elem := range v {
+			removePath(elem, path)
+		}
+		return
+	case map[string]interface{}, bson.M:
+		m := docMap(v)
+		pos := strings.Index(path, ".")
+		if pos == -1 {
+			delete(m, path)
+			return
+		}
+		removePath(m[path[:pos]], path[pos+1:])
+	}
+}
+
+// SetCoerceFilter set string value in filters converted to bool or number of the field's kind or not
+// e.g.: range={"age":{"gt":"20"}}
+func (fs *FieldSet) SetCoerceFilter(coerce bool) {
+	fs.coerceFilter = coerce
+}
+
+// SetTimeFormat set the format of btime, mtime and dtime rendered, unix or rfc3339
+func (fs *FieldSet) SetTimeFormat(format string) {
+	fs.timeRFC3339 = format == TimeFormatRFC3339
+}
+
+// acceptTimeStrings converts RFC3339 strings of time fields in filter params to unix timestamps
+// e.g.: {"mtime": {"gt": "2020-01-01T00:00:00Z"}}
+func acceptTimeStrings(params map[string]interface{}) {
+	for _, field := range timeFields {
+		if v, ok := params[field]; ok {
+			params[field] = parseTimeStrings(v)
+		}
+	}
+}
+
+func parseTimeStrings(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			return t.Unix()
+		}
+	case []interface{}:
+		r := make([]interface{}, 0, len(v))
+		for _, elem := range v {
+			r = append(r, parseTimeStrings(elem))
+		}
+		return r
+	case map[string]interface{}:
+		for k, elem := range v {
+			v[k] = parseTimeStrings(elem)
+		}
+	}
+	return value
+}
+
+// OutReplaceArray adapted MongoDB '_id' field for ARRAY, the first error of migrations returned
+func (fs *FieldSet) OutReplaceArray(values []interface{}) error {
+	var err error
 	for _, value := range values {
+		var e error
 		switch v := value.(type) {
 		case map[string]interface{}:
-			fs.OutReplace(&v)
+			e = fs.OutReplace(&v)
 		case bson.M:
-			fs.OutReplace((*map[string]interface{})(&v))
+			e = fs.OutReplace((*map[string]interface{})(&v))
 		default:
 			continue
 		}
+		if err == nil {
+			err = e
+		}
 	}
+	return err
 }
 
 // InSort sort data
 func (fs *FieldSet) InSort(data *map[string]interface{}) bson.D {
 	d := make([]bson.DocElem, 0)
 	for _, value := range (*fs).FSli {
-		// replace id
+		if strings.Index(value, ".") >= 0 {
+			continue
+		}
+		// replace id and fields stored by other names, docs read from db are by the names stored
+		name := fs.storageField(value)
 		if value == "id" {
 			value = "_id"
 		}
-		if strings.Index(value, ".") >= 0 {
+		if v, ok := (*data)[value]; ok {
+			d = append(d, bson.DocElem{Name: name, Value: v})
+		} else if v, ok := (*data)[name]; ok {
+			d = append(d, bson.DocElem{Name: name, Value: v})
+		}
+	}
+	return d
+}
+
+// isUpdateConflict check the field path is written by the update already, the same field,
+// or its parent or member like a and a.b, which MongoDB rejects in one update
+func isUpdateConflict(update map[string]interface{}, path string) bool {
+	for _, o := range update {
+		om, _ := o.(map[string]interface{})
+		for k := range om {
+			if k == path || strings.HasPrefix(k, path+".") || strings.HasPrefix(path, k+".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// BuildArrayOpObj build the update of array operator like $push, $pull, $addToSet
+func (fs *FieldSet) BuildArrayOpObj(op string, value interface{}, update map[string]interface{}) error {
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s not map", op)
+	}
+	opObj := make(map[string]interface{})
+	for k, v := range m {
+		if isUpdateConflict(update, k) {
+			return fmt.Errorf("%s field %s conflict", op, k)
+		}
+		kind, ok := fs.IsFieldMember(k)
+		if !ok {
+			return fmt.Errorf("%s field %s unknown", op, k)
+		}
+		if kind <= KindArrayBase || kind >= KindArrayEnd {
+			return fmt.Errorf("%s field %s not array", op, k)
+		}
+		if fs.IsFieldReadOnly(k) {
+			return fmt.Errorf("%s field %s read only", op, k)
+		}
+		if fs.IsFieldCreateOnly(k) {
+			return fmt.Errorf("%s field %s create only", op, k)
+		}
+		elems, ok := v.([]interface{})
+		if !ok {
+			elems = []interface{}{v}
+		}
+		if len(elems) == 0 {
+			return fmt.Errorf("%s field %s empty", op, k)
+		}
+		if f := fs.FMap[k]; f.MaxItems != nil && op != "$pull" && len(elems) > *f.MaxItems {
+			return fmt.Errorf("%s field %s items %d greater than maxitems %d", op, k, len(elems), *f.MaxItems)
+		}
+		parsed := make([]interface{}, 0, len(elems))
+		for _, elem := range elems {
+			if reason := fs.checkNumber(elem, kind-KindArrayBase); reason != "" {
+				return fmt.Errorf("%s field %s %s", op, k, reason)
+			}
+			pv := ParseKindValue(elem, kind-KindArrayBase)
+			if pv == nil {
+				return fmt.Errorf("%s field %s type mismatch", op, k)
+			}
+			// elements written or pulled as stored, see check
+			f := fs.FMap[k]
+			if f.NFC {
+				pv = NormalizeNFC(pv)
+			}
+			pv = f.normalize(pv)
+			if f.Rounded {
+				pv = RoundFloat(pv, f.Precision)
+			}
+			if op != "$pull" {
+				if reason := f.checkConstraint(pv); reason != "" {
+					return fmt.Errorf("%s field %s %s", op, k, reason)
+				}
+			}
+			if kind == KindArrayObject {
+				invalidFields := make(map[string]interface{})
+				fs.check(pv.(map[string]interface{}), strings.Split(k, "."), false, invalidFields)
+				if len(invalidFields) != 0 {
+					return fmt.Errorf("%s field %s invalid fields %v", op, k, invalidFields)
+				}
+			}
+			parsed = append(parsed, pv)
+		}
+		// validator of array field validates the elements written as an array
+		if op != "$pull" {
+			if reason := fs.validate(k, parsed); reason != "" {
+				return fmt.Errorf("%s field %s %s", op, k, reason)
+			}
+		}
+		if op == "$pull" {
+			if len(parsed) == 1 {
+				opObj[k] = parsed[0]
+			} else {
+				opObj[k] = map[string]interface{}{"$in": parsed}
+			}
+		} else {
+			opObj[k] = map[string]interface{}{"$each": parsed}
+		}
+	}
+	if len(opObj) > 0 {
+		update[op] = opObj
+	}
+	return nil
+}
+
+// BuildUnsetObj build the update of $unset operator which removes fields from doc
+func (fs *FieldSet) BuildUnsetObj(value interface{}, update map[string]interface{}) error {
+	fields, ok := value.([]interface{})
+	if !ok {
+		return fmt.Errorf("$unset not array")
+	}
+	unsetObj := make(map[string]interface{})
+	for _, f := range fields {
+		k := GetString(f)
+		if k == "" {
+			return fmt.Errorf("$unset field %v invalid", f)
+		}
+		switch k {
+		case "id", "btime", "mtime", "seq":
+			return fmt.Errorf("$unset field %s internal", k)
+		}
+		if isUpdateConflict(update, k) {
+			return fmt.Errorf("$unset field %s conflict", k)
+		}
+		if _, ok := fs.IsFieldMember(k); !ok {
+			return fmt.Errorf("$unset field %s unknown", k)
+		}
+		if fs.IsFieldReadOnly(k) {
+			return fmt.Errorf("$unset field %s read only", k)
+		}
+		if fs.IsFieldCreateOnly(k) {
+			return fmt.Errorf("$unset field %s create only", k)
+		}
+		if f := fs.FMap[k]; f.MinItems != nil && *f.MinItems > 0 {
+			return fmt.Errorf("$unset field %s minitems %d", k, *f.MinItems)
+		}
+		unsetObj[k] = ""
+	}
+	if len(unsetObj) > 0 {
+		update["$unset"] = unsetObj
+	}
+	return nil
+}
+
+// BuildIncObj build the $inc update of number fields, e.g.: {"$inc": {"count": 1}}
+func (fs *FieldSet) BuildIncObj(value interface{}, update map[string]interface{}) error {
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("$inc not object")
+	}
+	incObj := make(map[string]interface{})
+	for k, v := range fields {
+		switch k {
+		case "id", "btime", "mtime", "seq":
+			return fmt.Errorf("$inc field %s internal", k)
+		}
+		if isUpdateConflict(update, k) {
+			return fmt.Errorf("$inc field %s conflict", k)
+		}
+		kind, ok := fs.IsFieldMember(k)
+		if !ok {
+			return fmt.Errorf("$inc field %s unknown", k)
+		}
+		if fs.IsFieldReadOnly(k) {
+			return fmt.Errorf("$inc field %s read only", k)
+		}
+		if fs.IsFieldCreateOnly(k) {
+			return fmt.Errorf("$inc field %s create only", k)
+		}
+		if kind != KindInt && kind != KindUint && kind != KindFloat {
+			return fmt.Errorf("$inc field %s not number", k)
+		}
+		// negative delta of uint field is a decrement
+		if reason := fs.checkNumber(v, KindFloat); reason != "" {
+			return fmt.Errorf("$inc field %s %s", k, reason)
+		}
+		// deltas of int and uint fields are never truncated, even if not strict number
+		if kind != KindFloat {
+			if reason := CheckIntegral(v, false); reason != "" {
+				return fmt.Errorf("$inc field %s %s", k, reason)
+			}
+		}
+		n := CheckFloat(v)
+		if n == nil {
+			return fmt.Errorf("$inc field %s type mismatch", k)
+		}
+		if kind == KindFloat {
+			incObj[k] = n
+		} else {
+			incObj[k] = CheckInt(v)
+		}
+	}
+	if len(incObj) > 0 {
+		update["$inc"] = incObj
+	}
+	return nil
+}
+
+// guardInc adds the bounds of fields by min and max tags to the guard of write, as values after $inc of update,
+// fields missing are taken as 0
+func (fs *FieldSet) guardInc(update map[string]interface{}, g *writeGuard) {
+	for k, v := range docMap(update["$inc"]) {
+		f := fs.FMap[k]
+		delta := CheckFloat(v)
+		if delta == nil || delta.(float64) == 0 {
+			continue
+		}
+		d := delta.(float64)
+		name := fs.storageField(k)
+		// uint fields can not be decremented below 0
+		min := f.Min
+		if f.Kind == KindUint && (min == nil || *min < 0) {
+			zero := float64(0)
+			min = &zero
+		}
+		var bound float64
+		var cond bson.M
+		var reason string
+		switch {
+		case d > 0 && f.Max != nil:
+			bound = *f.Max - d
+			cond = bson.M{name: bson.M{"$lte": bound}}
+			reason = fmt.Sprintf("$inc field %s greater than max %v", k, *f.Max)
+		case d < 0 && min != nil:
+			bound = *min - d
+			cond = bson.M{name: bson.M{"$gte": bound}}
+			reason = fmt.Sprintf("$inc field %s less than min %v", k, *min)
+		default:
 			continue
 		}
-		if _, ok := (*data)[value]; ok {
-			d = append(d, bson.DocElem{Name: value, Value: (*data)[value]})
+		if d > 0 && bound >= 0 || d < 0 && bound <= 0 {
+			cond = bson.M{"$or": []interface{}{cond, bson.M{name: bson.M{"$exists": false}}}}
 		}
+		g.add(cond, reason)
 	}
-	return d
 }
 
 // BuildFilterObj build the condition like `WHERE f1 = xxx AND ...` in SQL
 func (fs *FieldSet) BuildFilterObj(filter map[string]interface{}, cond map[string]interface{}) error {
+	acceptTimeStrings(filter)
 	for k, value := range filter {
 		if _, exist := cond[k]; exist {
 			return fmt.Errorf("filter field %s condition conflict", k)
 		}
-		kind, ok := fs.IsFieldMember(k)
+		kind, ok := fs.IsFieldPath(k)
 		if !ok {
 			return fmt.Errorf("filter field %s unknown", k)
 		}
-		// nil or empty
+		if fs.isPathHidden(k) {
+			return fmt.Errorf("filter field %s not allowed", k)
+		}
+		// explicit presence: {"$missing": true}, {"$null": true} or {"$empty": true}
+		if m, ok := value.(map[string]interface{}); ok && len(m) == 1 {
+			if v, err := fs.buildPresenceObj(m, kind); err != nil {
+				return fmt.Errorf("filter field %s %s", k, err.Error())
+			} else if v != nil {
+				cond[k] = v
+				continue
+			}
+		}
+		// nil or empty, matches missing, null and default value
 		if kind != KindInvalid && value == nil || IsEmpty(value, kind) {
 			empty := EmptyValue(kind)
 			if empty == nil {
@@ -423,8 +1274,43 @@ func (fs *FieldSet) BuildFilterObj(filter map[string]interface{}, cond map[strin
 	return nil
 }
 
+// buildPresenceObj build the condition distinguishing missing, null and default value of field
+// $missing: field not set, $null: field set to null, $empty: field set to default value like 0, "" or []
+// nil returned if m is not a presence filter
+func (fs *FieldSet) buildPresenceObj(m map[string]interface{}, kind uint) (interface{}, error) {
+	for op, value := range m {
+		if op != "$missing" && op != "$null" && op != "$empty" {
+			return nil, nil
+		}
+		b, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s should be bool", op)
+		}
+		switch op {
+		case "$missing":
+			return bson.M{"$exists": !b}, nil
+		case "$null":
+			if b {
+				return bson.M{"$type": 10}, nil
+			}
+			return bson.M{"$exists": true, "$ne": nil}, nil
+		case "$empty":
+			empty := EmptyValue(kind)
+			if empty == nil {
+				return nil, fmt.Errorf("%s not support", op)
+			}
+			if b {
+				return bson.M{"$eq": empty}, nil
+			}
+			return bson.M{"$exists": true, "$nin": []interface{}{nil, empty}}, nil
+		}
+	}
+	return nil, nil
+}
+
 // BuildRangeObj build the condition of `range` filter
 func (fs *FieldSet) BuildRangeObj(rang map[string]interface{}, cond map[string]interface{}) error {
+	acceptTimeStrings(rang)
 	for k, value := range rang {
 		if _, exist := cond[k]; exist {
 			return fmt.Errorf("range field %s condition conflict", k)
@@ -434,14 +1320,17 @@ func (fs *FieldSet) BuildRangeObj(rang map[string]interface{}, cond map[string]i
 		switch mv := value.(type) {
 		case map[string]interface{}:
 			obj := make(map[string]interface{})
-			kind, ok := fs.IsFieldMember(k)
+			kind, ok := fs.IsFieldPath(k)
 			if !ok {
 				return fmt.Errorf("range field %s unknown", k)
 			}
+			if fs.isPathHidden(k) {
+				return fmt.Errorf("range field %s not allowed", k)
+			}
 			if kind >= KindMapBool && kind <= KindMapString {
 				kind = kind - KindMapBase
 			}
-			if kind >= KindBool && kind <= KindString {
+			if kind >= KindBool && kind <= KindString || kind == KindDate || kind == KindDuration || kind == KindDecimal {
 				// gt or gte
 				if gt, ok := mv["gt"]; ok {
 					v := fs.ParseSimpleValue(gt, kind)
@@ -495,23 +1384,63 @@ func (fs *FieldSet) BuildRangeObj(rang map[string]interface{}, cond map[string]i
 	return nil
 }
 
+// BuildTimeWindowObj build the range condition of `since` and `until` on btime or mtime
+// since is inclusive and until is exclusive, unix timestamps or RFC3339 strings, e.g.: since=1600000000
+func (fs *FieldSet) BuildTimeWindowObj(field, since, until string, cond map[string]interface{}) error {
+	if field != "btime" && field != "mtime" {
+		return fmt.Errorf("time field %s invalid", field)
+	}
+	rang := make(map[string]interface{})
+	if since != "" {
+		v, err := parseTimeParam(since)
+		if err != nil {
+			return fmt.Errorf("since invalid")
+		}
+		rang["gte"] = v
+	}
+	if until != "" {
+		v, err := parseTimeParam(until)
+		if err != nil {
+			return fmt.Errorf("until invalid")
+		}
+		rang["lt"] = v
+	}
+	return fs.BuildRangeObj(map[string]interface{}{field: rang}, cond)
+}
+
+// parseTimeParam parses unix timestamp or RFC3339 string of URL Query param
+func parseTimeParam(s string) (int64, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Unix(), nil
+}
+
 // BuildInObj build the condition of `in` filter
 func (fs *FieldSet) BuildInObj(in map[string]interface{}, cond map[string]interface{}) error {
+	acceptTimeStrings(in)
 	for k, value := range in {
 		if _, exist := cond[k]; exist {
 			return fmt.Errorf("in field %s condition conflict", k)
 		}
-		kind, ok := fs.IsFieldMember(k)
+		kind, ok := fs.IsFieldPath(k)
 		if !ok {
 			return fmt.Errorf("in field %s unknown", k)
 		}
+		if fs.isPathHidden(k) {
+			return fmt.Errorf("in field %s not allowed", k)
+		}
 		if kind >= KindArrayBool && kind <= KindArrayString {
 			kind = kind - KindArrayBase
 		}
 		if kind >= KindMapBool && kind <= KindMapString {
 			kind = kind - KindMapBase
 		}
-		if kind >= KindBool && kind <= KindString {
+		if kind >= KindBool && kind <= KindString || kind == KindDate || kind == KindDuration || kind == KindDecimal {
 			v := fs.ParseSimpleArray(value, kind)
 			if v != nil {
 				cond[k] = map[string]interface{}{"$in": v}
@@ -525,23 +1454,38 @@ func (fs *FieldSet) BuildInObj(in map[string]interface{}, cond map[string]interf
 	return nil
 }
 
+// BuildIdsObj build the condition of `ids` filter, shortcut of in={"id": [...]}
+func (fs *FieldSet) BuildIdsObj(ids []interface{}, cond map[string]interface{}) error {
+	if _, exist := cond["id"]; exist {
+		return fmt.Errorf("ids condition conflict")
+	}
+	if err := fs.BuildInObj(map[string]interface{}{"id": ids}, cond); err != nil {
+		return fmt.Errorf("ids should be array of string")
+	}
+	return nil
+}
+
 // BuildNinObj build the condition of `nin` filter
 func (fs *FieldSet) BuildNinObj(nin map[string]interface{}, cond map[string]interface{}) error {
+	acceptTimeStrings(nin)
 	for k, value := range nin {
 		if _, exist := cond[k]; exist {
 			return fmt.Errorf("nin field %s condition conflict", k)
 		}
-		kind, ok := fs.IsFieldMember(k)
+		kind, ok := fs.IsFieldPath(k)
 		if !ok {
 			return fmt.Errorf("nin field %s unknown", k)
 		}
+		if fs.isPathHidden(k) {
+			return fmt.Errorf("nin field %s not allowed", k)
+		}
 		if kind >= KindArrayBool && kind <= KindArrayString {
 			kind = kind - KindArrayBase
 		}
 		if kind >= KindMapBool && kind <= KindMapString {
 			kind = kind - KindMapBase
 		}
-		if kind >= KindBool && kind <= KindString {
+		if kind >= KindBool && kind <= KindString || kind == KindDate || kind == KindDuration || kind == KindDecimal {
 			v := fs.ParseSimpleArray(value, kind)
 			if v != nil {
 				cond[k] = map[string]interface{}{"$nin": v}
@@ -555,16 +1499,162 @@ func (fs *FieldSet) BuildNinObj(nin map[string]interface{}, cond map[string]inte
 	return nil
 }
 
+// BuildNeObj build the condition of `ne` filter
+func (fs *FieldSet) BuildNeObj(ne map[string]interface{}, cond map[string]interface{}) error {
+	acceptTimeStrings(ne)
+	for k, value := range ne {
+		if _, exist := cond[k]; exist {
+			return fmt.Errorf("ne field %s condition conflict", k)
+		}
+		kind, ok := fs.IsFieldPath(k)
+		if !ok {
+			return fmt.Errorf("ne field %s unknown", k)
+		}
+		if fs.isPathHidden(k) {
+			return fmt.Errorf("ne field %s not allowed", k)
+		}
+		if kind >= KindArrayBool && kind <= KindArrayString {
+			kind = kind - KindArrayBase
+		}
+		if kind >= KindMapBool && kind <= KindMapString {
+			kind = kind - KindMapBase
+		}
+		if kind >= KindBool && kind <= KindString || kind == KindDate || kind == KindDuration || kind == KindDecimal {
+			v := fs.ParseSimpleValue(value, kind)
+			if v != nil {
+				cond[k] = map[string]interface{}{"$ne": v}
+			} else {
+				return fmt.Errorf("ne field %s type mismatch", k)
+			}
+			continue
+		}
+		return fmt.Errorf("ne field %s type not support", k)
+	}
+	return nil
+}
+
+// BuildElemMatchObj build the condition of `elem_match` filter for arrays of objects
+// e.g.: {"comments": {"user": "tom", "score": {"gte": 9}}}, sub fields are filtered like filter, or like range if map
+func (fs *FieldSet) BuildElemMatchObj(elemMatch map[string]interface{}, cond map[string]interface{}) error {
+	for k, value := range elemMatch {
+		if _, exist := cond[k]; exist {
+			return fmt.Errorf("elem_match field %s condition conflict", k)
+		}
+		kind, ok := fs.IsFieldMember(k)
+		if !ok {
+			return fmt.Errorf("elem_match field %s unknown", k)
+		}
+		if fs.isPathHidden(k) {
+			return fmt.Errorf("elem_match field %s not allowed", k)
+		}
+		if kind != KindArrayObject {
+			return fmt.Errorf("elem_match field %s not array of object", k)
+		}
+		sub, ok := value.(map[string]interface{})
+		if !ok || len(sub) == 0 {
+			return fmt.Errorf("elem_match field %s not map", k)
+		}
+		elem := make(map[string]interface{})
+		for subKey, subValue := range sub {
+			full := k + "." + subKey
+			subCond := make(map[string]interface{})
+			var err error
+			if _, isMap := subValue.(map[string]interface{}); isMap {
+				err = fs.BuildRangeObj(map[string]interface{}{full: subValue}, subCond)
+			} else {
+				err = fs.BuildFilterObj(map[string]interface{}{full: subValue}, subCond)
+			}
+			if err != nil {
+				return fmt.Errorf("elem_match field %s: %s", k, err.Error())
+			}
+			elem[subKey] = subCond[full]
+		}
+		cond[k] = map[string]interface{}{"$elemMatch": elem}
+	}
+	return nil
+}
+
+// max length of the pattern of `regex` filter
+const regexMaxLength = 256
+
+// BuildRegexObj build the condition of `regex` filter on string fields
+// value is a raw pattern anchored with ^, e.g.: {"name": "^The.*"}
+// or a literal text escaped and anchored by mode, e.g.: {"name": {"text": "a.b", "mode": "prefix", "ignore_case": true}}
+// mode: prefix, suffix, contains or exact
+func (fs *FieldSet) BuildRegexObj(regex map[string]interface{}, cond map[string]interface{}) error {
+	for k, value := range regex {
+		if _, exist := cond[k]; exist {
+			return fmt.Errorf("regex field %s condition conflict", k)
+		}
+		kind, ok := fs.IsFieldPath(k)
+		if !ok {
+			return fmt.Errorf("regex field %s unknown", k)
+		}
+		if fs.isPathHidden(k) {
+			return fmt.Errorf("regex field %s not allowed", k)
+		}
+		if kind != KindString && kind != KindArrayString {
+			return fmt.Errorf("regex field %s type not support", k)
+		}
+		pattern := ""
+		options := ""
+		switch v := value.(type) {
+		case string:
+			if !strings.HasPrefix(v, "^") {
+				return fmt.Errorf("regex field %s pattern should be anchored with ^, or use mode", k)
+			}
+			if err := checkRegexPattern(v); err != nil {
+				return fmt.Errorf("regex field %s pattern invalid, %v", k, err)
+			}
+			pattern = v
+		case map[string]interface{}:
+			text, ok := v["text"].(string)
+			if !ok || text == "" {
+				return fmt.Errorf("regex field %s need text", k)
+			}
+			quoted := regexp.QuoteMeta(text)
+			switch GetString(v["mode"]) {
+			case "prefix":
+				pattern = "^" + quoted
+			case "suffix":
+				pattern = quoted + "$"
+			case "contains":
+				pattern = quoted
+			case "exact":
+				pattern = "^" + quoted + "$"
+			default:
+				return fmt.Errorf("regex field %s mode should be prefix, suffix, contains or exact", k)
+			}
+			if ignoreCase, _ := v["ignore_case"].(bool); ignoreCase {
+				options = "i"
+			}
+		default:
+			return fmt.Errorf("regex field %s type mismatch", k)
+		}
+		if len(pattern) > regexMaxLength {
+			return fmt.Errorf("regex field %s pattern too long", k)
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("regex field %s pattern invalid", k)
+		}
+		cond[k] = bson.RegEx{Pattern: pattern, Options: options}
+	}
+	return nil
+}
+
 // BuildAllObj build the condition of `all` filter
 func (fs *FieldSet) BuildAllObj(all map[string]interface{}, cond map[string]interface{}) error {
 	for k, value := range all {
 		if _, exist := cond[k]; exist {
 			return fmt.Errorf("all field %s condition conflict", k)
 		}
-		kind, ok := fs.IsFieldMember(k)
+		kind, ok := fs.IsFieldPath(k)
 		if !ok {
 			return fmt.Errorf("all field %s unknown", k)
 		}
+		if fs.isPathHidden(k) {
+			return fmt.Errorf("all field %s not allowed", k)
+		}
 		if kind >= KindArrayBool && kind <= KindArrayString {
 			kind = kind - KindArrayBase
 		}
@@ -585,6 +1675,64 @@ func (fs *FieldSet) BuildAllObj(all map[string]interface{}, cond map[string]inte
 	return nil
 }
 
+// BuildNotObj build the condition of `not` filter, negating the conditions of range, regex, in, all or elem_match
+// e.g.: {"range": {"mtime": {"gt": 1600000000}}, "regex": {"name": "^tmp"}}
+// a field missing matches the negated condition too
+func (fs *FieldSet) BuildNotObj(not map[string]interface{}, cond map[string]interface{}) error {
+	for op, value := range not {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("not %s type not map", op)
+		}
+		part := make(map[string]interface{})
+		var err error
+		switch op {
+		case "range":
+			err = fs.BuildRangeObj(m, part)
+		case "regex":
+			err = fs.BuildRegexObj(m, part)
+		case "in":
+			err = fs.BuildInObj(m, part)
+		case "all":
+			err = fs.BuildAllObj(m, part)
+		case "elem_match":
+			err = fs.BuildElemMatchObj(m, part)
+		default:
+			return fmt.Errorf("not %s unknown", op)
+		}
+		if err != nil {
+			return err
+		}
+		for k, v := range part {
+			part[k] = bson.M{"$not": v}
+		}
+		mergeCondition(cond, part)
+	}
+	return nil
+}
+
+// mergeCondition merges the conditions of part into cond, a field conditioned in both is combined by $and
+func mergeCondition(cond, part map[string]interface{}) {
+	for k, v := range part {
+		if _, exist := cond[k]; !exist {
+			cond[k] = v
+			continue
+		}
+		and, _ := cond["$and"].([]interface{})
+		cond["$and"] = append(and, map[string]interface{}{k: v})
+	}
+}
+
+// mergeBuild builds the conditions of a filter apart and merges them into cond
+func mergeBuild(cond map[string]interface{}, build func(part map[string]interface{}) error) error {
+	part := make(map[string]interface{})
+	if err := build(part); err != nil {
+		return err
+	}
+	mergeCondition(cond, part)
+	return nil
+}
+
 // BuildOrObj build the condition of `or` filter
 func (fs *FieldSet) BuildOrObj(or []interface{}, cond map[string]interface{}) error {
 	if _, exist := cond["$or"]; exist {
@@ -601,7 +1749,7 @@ func (fs *FieldSet) BuildOrObj(or []interface{}, cond map[string]interface{}) er
 				case "filter":
 					switch filter := value.(type) {
 					case map[string]interface{}:
-						err = fs.BuildFilterObj(filter, condition)
+						err = mergeBuild(condition, func(part map[string]interface{}) error { return fs.BuildFilterObj(filter, part) })
 						if err != nil {
 							return err
 						}
@@ -611,7 +1759,7 @@ func (fs *FieldSet) BuildOrObj(or []interface{}, cond map[string]interface{}) er
 				case "range":
 					switch rang := value.(type) {
 					case map[string]interface{}:
-						err = fs.BuildRangeObj(rang, condition)
+						err = mergeBuild(condition, func(part map[string]interface{}) error { return fs.BuildRangeObj(rang, part) })
 						if err != nil {
 							return err
 						}
@@ -621,7 +1769,7 @@ func (fs *FieldSet) BuildOrObj(or []interface{}, cond map[string]interface{}) er
 				case "in":
 					switch in := value.(type) {
 					case map[string]interface{}:
-						err = fs.BuildInObj(in, condition)
+						err = mergeBuild(condition, func(part map[string]interface{}) error { return fs.BuildInObj(in, part) })
 						if err != nil {
 							return err
 						}
@@ -631,7 +1779,7 @@ func (fs *FieldSet) BuildOrObj(or []interface{}, cond map[string]interface{}) er
 				case "nin":
 					switch nin := value.(type) {
 					case map[string]interface{}:
-						err = fs.BuildNinObj(nin, condition)
+						err = mergeBuild(condition, func(part map[string]interface{}) error { return fs.BuildNinObj(nin, part) })
 						if err != nil {
 							return err
 						}
@@ -641,13 +1789,23 @@ func (fs *FieldSet) BuildOrObj(or []interface{}, cond map[string]interface{}) er
 				case "all":
 					switch all := value.(type) {
 					case map[string]interface{}:
-						err = fs.BuildAllObj(all, condition)
+						err = mergeBuild(condition, func(part map[string]interface{}) error { return fs.BuildAllObj(all, part) })
 						if err != nil {
 							return err
 						}
 					default:
 						return fmt.Errorf("or field %v all type not map", obj)
 					}
+				case "not":
+					switch not := value.(type) {
+					case map[string]interface{}:
+						err = fs.BuildNotObj(not, condition)
+						if err != nil {
+							return err
+						}
+					default:
+						return fmt.Errorf("or field %v not type not map", obj)
+					}
 				default:
 					return fmt.Errorf("or field %v condition %v unknown", obj, k)
 				}
@@ -668,6 +1826,12 @@ func (fs *FieldSet) BuildRegexSearchObj(search string, regexSearchFields []strin
 	if _, exist := cond["$or"]; exist {
 		return fmt.Errorf("or field condition conflict")
 	}
+	if len(search) > regexMaxLength {
+		return fmt.Errorf("regex search too long")
+	}
+	if err := checkRegexPattern(search); err != nil {
+		return fmt.Errorf("regex search invalid, %v", err)
+	}
 	orCond := make([]interface{}, 0)
 	for _, field := range regexSearchFields {
 		condition := make(map[string]interface{})
@@ -682,6 +1846,16 @@ func (fs *FieldSet) BuildRegexSearchObj(search string, regexSearchFields []strin
 
 // BuildOrderArray build sort
 func (fs *FieldSet) BuildOrderArray(order []string, sort *bson.D) error {
+	return fs.buildOrderArray(order, sort, false)
+}
+
+// BuildSearchOrderArray build the sort fields in search context
+// _score is a virtual field of the relevance score, e.g.: ["-_score", "-mtime"]
+func (fs *FieldSet) BuildSearchOrderArray(order []string, sort *bson.D) error {
+	return fs.buildOrderArray(order, sort, true)
+}
+
+func (fs *FieldSet) buildOrderArray(order []string, sort *bson.D, scoreOk bool) error {
 	for _, value := range order {
 		if len(value) <= 1 {
 			return fmt.Errorf("order field %s invalid", value)
@@ -695,9 +1869,16 @@ func (fs *FieldSet) BuildOrderArray(order []string, sort *bson.D) error {
 		} else {
 			return fmt.Errorf("order field %s should start with +/- ", value)
 		}
-		if _, ok := fs.IsFieldMember(k); !ok {
+		if k == scoreField {
+			if !scoreOk {
+				return fmt.Errorf("order field %s only in search", value)
+			}
+		} else if _, ok := fs.IsFieldMember(k); !ok {
 			return fmt.Errorf("order field %s unknown", value)
 		}
+		if fs.IsFieldHidden(k) {
+			return fmt.Errorf("order field %s not allowed", value)
+		}
 		*sort = append(*sort, bson.DocElem{Name: k, Value: v})
 	}
 	return nil
@@ -718,24 +1899,256 @@ func (fs *FieldSet) OrderArray2Slice(sort *bson.D) []string {
 			dir = "-"
 		}
 		// id --> _id
-		if k == "id" {
-			k = "_id"
-		}
-		r = append(r, dir+k)
+		r = append(r, dir+fs.storageField(k))
 	}
 	return r
 }
 
 // BuildSelectObj build the select fields
+// a field prefixed with "-" is excluded, inclusion and exclusion can not be mixed except "-id"
 func (fs *FieldSet) BuildSelectObj(slice []string, sel map[string]interface{}) error {
+	include := 0
+	exclude := make(map[string]bool)
 	for _, value := range slice {
-		if len(value) == 0 {
+		field := strings.TrimPrefix(value, "-")
+		if len(field) == 0 {
+			return fmt.Errorf("select field invalid")
+		}
+		if _, ok := fs.IsFieldMember(field); !ok {
+			return fmt.Errorf("select field %s unknown", field)
+		}
+		if field != value {
+			exclude[field] = true
+			sel[field] = 0
+			continue
+		}
+		include++
+		// hidden fields are stripped from projection
+		if !fs.IsFieldHidden(field) {
+			sel[field] = 1
+		}
+	}
+	if include > 0 && (len(exclude) > 1 || len(exclude) == 1 && !exclude["id"]) {
+		return fmt.Errorf("select can not mix inclusion and exclusion except -id")
+	}
+	if include > 0 && !exclude["id"] {
+		// keep the projection inclusive even if all fields selected are hidden
+		sel["id"] = 1
+	}
+	if include > 0 && fs.schemaVersion > 0 {
+		// migrations need the version of docs partially selected
+		sel[schemaVersionField] = 1
+	}
+	if include == 0 {
+		fs.excludeHidden(sel)
+	}
+	fs.recordRead(fs.SelectedFields(slice))
+	return nil
+}
+
+// excludeHidden adds hidden fields to the exclusion projection, without path collision
+func (fs *FieldSet) excludeHidden(sel map[string]interface{}) {
+	for _, field := range fs.hidden {
+		collision := false
+		for k := range sel {
+			if field == k || strings.HasPrefix(field, k+".") {
+				collision = true
+				break
+			}
+			if strings.HasPrefix(k, field+".") {
+				delete(sel, k)
+			}
+		}
+		if !collision {
+			sel[field] = 0
+		}
+	}
+}
+
+// BuildSelectEntries build the select fields, entries are field names or slices of array fields
+// e.g.: ["id", "title", {"comments": {"slice": 10}}], slice is first N, -N for last N, or [skip, N]
+func (fs *FieldSet) BuildSelectEntries(entries []interface{}, sel map[string]interface{}) error {
+	names := make([]string, 0, len(entries))
+	slices := make(map[string]interface{})
+	for _, entry := range entries {
+		switch v := entry.(type) {
+		case string:
+			names = append(names, v)
+		case map[string]interface{}:
+			for k, value := range v {
+				m, ok := value.(map[string]interface{})
+				if !ok || len(m) != 1 || m["slice"] == nil {
+					return fmt.Errorf("select field %s should be like {\"slice\": 10}", k)
+				}
+				kind, ok := fs.IsFieldMember(k)
+				if !ok {
+					return fmt.Errorf("select field %s unknown", k)
+				}
+				if kind <= KindArrayBase || kind >= KindArrayEnd {
+					return fmt.Errorf("select field %s slice not array", k)
+				}
+				slice, ok := parseSelectSlice(m["slice"])
+				if !ok {
+					return fmt.Errorf("select field %s slice invalid", k)
+				}
+				slices[k] = slice
+			}
+		default:
 			return fmt.Errorf("select field invalid")
 		}
-		if _, ok := fs.IsFieldMember(value); !ok {
-			return fmt.Errorf("select field %s unknown", value)
+	}
+	if len(names) > 0 {
+		if err := fs.BuildSelectObj(names, sel); err != nil {
+			return err
+		}
+	} else {
+		fs.recordRead(nil)
+	}
+	for k, slice := range slices {
+		if fs.IsFieldHidden(k) {
+			continue
+		}
+		sel[k] = bson.M{"$slice": slice}
+	}
+	return nil
+}
+
+// parseSelectSlice parse N or [skip, N] of slice in select
+func parseSelectSlice(value interface{}) (interface{}, bool) {
+	if n := CheckInt(value); n != nil {
+		return n, n.(int64) != 0
+	}
+	arr, ok := value.([]interface{})
+	if !ok || len(arr) != 2 {
+		return nil, false
+	}
+	skip, limit := CheckInt(arr[0]), CheckInt(arr[1])
+	if skip == nil || limit == nil || limit.(int64) <= 0 {
+		return nil, false
+	}
+	return []interface{}{skip, limit}, true
+}
+
+// SelectEntryNames get the field names of select entries, empty if only slices which select all fields
+func SelectEntryNames(entries []interface{}) []string {
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if v, ok := entry.(string); ok {
+			names = append(names, v)
+		}
+	}
+	if len(names) == 0 {
+		return names
+	}
+	for _, entry := range entries {
+		if v, ok := entry.(map[string]interface{}); ok {
+			for k := range v {
+				names = append(names, k)
+			}
+		}
+	}
+	return names
+}
+
+// SelectedFields get the top level fields selected by the select param, nil if all
+func (fs *FieldSet) SelectedFields(slice []string) []string {
+	include := make([]string, 0, len(slice))
+	exclude := make(map[string]bool)
+	for _, value := range slice {
+		if strings.HasPrefix(value, "-") {
+			exclude[value[1:]] = true
+		} else {
+			include = append(include, value)
+		}
+	}
+	if len(include) > 0 || len(exclude) == 0 {
+		return include
+	}
+	fields := make([]string, 0, len(fs.FSli))
+	for _, field := range fs.FSli {
+		if !exclude[field] && !strings.Contains(field, ".") {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// BuildSliceObj build the $slice projection of array fields
+func (fs *FieldSet) BuildSliceObj(slice map[string]interface{}, sel map[string]interface{}) error {
+	for k, value := range slice {
+		kind, ok := fs.IsFieldMember(k)
+		if !ok {
+			return fmt.Errorf("slice field %s unknown", k)
+		}
+		if kind <= KindArrayBase || kind >= KindArrayEnd {
+			return fmt.Errorf("slice field %s not array", k)
+		}
+		switch mv := value.(type) {
+		case map[string]interface{}:
+			limit := CheckInt(mv["limit"])
+			if limit == nil || limit.(int64) <= 0 {
+				return fmt.Errorf("slice field %s limit invalid", k)
+			}
+			if _, ok := mv["skip"]; !ok {
+				sel[k] = bson.M{"$slice": limit}
+				continue
+			}
+			skip := CheckInt(mv["skip"])
+			if skip == nil {
+				return fmt.Errorf("slice field %s skip invalid", k)
+			}
+			sel[k] = bson.M{"$slice": []interface{}{skip, limit}}
+		default:
+			return fmt.Errorf("slice field %s not map", k)
+		}
+	}
+	return nil
+}
+
+// CheckNFCFields check the NFC fields in the config of Processor valid or not
+func (fs *FieldSet) CheckNFCFields(fields []string) error {
+	fields = RemoveDupArray(fields)
+	for _, field := range fields {
+		if len(field) <= 0 {
+			return fmt.Errorf("nfc field %s invalid", field)
+		}
+		kind, ok := fs.IsFieldMember(field)
+		if !ok {
+			return fmt.Errorf("nfc field %s unknown", field)
+		}
+		if kind != KindString && kind != KindArrayString && kind != KindMapString {
+			return fmt.Errorf("nfc field %s not string", field)
+		}
+	}
+	return nil
+}
+
+// CheckHiddenFields check the hidden fields in the config of Processor valid or not
+func (fs *FieldSet) CheckHiddenFields(fields []string) error {
+	for _, field := range fields {
+		if len(field) <= 0 || field == "id" {
+			return fmt.Errorf("hidden field %s invalid", field)
+		}
+		if _, ok := fs.FMap[field]; !ok {
+			return fmt.Errorf("hidden field %s unknown", field)
+		}
+	}
+	return nil
+}
+
+// CheckReferenceFields check the reference fields in the config of Processor valid or not
+func (fs *FieldSet) CheckReferenceFields(fields []string) error {
+	for _, field := range fields {
+		if len(field) <= 0 || strings.Contains(field, ".") {
+			return fmt.Errorf("reference field %s invalid", field)
+		}
+		kind, ok := fs.IsFieldMember(field)
+		if !ok {
+			return fmt.Errorf("reference field %s unknown", field)
+		}
+		if kind != KindString && kind != KindArrayString {
+			return fmt.Errorf("reference field %s not string", field)
 		}
-		sel[value] = 1
 	}
 	return nil
 }
@@ -824,6 +2237,14 @@ func (fs *FieldSet) CheckIndexFields(fields []string) ([]string, error) {
 		if len(field) <= 1 {
 			return nil, fmt.Errorf("index fields[%d]=%s invalid", i, field)
 		}
+		// geo index, e.g.: $2dsphere:location
+		if strings.HasPrefix(field, "$2dsphere:") {
+			if kind, ok := fs.IsFieldMember(strings.TrimPrefix(field, "$2dsphere:")); !ok || kind != KindGeo {
+				return nil, fmt.Errorf("index fields[%d]=%s not geo", i, field)
+			}
+			formatFields = append(formatFields, field)
+			continue
+		}
 		r, k := field[0], field[1:]
 		if r != '+' && r != '-' {
 			return nil, fmt.Errorf("index fields[%d]=%s should start with +/- ", i, field)
@@ -848,6 +2269,9 @@ func (fs *FieldSet) ParseSimpleValue(value interface{}, kind uint) interface{} {
 	if value == nil {
 		return nil
 	}
+	if fs.coerceFilter {
+		value = CoerceKindValue(value, kind)
+	}
 	switch kind {
 	case KindBool:
 		return CheckBool(value)
@@ -861,6 +2285,18 @@ func (fs *FieldSet) ParseSimpleValue(value interface{}, kind uint) interface{} {
 		return CheckString(value)
 	case KindObject:
 		return CheckObject(value)
+	case KindDate:
+		return CheckDate(value)
+	case KindDuration:
+		return CheckDuration(value)
+	case KindGeo:
+		return CheckGeo(value)
+	case KindDecimal:
+		return CheckDecimal(value)
+	case KindBinary:
+		return CheckBinary(value)
+	case KindAny:
+		return CheckAny(value)
 	}
 	return nil
 }
@@ -905,6 +2341,18 @@ func ParseKindValue(value interface{}, kind uint) interface{} {
 		return CheckString(value)
 	case KindObject:
 		return CheckObject(value)
+	case KindDate:
+		return CheckDate(value)
+	case KindDuration:
+		return CheckDuration(value)
+	case KindGeo:
+		return CheckGeo(value)
+	case KindDecimal:
+		return CheckDecimal(value)
+	case KindBinary:
+		return CheckBinary(value)
+	case KindAny:
+		return CheckAny(value)
 	case KindArrayBool:
 		fallthrough
 	case KindArrayInt:
@@ -939,6 +2387,50 @@ func ParseKindValue(value interface{}, kind uint) interface{} {
 	return nil
 }
 
+// CoerceKindValue converts the string representation of bool or number to the kind
+// e.g.: "42" to 42 for int kind, "true" to true for bool kind
+// arrays and maps are converted elementwise, value returned as is if can not be converted
+func CoerceKindValue(value interface{}, kind uint) interface{} {
+	switch v := value.(type) {
+	case string:
+		s := strings.TrimSpace(v)
+		switch kind {
+		case KindBool:
+			if b, err := strconv.ParseBool(s); err == nil {
+				return b
+			}
+		case KindInt:
+			if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return n
+			}
+		case KindUint:
+			if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+				return n
+			}
+		case KindFloat:
+			// NaN and Inf are not numbers of json
+			if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+				return f
+			}
+		}
+	case []interface{}:
+		if KindArrayBase < kind && kind < KindArrayEnd && kind != KindArrayObject {
+			r := make([]interface{}, 0, len(v))
+			for _, elem := range v {
+				r = append(r, CoerceKindValue(elem, kind-KindArrayBase))
+			}
+			return r
+		}
+	case map[string]interface{}:
+		if KindMapBase < kind && kind < KindMapEnd && kind != KindMapObject {
+			for k, elem := range v {
+				v[k] = CoerceKindValue(elem, kind-KindMapBase)
+			}
+		}
+	}
+	return value
+}
+
 // ParseKindArray parse all array kind of value
 func ParseKindArray(value []interface{}, kind uint) interface{} {
 	r := make([]interface{}, 0, len(value))
@@ -981,7 +2473,7 @@ func IsEmpty(value interface{}, kind uint) bool {
 	switch {
 	case k == KindBool:
 		return IsEmptyBool(value)
-	case KindInt <= k && k < KindFloat:
+	case KindInt <= k && k < KindFloat, k == KindDuration:
 		return IsEmptyNumber(value)
 	case k == KindString:
 		return IsEmptyString(value)
@@ -1000,7 +2492,7 @@ func EmptyValue(kind uint) interface{} {
 	switch kind {
 	case KindBool:
 		return false
-	case KindInt, KindUint, KindFloat:
+	case KindInt, KindUint, KindFloat, KindDuration:
 		return 0
 	case KindString:
 		return ""
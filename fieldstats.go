@@ -0,0 +1,133 @@
+package restful
+
+import (
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// FieldStat is the access statistics of a field, counts are sampled
+type FieldStat struct {
+	Name      string `json:"name"`
+	Reads     int64  `json:"reads"`      // times selected explicitly or read by full doc
+	Writes    int64  `json:"writes"`     // times written
+	LastRead  int64  `json:"last_read"`  // unix timestamp, 0 if never
+	LastWrite int64  `json:"last_write"` // unix timestamp, 0 if never
+}
+
+type fieldCounter struct {
+	reads     int64
+	writes    int64
+	lastRead  int64
+	lastWrite int64
+}
+
+// fieldStats records sampled reads and writes of fields
+// counters are created at build time, so no lock is needed when counting
+type fieldStats struct {
+	rate     float64
+	counters map[string]*fieldCounter
+}
+
+// SetStatsSampleRate enables field access statistics with sample rate in (0, 1]
+// rate <= 0 disables it
+func (fs *FieldSet) SetStatsSampleRate(rate float64) {
+	if rate <= 0 {
+		fs.stats = nil
+		return
+	}
+	if rate > 1 {
+		rate = 1
+	}
+	stats := &fieldStats{
+		rate:     rate,
+		counters: make(map[string]*fieldCounter, len(fs.FSli)),
+	}
+	for _, name := range fs.FSli {
+		stats.counters[name] = &fieldCounter{}
+	}
+	fs.stats = stats
+}
+
+// Stats get the field access statistics ordered, nil if not enabled
+func (fs *FieldSet) Stats() []FieldStat {
+	if fs.stats == nil {
+		return nil
+	}
+	stats := make([]FieldStat, 0, len(fs.FSli))
+	for _, name := range fs.FSli {
+		c := fs.stats.counters[name]
+		stats = append(stats, FieldStat{
+			Name:      name,
+			Reads:     atomic.LoadInt64(&c.reads),
+			Writes:    atomic.LoadInt64(&c.writes),
+			LastRead:  atomic.LoadInt64(&c.lastRead),
+			LastWrite: atomic.LoadInt64(&c.lastWrite),
+		})
+	}
+	return stats
+}
+
+// sampled decides the access should be recorded or not
+func (s *fieldStats) sampled() bool {
+	return s != nil && (s.rate >= 1 || rand.Float64() < s.rate)
+}
+
+// recordRead records the fields selected, all fields if empty
+func (fs *FieldSet) recordRead(fields []string) {
+	if !fs.stats.sampled() {
+		return
+	}
+	now := time.Now().Unix()
+	if len(fields) == 0 {
+		fields = fs.FSli
+	}
+	for _, field := range fields {
+		if c := fs.stats.counter(field); c != nil {
+			atomic.AddInt64(&c.reads, 1)
+			atomic.StoreInt64(&c.lastRead, now)
+		}
+	}
+}
+
+// recordWrite records the fields in obj written
+func (fs *FieldSet) recordWrite(obj map[string]interface{}) {
+	if !fs.stats.sampled() {
+		return
+	}
+	fs.stats.write(obj, "", time.Now().Unix())
+}
+
+func (s *fieldStats) write(obj map[string]interface{}, prefix string, now int64) {
+	for k, value := range obj {
+		full := prefix + k
+		c := s.counter(full)
+		if c == nil {
+			continue
+		}
+		atomic.AddInt64(&c.writes, 1)
+		atomic.StoreInt64(&c.lastWrite, now)
+		switch v := value.(type) {
+		case map[string]interface{}:
+			s.write(v, full+".", now)
+		case []interface{}:
+			for _, elem := range v {
+				if m, ok := elem.(map[string]interface{}); ok {
+					s.write(m, full+".", now)
+				}
+			}
+		}
+	}
+}
+
+// counter get the counter of field, the map field for map member, e.g.: extent1.key
+func (s *fieldStats) counter(field string) *fieldCounter {
+	if c, ok := s.counters[field]; ok {
+		return c
+	}
+	if i := strings.LastIndex(field, "."); i > 0 {
+		return s.counters[field[:i]]
+	}
+	return nil
+}
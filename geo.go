@@ -0,0 +1,288 @@
+package restful
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// meters of earth radius, converting distance to radians
+const earthRadius = 6378100.0
+
+// GeoPoint is a GeoJSON point in DataStruct, e.g.: {"type": "Point", "coordinates": [113.94, 22.54]}
+// any struct shaped like GeoJSON with `type` and `coordinates` fields is a geo field
+type GeoPoint struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"`
+}
+
+// depth of nested coordinates arrays of each GeoJSON type
+var geoDepth = map[string]int{
+	"Point":           1,
+	"MultiPoint":      2,
+	"LineString":      2,
+	"MultiLineString": 3,
+	"Polygon":         3,
+	"MultiPolygon":    4,
+}
+
+// isGeoType check the struct is shaped like GeoJSON or not
+func isGeoType(t reflect.Type) bool {
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+	hasType, hasCoordinates := false, false
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _ := fieldName(f)
+		switch name {
+		case "type":
+			hasType = f.Type.Kind() == reflect.String
+		case "coordinates":
+			hasCoordinates = f.Type.Kind() == reflect.Slice || f.Type.Kind() == reflect.Array
+		}
+	}
+	return hasType && hasCoordinates
+}
+
+// CheckGeo check value type
+// if value is a GeoJSON geometry with valid coordinates, return it as map
+// if value is not any type represent GEO, return nil
+func CheckGeo(value interface{}) interface{} {
+	var m map[string]interface{}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m = v
+	case bson.M:
+		m = v
+	default:
+		return nil
+	}
+	typ, ok := m["type"].(string)
+	if !ok {
+		return nil
+	}
+	depth, ok := geoDepth[typ]
+	if !ok {
+		return nil
+	}
+	coordinates := checkGeoCoordinates(m["coordinates"], depth)
+	if coordinates == nil {
+		return nil
+	}
+	return map[string]interface{}{"type": typ, "coordinates": coordinates}
+}
+
+// checkGeoCoordinates check the nested arrays of coordinates, a position is [lng, lat]
+func checkGeoCoordinates(value interface{}, depth int) interface{} {
+	arr, ok := value.([]interface{})
+	if !ok {
+		return nil
+	}
+	if depth == 1 {
+		if len(arr) < 2 || len(arr) > 3 {
+			return nil
+		}
+		pos := make([]interface{}, 0, len(arr))
+		for _, elem := range arr {
+			f := CheckFloat(elem)
+			if f == nil {
+				return nil
+			}
+			pos = append(pos, f)
+		}
+		lng, lat := pos[0].(float64), pos[1].(float64)
+		if lng < -180 || lng > 180 || lat < -90 || lat > 90 {
+			return nil
+		}
+		return pos
+	}
+	if len(arr) == 0 {
+		return nil
+	}
+	r := make([]interface{}, 0, len(arr))
+	for _, elem := range arr {
+		v := checkGeoCoordinates(elem, depth-1)
+		if v == nil {
+			return nil
+		}
+		r = append(r, v)
+	}
+	return r
+}
+
+// parseGeoCircle parse the center and radius in meters of {"lng": 113.94, "lat": 22.54, <radiusKey>: 1000}
+func parseGeoCircle(m map[string]interface{}, radiusKey string) ([]interface{}, float64, error) {
+	center := checkGeoCoordinates([]interface{}{m["lng"], m["lat"]}, 1)
+	if center == nil {
+		return nil, 0, fmt.Errorf("lng or lat invalid")
+	}
+	radius := CheckFloat(m[radiusKey])
+	if radius == nil || radius.(float64) <= 0 {
+		return nil, 0, fmt.Errorf("%s should be positive meters", radiusKey)
+	}
+	return center.([]interface{}), radius.(float64), nil
+}
+
+// BuildNearObj build the condition of `near` filter, docs are sorted by distance, nearest first
+// e.g.: {"location": {"lng": 113.94, "lat": 22.54, "max": 1000}}, max is the distance in meters
+func (fs *FieldSet) BuildNearObj(near map[string]interface{}, cond map[string]interface{}) error {
+	for k, value := range near {
+		if _, exist := cond[k]; exist {
+			return fmt.Errorf("near field %s condition conflict", k)
+		}
+		kind, ok := fs.IsFieldMember(k)
+		if !ok {
+			return fmt.Errorf("near field %s unknown", k)
+		}
+		if fs.IsFieldHidden(k) {
+			return fmt.Errorf("near field %s not allowed", k)
+		}
+		if kind != KindGeo {
+			return fmt.Errorf("near field %s not geo", k)
+		}
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("near field %s not map", k)
+		}
+		center, max, err := parseGeoCircle(m, "max")
+		if err != nil {
+			return fmt.Errorf("near field %s %s", k, err.Error())
+		}
+		cond[k] = bson.M{"$nearSphere": bson.M{
+			"$geometry":    bson.M{"type": "Point", "coordinates": center},
+			"$maxDistance": max,
+		}}
+	}
+	return nil
+}
+
+// BuildGeoWithinObj build the condition of `geo_within` filter
+// value is a GeoJSON Polygon or MultiPolygon, or a circle like {"lng": 113.94, "lat": 22.54, "radius": 1000}
+func (fs *FieldSet) BuildGeoWithinObj(within map[string]interface{}, cond map[string]interface{}) error {
+	for k, value := range within {
+		if _, exist := cond[k]; exist {
+			return fmt.Errorf("geo_within field %s condition conflict", k)
+		}
+		kind, ok := fs.IsFieldMember(k)
+		if !ok {
+			return fmt.Errorf("geo_within field %s unknown", k)
+		}
+		if fs.IsFieldHidden(k) {
+			return fmt.Errorf("geo_within field %s not allowed", k)
+		}
+		if kind != KindGeo {
+			return fmt.Errorf("geo_within field %s not geo", k)
+		}
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("geo_within field %s not map", k)
+		}
+		if _, ok := m["type"]; ok {
+			geo := CheckGeo(m)
+			if geo == nil || (m["type"] != "Polygon" && m["type"] != "MultiPolygon") {
+				return fmt.Errorf("geo_within field %s should be Polygon or MultiPolygon", k)
+			}
+			cond[k] = bson.M{"$geoWithin": bson.M{"$geometry": geo}}
+			continue
+		}
+		center, radius, err := parseGeoCircle(m, "radius")
+		if err != nil {
+			return fmt.Errorf("geo_within field %s %s", k, err.Error())
+		}
+		cond[k] = bson.M{"$geoWithin": bson.M{"$centerSphere": []interface{}{center, radius / earthRadius}}}
+	}
+	return nil
+}
+
+// countCondition converts $nearSphere to $geoWithin of the same circle,
+// for count and aggregate $match which do not support $nearSphere
+func countCondition(condition map[string]interface{}) map[string]interface{} {
+	var r map[string]interface{}
+	copied := func() {
+		if r == nil {
+			r = make(map[string]interface{}, len(condition))
+			for k, v := range condition {
+				r[k] = v
+			}
+		}
+	}
+	for k, v := range condition {
+		if k == "$and" {
+			// conditions merged, e.g. by soft delete or filters
+			and, ok := v.([]interface{})
+			if !ok || !hasNear(map[string]interface{}{k: and}) {
+				continue
+			}
+			conds := make([]interface{}, 0, len(and))
+			for _, c := range and {
+				conds = append(conds, countCondition(docMap(c)))
+			}
+			copied()
+			r[k] = conds
+			continue
+		}
+		m, ok := v.(bson.M)
+		if !ok {
+			continue
+		}
+		near, ok := m["$nearSphere"].(bson.M)
+		if !ok {
+			continue
+		}
+		copied()
+		center := near["$geometry"].(bson.M)["coordinates"]
+		radians := near["$maxDistance"].(float64) / earthRadius
+		r[k] = bson.M{"$geoWithin": bson.M{"$centerSphere": []interface{}{center, radians}}}
+	}
+	if r == nil {
+		return condition
+	}
+	return r
+}
+
+// hasNear check the condition has $nearSphere or not, in $and too
+func hasNear(condition map[string]interface{}) bool {
+	for k, v := range condition {
+		if k == "$and" {
+			if and, ok := v.([]interface{}); ok {
+				for _, c := range and {
+					if hasNear(docMap(c)) {
+						return true
+					}
+				}
+			}
+			continue
+		}
+		if m, ok := v.(bson.M); ok {
+			if _, ok := m["$nearSphere"]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// geoIndexes get the 2dsphere indexes of geo fields missing in indexes
+func (fs *FieldSet) geoIndexes(indexes []Index) []Index {
+	r := make([]Index, 0)
+	for _, name := range fs.FSli {
+		if fs.FMap[name].Kind != KindGeo {
+			continue
+		}
+		key := "$2dsphere:" + name
+		exist := false
+		for _, index := range indexes {
+			for _, k := range index.Key {
+				if k == key {
+					exist = true
+				}
+			}
+		}
+		if !exist {
+			r = append(r, Index{Key: []string{key}})
+		}
+	}
+	return r
+}
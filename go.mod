@@ -8,5 +8,7 @@ require (
 	github.com/jimdn/objectid v1.0.0
 	github.com/kr/pretty v0.2.0 // indirect
 	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d
+	golang.org/x/crypto v0.14.0
+	golang.org/x/text v0.13.0
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 )
@@ -0,0 +1,57 @@
+package restful
+
+import (
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// writeGuard is the conditions the doc must meet when it is written, checked atomically by the selector of the write,
+// e.g. bounds of $inc, maxitems of $push, so checks on the doc read before are not raced by concurrent writes
+type writeGuard struct {
+	conds []guardCond
+}
+
+type guardCond struct {
+	expr   bson.M // condition by the names stored
+	reason string // reason if not met
+}
+
+// add adds the condition, e.g.: {"tags.9": {"$exists": false}}
+func (g *writeGuard) add(expr bson.M, reason string) {
+	g.conds = append(g.conds, guardCond{expr: expr, reason: reason})
+}
+
+// selector merges the conditions into the selector of write
+func (g *writeGuard) selector(selector bson.M) bson.M {
+	if g == nil || len(g.conds) == 0 {
+		return selector
+	}
+	and, _ := selector["$and"].([]interface{})
+	for _, c := range g.conds {
+		and = append(and, c.expr)
+	}
+	selector["$and"] = and
+	return selector
+}
+
+// failure get the reason of condition not met by the doc, after the write matched nothing,
+// empty if the doc not found or all met, then the write failed by id or seq
+func (g *writeGuard) failure(dbc *mgo.Collection, id interface{}) string {
+	if g == nil {
+		return ""
+	}
+	for _, c := range g.conds {
+		n, err := dbc.Find(bson.M{"_id": id, "$nor": []interface{}{c.expr}}).Count()
+		if err == nil && n > 0 {
+			return c.reason
+		}
+	}
+	return ""
+}
+
+// guardError is the error of a write failed by the condition of guard not met
+type guardError string
+
+func (e guardError) Error() string {
+	return string(e)
+}
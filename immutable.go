@@ -0,0 +1,179 @@
+package restful
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// checkImmutableFields check the fields of Processor.ImmutableFields when init
+func (p *Processor) checkImmutableFields(report *InitReport) {
+	for _, field := range p.ImmutableFields {
+		if strings.Contains(field, ".") {
+			report.Add(p.Biz, "immutable field %s not top level", field)
+			continue
+		}
+		if _, ok := p.FieldSet.FMap[field]; !ok || field == "id" {
+			report.Add(p.Biz, "immutable field %s invalid", field)
+		}
+	}
+}
+
+// isEmptyValue check the stored value is empty or not, an immutable field can be set while empty
+func isEmptyValue(value interface{}) bool {
+	return value == nil || value == ""
+}
+
+// sameValue check the stored value and the value written are the same or not, ignoring number types,
+// decimals are compared by their strings, times by Equal, objects and arrays by their members
+func sameValue(stored, written interface{}) bool {
+	switch a := stored.(type) {
+	case bson.Decimal128:
+		b, ok := written.(bson.Decimal128)
+		return ok && a.String() == b.String()
+	case time.Time:
+		b, ok := written.(time.Time)
+		return ok && a.Equal(b)
+	case map[string]interface{}, bson.M:
+		switch written.(type) {
+		case map[string]interface{}, bson.M:
+		default:
+			return false
+		}
+		m, n := docMap(a), docMap(written)
+		if len(m) != len(n) {
+			return false
+		}
+		for k, v := range m {
+			w, ok := n[k]
+			if !ok || !sameValue(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := written.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !sameValue(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	if a, ok := numberValue(stored); ok {
+		b, ok := numberValue(written)
+		return ok && a == b
+	}
+	return reflect.DeepEqual(stored, written)
+}
+
+// sameKindValue check the values are the same after both parsed by the kind of field
+func sameKindValue(stored, written interface{}, kind uint) bool {
+	a, b := ParseKindValue(stored, kind), ParseKindValue(written, kind)
+	if a == nil || b == nil {
+		return sameValue(stored, written)
+	}
+	return sameValue(a, b)
+}
+
+// numberValue get the value of number types as float64, or integers as int64 exactly
+func numberValue(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		if v <= math.MaxInt64 {
+			return int64(v), true
+		}
+		return float64(v), true
+	case float32:
+		return numberValue(float64(v))
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v), true
+		}
+		return v, true
+	}
+	return nil, false
+}
+
+// checkImmutable check the write does not change immutable fields set in the doc stored
+// replace is true for PUT, immutable fields absent in info are kept with the values stored
+// update is the update of PATCH built, immutable fields can only be written by $set
+// fields empty when checked are added to guard, so they are not set by concurrent writes meanwhile
+func (p *Processor) checkImmutable(dbc *mgo.Collection, id string, info map[string]interface{}, update map[string]interface{}, replace bool, guard *writeGuard) *Rsp {
+	fields := make([]string, 0)
+	for _, field := range p.ImmutableFields {
+		for op, v := range update {
+			if m, ok := v.(map[string]interface{}); ok && op != "$set" {
+				for k := range m {
+					if k == field || strings.HasPrefix(k, field+".") {
+						return genRsp(http.StatusBadRequest, fmt.Sprintf("immutable field %s can not be written by %s", field, op), nil)
+					}
+				}
+			}
+		}
+		if replace || isFieldWritten(info, field) {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	selector := bson.M{}
+	for _, field := range fields {
+		selector[p.FieldSet.storageField(field)] = 1
+	}
+	var old map[string]interface{}
+	err := dbc.Find(bson.M{"_id": id}).Select(selector).One(&old)
+	if err != nil && err != mgo.ErrNotFound {
+		return genRsp(http.StatusInternalServerError, "db access fail", nil)
+	}
+	p.FieldSet.apiNames(old)
+	if err := p.keepImmutable(old, info, replace, guard); err != nil {
+		return genRsp(http.StatusConflict, err.Error(), nil)
+	}
+	return nil
+}
+
+// keepImmutable check info does not change immutable fields set in old, nil if not stored, by names in API,
+// immutable fields absent in info are kept with the values stored if replace,
+// fields empty in old are added to guard
+func (p *Processor) keepImmutable(old map[string]interface{}, info map[string]interface{}, replace bool, guard *writeGuard) error {
+	for _, field := range p.ImmutableFields {
+		if !replace && !isFieldWritten(info, field) {
+			continue
+		}
+		stored := old[field]
+		if isEmptyValue(stored) {
+			guard.add(bson.M{p.FieldSet.storageField(field): bson.M{"$in": []interface{}{nil, ""}}},
+				fmt.Sprintf("immutable field %s already set", field))
+			continue
+		}
+		value, ok := info[field]
+		if !ok && replace {
+			info[field] = stored
+			continue
+		}
+		if !ok || !sameKindValue(stored, value, p.FieldSet.FMap[field].Kind) {
+			return fmt.Errorf("immutable field %s already set", field)
+		}
+	}
+	return nil
+}
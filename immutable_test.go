@@ -0,0 +1,60 @@
+package restful
+
+import (
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+type immutableDoc struct {
+	ID    *string  `json:"id,omitempty" bson:"_id,omitempty"`
+	Price *Decimal `json:"price,omitempty" bson:"price,omitempty"`
+	Btime *int64   `json:"btime,omitempty" bson:"btime,omitempty"`
+	Mtime *int64   `json:"mtime,omitempty" bson:"mtime,omitempty"`
+	Seq   *string  `json:"seq,omitempty" bson:"seq,omitempty"`
+}
+
+func TestImmutableDecimalRewritten(t *testing.T) {
+	p := &Processor{Biz: "immutable", DataStruct: new(immutableDoc), ImmutableFields: []string{"price"}}
+	if err := p.Init(); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	stored, _ := bson.ParseDecimal128("1.50")
+	old := map[string]interface{}{"price": stored}
+
+	for _, written := range []interface{}{"2.00", CheckDecimal("2.00")} {
+		info := map[string]interface{}{"price": written}
+		if err := p.keepImmutable(old, info, false, &writeGuard{}); err == nil {
+			t.Errorf("immutable decimal rewritten by %v", written)
+		}
+	}
+	for _, written := range []interface{}{"1.50", CheckDecimal("1.50")} {
+		info := map[string]interface{}{"price": written}
+		if err := p.keepImmutable(old, info, false, &writeGuard{}); err != nil {
+			t.Errorf("immutable decimal written the same by %v: %v", written, err)
+		}
+	}
+}
+
+func TestSameValue(t *testing.T) {
+	a, _ := bson.ParseDecimal128("1")
+	b, _ := bson.ParseDecimal128("2")
+	cases := []struct {
+		x, y interface{}
+		same bool
+	}{
+		{a, b, false},
+		{a, a, true},
+		{int64(3), float64(3), true},
+		{int(3), float64(3.5), false},
+		{"x", "x", true},
+		{bson.M{"a": []interface{}{1, "b"}}, map[string]interface{}{"a": []interface{}{int64(1), "b"}}, true},
+		{bson.M{"a": a}, bson.M{"a": b}, false},
+		{[]interface{}{1}, []interface{}{1, 2}, false},
+	}
+	for _, c := range cases {
+		if sameValue(c.x, c.y) != c.same {
+			t.Errorf("sameValue(%v, %v) != %v", c.x, c.y, c.same)
+		}
+	}
+}
@@ -0,0 +1,444 @@
+package restful
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// docs upserted in one bulk when importing
+const importBatchSize = 500
+
+// max errors reported when importing
+const importMaxErrors = 1000
+
+// ImportError is the error of a line when importing
+type ImportError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// RspImportData is the returning structure in `data` field for import request
+type RspImportData struct {
+	Total     int           `json:"total"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Errors    []ImportError `json:"errors"` // at most 1000 errors reported
+}
+
+// importRow is a doc parsed from a line
+type importRow struct {
+	line    int
+	info    map[string]interface{}
+	created bool // id generated, created as POST
+}
+
+// importer upserts the docs parsed in batches and collects errors
+type importer struct {
+	p     *Processor
+	query url.Values
+	dbc   *mgo.Collection
+	rows  []importRow
+	data  RspImportData
+	// docs not existing can be created by ids of lines, as PUT
+	upsert bool
+	// deprecated fields written by lines
+	deprecated map[string]bool
+}
+
+func (im *importer) fail(line int, err string) {
+	im.data.Failed++
+	if len(im.data.Errors) < importMaxErrors {
+		im.data.Errors = append(im.data.Errors, ImportError{Line: line, Error: err})
+	}
+}
+
+// add validates the doc of line and upserts when batch is full
+func (im *importer) add(line int, info map[string]interface{}) error {
+	im.data.Total++
+	created := false
+	if id, ok := info["id"]; ok {
+		v := GetString(id)
+		if v == "" {
+			im.fail(line, "custom id empty")
+			return nil
+		}
+		if StringLength(v) > 128 {
+			im.fail(line, "custom id too long")
+			return nil
+		}
+	} else {
+		info["id"] = GenUniqueID()
+		created = true
+	}
+	if err := im.p.CheckWriteRoles(im.query, info); err != nil {
+		im.fail(line, err.Error())
+		return nil
+	}
+	if err := im.p.ApplyProfile(im.query, info, true); err != nil {
+		im.fail(line, err.Error())
+		return nil
+	}
+	if err := im.p.ValidateCreate(info); err != nil {
+		im.fail(line, err.Error())
+		return nil
+	}
+	if len(im.p.deprecatedWrites) > 0 {
+		for _, field := range im.p.deprecatedFieldsIn(info, "") {
+			atomic.AddInt64(im.p.deprecatedWrites[field], 1)
+			im.deprecated[field] = true
+		}
+	}
+	if err := im.p.hashPasswords(info); err != nil {
+		im.fail(line, err.Error())
+		return nil
+	}
+	im.rows = append(im.rows, importRow{line: line, info: info, created: created})
+	if len(im.rows) >= importBatchSize {
+		return im.flush()
+	}
+	return nil
+}
+
+// flush upserts the docs in batch, btime and seq of the docs existing are kept
+// docs are checked by Processor.ValidateDocument with the docs existing first,
+// and written as PUT: soft-deleted docs are not revived, immutable fields and fields the caller has no role to write are kept
+func (im *importer) flush() error {
+	if len(im.rows) == 0 {
+		return nil
+	}
+	rows := im.rows
+	im.rows = nil
+
+	ids := make([]interface{}, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row.info["_id"])
+	}
+	var olds []map[string]interface{}
+	q := im.dbc.Find(bson.M{"_id": bson.M{"$in": ids}})
+	if im.p.ValidateDocument == nil {
+		// only fields kept are read, unless whole docs are validated
+		selector := im.p.restrictedSelector(im.query, im.p.passwordSelector(bson.M{"btime": 1, "seq": 1, "dtime": 1}))
+		for _, field := range im.p.ImmutableFields {
+			selector[im.p.FieldSet.storageField(field)] = 1
+		}
+		q = q.Select(selector)
+	}
+	err := q.All(&olds)
+	if err != nil {
+		return err
+	}
+	oldMap := make(map[interface{}]map[string]interface{}, len(olds))
+	for _, old := range olds {
+		if im.p.ValidateDocument != nil {
+			// validated by the current schema version
+			if _, err = im.p.FieldSet.Migrate(old); err != nil {
+				return err
+			}
+		}
+		im.p.FieldSet.apiNames(old)
+		oldMap[old["_id"]] = old
+	}
+	valid := rows[:0]
+	guards := make([]*writeGuard, 0, len(rows))
+	upserts := make([]bool, 0, len(rows))
+	for _, row := range rows {
+		old, exist := oldMap[row.info["_id"]]
+		if exist && im.p.SoftDelete && old["dtime"] != nil {
+			im.fail(row.line, "id deleted")
+			continue
+		}
+		if !exist && !row.created && !im.upsert {
+			im.fail(row.line, "id not found")
+			continue
+		}
+		if exist {
+			im.p.keepRestricted(im.query, row.info, old)
+		}
+		guard := &writeGuard{}
+		if err := im.p.keepImmutable(old, row.info, true, guard); err != nil {
+			im.fail(row.line, err.Error())
+			continue
+		}
+		if errRsp := im.p.validateDocument(oldMap[row.info["_id"]], row.info); errRsp != nil {
+			im.fail(row.line, errRsp.Msg)
+			continue
+		}
+		valid = append(valid, row)
+		guards = append(guards, guard)
+		upserts = append(upserts, im.upsert || row.created)
+	}
+	rows = valid
+	if len(rows) == 0 {
+		return nil
+	}
+
+	failed := make(map[int]bool)
+	failRow := func(i int, err error) {
+		failed[i] = true
+		if reason := guards[i].failure(im.dbc, rows[i].info["_id"]); reason != "" {
+			im.fail(rows[i].line, reason)
+			return
+		}
+		if err == mgo.ErrNotFound {
+			im.fail(rows[i].line, "id not found")
+			return
+		}
+		if field := im.p.duplicateField(err); field != "" {
+			im.fail(rows[i].line, "duplicate "+field)
+			return
+		}
+		im.fail(rows[i].line, err.Error())
+	}
+	bulk := im.dbc.Bulk()
+	bulk.Unordered()
+	for i, row := range rows {
+		ApplyInternalFields(row.info, oldMap[row.info["_id"]])
+		im.p.keepPasswords(row.info, oldMap[row.info["_id"]])
+		im.p.applySchemaVersion(row.info)
+		doc := im.p.FieldSet.InSort(&row.info)
+		if im.p.KeepRevisions {
+			// written one by one to keep the docs replaced as revisions
+			if err := im.p.applyWrite(im.query, im.dbc, guards[i].selector(im.p.liveSelector(bson.M{"_id": row.info["_id"]})), &doc, upserts[i]); err != nil {
+				failRow(i, err)
+			}
+			continue
+		}
+		if upserts[i] {
+			bulk.Upsert(guards[i].selector(im.p.liveSelector(bson.M{"_id": row.info["_id"]})), &doc)
+		} else {
+			bulk.Update(guards[i].selector(im.p.liveSelector(bson.M{"_id": row.info["_id"]})), &doc)
+		}
+	}
+	if !im.p.KeepRevisions {
+		_, err = bulk.Run()
+	}
+	if err != nil {
+		bulkErr, ok := err.(*mgo.BulkError)
+		if !ok {
+			return err
+		}
+		for _, c := range bulkErr.Cases() {
+			if c.Index < 0 || c.Index >= len(rows) {
+				return err
+			}
+			failRow(c.Index, c.Err)
+		}
+	}
+	for i, row := range rows {
+		if failed[i] {
+			continue
+		}
+		im.data.Succeeded++
+		im.p.writeDone("PUT", map[string]string{"id": GetString(row.info["_id"])}, im.query, row.info)
+	}
+	return nil
+}
+
+// importCell parse the CSV cell to the kind of column
+// arrays, maps and objects are decoded as json, others are coerced from string
+func importCell(cell string, kind uint) (interface{}, error) {
+	switch {
+	case kind == KindString:
+		return cell, nil
+	case kind == KindObject || KindArrayBase < kind && kind < KindArrayEnd || KindMapBase < kind && kind < KindMapEnd:
+		var v interface{}
+		if err := json.Unmarshal([]byte(cell), &v); err != nil {
+			return nil, fmt.Errorf("json invalid")
+		}
+		return v, nil
+	}
+	return CoerceKindValue(cell, kind), nil
+}
+
+// importSetPath sets value in info by dotted path, e.g.: extent1.key
+func importSetPath(info map[string]interface{}, path string, value interface{}) {
+	keys := strings.Split(path, ".")
+	m := info
+	for _, k := range keys[:len(keys)-1] {
+		sub, ok := m[k].(map[string]interface{})
+		if !ok {
+			sub = make(map[string]interface{})
+			m[k] = sub
+		}
+		m = sub
+	}
+	m[keys[len(keys)-1]] = value
+}
+
+func (p *Processor) importNDJSON(im *importer, body io.Reader, extJSON bool) error {
+	reader := bufio.NewReader(body)
+	line := 0
+	for {
+		buf, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(buf) > 0 {
+			line++
+			buf = bytes.TrimSpace(buf)
+			if len(buf) > 0 {
+				info, parseErr := ParseBody(buf)
+				if parseErr == nil && extJSON {
+					var v interface{}
+					v, parseErr = FromExtJSON(info)
+					if parseErr == nil {
+						info = v.(map[string]interface{})
+					}
+				}
+				if parseErr != nil {
+					im.data.Total++
+					im.fail(line, "invalid json: "+parseErr.Error())
+				} else if err := im.add(line, info); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+func (p *Processor) importCSV(im *importer, body io.Reader) error {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	header[0] = strings.TrimPrefix(header[0], "\xef\xbb\xbf")
+	kinds := make([]uint, 0, len(header))
+	for _, column := range header {
+		kind, ok := p.FieldSet.IsFieldMember(column)
+		if !ok {
+			return fmt.Errorf("csv column %s unknown", column)
+		}
+		kinds = append(kinds, kind)
+	}
+	// line 1 is header
+	line := 1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		line++
+		if _, ok := err.(*csv.ParseError); ok {
+			im.data.Total++
+			im.fail(line, err.Error())
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(record) != len(header) {
+			im.data.Total++
+			im.fail(line, fmt.Sprintf("csv columns %d mismatch header %d", len(record), len(header)))
+			continue
+		}
+		info := make(map[string]interface{})
+		var cellErr error
+		for i, cell := range record {
+			// empty cell means field absent
+			if cell == "" {
+				continue
+			}
+			value, err := importCell(cell, kinds[i])
+			if err != nil {
+				cellErr = fmt.Errorf("csv column %s %s", header[i], err.Error())
+				break
+			}
+			importSetPath(info, header[i], value)
+		}
+		if cellErr != nil {
+			im.data.Total++
+			im.fail(line, cellErr.Error())
+			continue
+		}
+		if err := im.add(line, info); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *Processor) defaultImport() StreamHandler {
+	return func(vars map[string]string, query url.Values, r *http.Request, w http.ResponseWriter) *Rsp {
+		begin := time.Now()
+		reqID := query.Get("reqid")
+		if reqID == "" {
+			reqID = "sys_" + RandString(8)
+		}
+		Log.Debugf("[req] %v POST %v/__import query=%v", reqID, p.URLPath, query)
+		defer r.Body.Close()
+
+		format := query.Get("format")
+		if format == "" {
+			format = "ndjson"
+		}
+		if format != "csv" && format != "ndjson" {
+			Log.Warnf("[rsp] %v POST %v/__import format %v invalid", reqID, p.URLPath, format)
+			return genRsp(http.StatusBadRequest, "format should be csv or ndjson", nil)
+		}
+
+		dbs := gCfg.MgoSess.Clone()
+		defer dbs.Close()
+		im := &importer{
+			p:     p,
+			query: query,
+			dbc:   dbs.DB(p.GetDbName(query)).C(p.GetTableName(query)),
+			data:  RspImportData{Errors: make([]ImportError, 0)},
+			// as PUT
+			upsert: !p.PutNoUpsert && strings.ToLower(query.Get("upsert")) != "false",
+
+			deprecated: make(map[string]bool),
+		}
+
+		var err error
+		if format == "csv" {
+			err = p.importCSV(im, r.Body)
+		} else {
+			err = p.importNDJSON(im, r.Body, isExtJSON(query))
+		}
+		if err == nil {
+			err = im.flush()
+		}
+		if err != nil {
+			Log.Warnf("[rsp] %v POST %v/__import fail after %d lines, err=%v", reqID, p.URLPath, im.data.Total, err)
+			return genRsp(http.StatusBadRequest, fmt.Sprintf("import fail: %v", err), im.data)
+		}
+
+		// ensure index
+		if p.Indexes != nil && len(p.Indexes) > 0 {
+			getIndexEnsureList().Push(&IndexToEnsureStruct{
+				DB:        p.GetDbName(query),
+				Table:     p.GetTableName(query),
+				Processor: p,
+			})
+		}
+
+		costMs := time.Since(begin).Nanoseconds() / int64(time.Millisecond)
+		Log.Warnf("[rsp] %v success, %d of %d docs imported, cost %vms", reqID, im.data.Succeeded, im.data.Total, costMs)
+		rsp := genRsp(http.StatusOK, "import ok", im.data)
+		for field := range im.deprecated {
+			rsp.Warnings = append(rsp.Warnings, fmt.Sprintf("field %s is deprecated", field))
+		}
+		sort.Strings(rsp.Warnings)
+		return rsp
+	}
+}
@@ -22,11 +22,12 @@ func getIndexMapKey(db, table string) string {
 
 // list to ensure index
 var indexEnsureList *IndexEnsureList
+var indexEnsureListOnce sync.Once
 
 func getIndexEnsureList() *IndexEnsureList {
-	if indexEnsureList == nil {
+	indexEnsureListOnce.Do(func() {
 		indexEnsureList = new(IndexEnsureList).Init()
-	}
+	})
 	return indexEnsureList
 }
 
@@ -92,13 +93,14 @@ func (l *IndexEnsureList) Pop() *IndexToEnsureStruct {
 // Cache to store index that has been ensured
 // 600 seconds expired, ensure again
 var indexEnsuredMap *IndexEnsuredMap
+var indexEnsuredMapOnce sync.Once
 
 func getIndexEnsuredMap() *IndexEnsuredMap {
-	if indexEnsuredMap == nil {
+	indexEnsuredMapOnce.Do(func() {
 		indexEnsuredMap = &IndexEnsuredMap{
 			M: make(map[string]int64),
 		}
-	}
+	})
 	return indexEnsuredMap
 }
 
@@ -156,16 +158,17 @@ func ensureIndexTask() {
 			continue
 		}
 		for i := 0; i < len(idx.Processor.Indexes); i++ {
+			key := idx.Processor.FieldSet.storageIndexKey(idx.Processor.Indexes[i].Key)
 			existInDB := false
 			for j := 0; j < len(indexesInDB); j++ {
-				if reflect.DeepEqual(idx.Processor.Indexes[i].Key, indexesInDB[j].Key) && idx.Processor.Indexes[i].Unique == indexesInDB[j].Unique {
+				if reflect.DeepEqual(key, indexesInDB[j].Key) && idx.Processor.Indexes[i].Unique == indexesInDB[j].Unique {
 					existInDB = true
 					break
 				}
 			}
 			if !existInDB {
 				err := dbc.EnsureIndex(mgo.Index{
-					Key:        idx.Processor.Indexes[i].Key,
+					Key:        key,
 					Unique:     idx.Processor.Indexes[i].Unique,
 					Background: true,
 				})
@@ -0,0 +1,74 @@
+package restful
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// run with -race, singletons are got concurrently at startup by handlers and the ensure task
+func TestIndexSingletonsConcurrent(t *testing.T) {
+	const n = 32
+	lists := make([]*IndexEnsureList, n)
+	maps := make([]*IndexEnsuredMap, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			lists[i] = getIndexEnsureList()
+			maps[i] = getIndexEnsuredMap()
+			lists[i].Push(&IndexToEnsureStruct{DB: "db", Table: fmt.Sprintf("t%d", i)})
+			maps[i].Set(getIndexMapKey("db", fmt.Sprintf("t%d", i)))
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 1; i < n; i++ {
+		if lists[i] != lists[0] {
+			t.Fatalf("ensure list %d not the singleton", i)
+		}
+		if maps[i] != maps[0] {
+			t.Fatalf("ensured map %d not the singleton", i)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if !maps[0].Exist(getIndexMapKey("db", fmt.Sprintf("t%d", i))) {
+			t.Errorf("index of t%d not ensured", i)
+		}
+	}
+	popped := 0
+	for idx := lists[0].Pop(); idx != nil; idx = lists[0].Pop() {
+		popped++
+	}
+	if popped != n {
+		t.Errorf("popped %d indexes, want %d", popped, n)
+	}
+}
+
+func TestIndexEnsureListPushPopConcurrent(t *testing.T) {
+	l := new(IndexEnsureList).Init()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				// duplicates are pushed once
+				l.Push(&IndexToEnsureStruct{DB: "db", Table: fmt.Sprintf("t%d", j%10)})
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				l.Pop()
+			}
+		}()
+	}
+	wg.Wait()
+	for idx := l.Pop(); idx != nil; idx = l.Pop() {
+	}
+	if len(l.indexToEnsureMap) != 0 || l.indexToEnsureList.Len() != 0 {
+		t.Errorf("list not empty after popped, map %d list %d", len(l.indexToEnsureMap), l.indexToEnsureList.Len())
+	}
+}
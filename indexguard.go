@@ -0,0 +1,153 @@
+package restful
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// indexKeyField get the field and direction of an index key, e.g.: -age, $2dsphere:location
+func indexKeyField(key string) (string, int64) {
+	if i := strings.Index(key, ":"); strings.HasPrefix(key, "$") && i > 0 {
+		return key[i+1:], 0
+	}
+	if strings.HasPrefix(key, "-") {
+		return key[1:], -1
+	}
+	return strings.TrimPrefix(key, "+"), 1
+}
+
+// isIndexedCondition check the condition by the names stored can use an index or not,
+// a field of condition is the first key of an index, or each branch of $or can use one
+func (p *Processor) isIndexedCondition(condition map[string]interface{}) bool {
+	for k, v := range condition {
+		switch k {
+		case "_id", "id":
+			return true
+		case "$or":
+			branches := condBranches(v)
+			covered := len(branches) > 0
+			for _, branch := range branches {
+				if !p.isIndexedCondition(docMap(branch)) {
+					covered = false
+				}
+			}
+			if covered {
+				return true
+			}
+		case "$and":
+			for _, elem := range condBranches(v) {
+				if p.isIndexedCondition(docMap(elem)) {
+					return true
+				}
+			}
+		default:
+			for _, index := range p.Indexes {
+				if field, _ := indexKeyField(index.Key[0]); p.FieldSet.storageField(field) == k {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// condBranches get the branches of $or or $and, built as []interface{}, or as []map[string]interface{} by InReplace
+func condBranches(v interface{}) []interface{} {
+	switch branches := v.(type) {
+	case []interface{}:
+		return branches
+	case []map[string]interface{}:
+		r := make([]interface{}, 0, len(branches))
+		for _, branch := range branches {
+			r = append(r, branch)
+		}
+		return r
+	case []bson.M:
+		r := make([]interface{}, 0, len(branches))
+		for _, branch := range branches {
+			r = append(r, branch)
+		}
+		return r
+	}
+	return nil
+}
+
+// isIndexedSort check the sort can use an index or not,
+// the keys of an index are the fields of condition followed by the sort, in the same or reversed direction
+func (p *Processor) isIndexedSort(condition map[string]interface{}, sort bson.D) bool {
+	// id as the last tiebreaker is fine
+	if n := len(sort); n > 0 && (sort[n-1].Name == "id" || sort[n-1].Name == "_id") {
+		sort = sort[:n-1]
+	}
+	if len(sort) == 0 {
+		return true
+	}
+	// docs searched by es are sorted in memory of the aggregate, ids matched are few
+	for _, elem := range sort {
+		if elem.Name == scoreField {
+			return true
+		}
+	}
+	for _, index := range p.Indexes {
+		keys := index.Key
+		for len(keys) > 0 {
+			field, _ := indexKeyField(keys[0])
+			if _, ok := condition[p.FieldSet.storageField(field)]; !ok || field == sort[0].Name {
+				break
+			}
+			keys = keys[1:]
+		}
+		if len(keys) < len(sort) {
+			continue
+		}
+		matched, reversed := true, false
+		for i, elem := range sort {
+			field, dir := indexKeyField(keys[i])
+			if field != elem.Name || dir == 0 {
+				matched = false
+				break
+			}
+			same := dir == elem.Value.(int64)
+			if i == 0 {
+				reversed = !same
+			} else if same == reversed {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIndexedQuery check the query of GET list, count, sample, export or stream is covered by Processor.Indexes if RequireIndexedQueries
+func (p *Processor) checkIndexedQuery(condition map[string]interface{}, sort bson.D) error {
+	if !p.RequireIndexedQueries {
+		return nil
+	}
+	fields := make([]string, 0, len(condition))
+	for k := range condition {
+		// soft-deleted docs excluded by default do not need index
+		if k != "dtime" {
+			fields = append(fields, k)
+		}
+	}
+	if len(fields) > 0 {
+		cond := make(map[string]interface{}, len(fields))
+		for _, k := range fields {
+			cond[k] = condition[k]
+		}
+		if !p.isIndexedCondition(cond) {
+			return fmt.Errorf("query not covered by index, declare an index starting with one of %v", fields)
+		}
+	}
+	if !p.isIndexedSort(condition, sort) {
+		order := p.FieldSet.OrderArray2Slice(&sort)
+		return fmt.Errorf("order not covered by index, declare an index with keys %v", order)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package restful
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// checkArrayItems check the arrays after $push, $addToSet or $pull of PATCH within minitems and maxitems,
+// arrays are read from the doc stored before update, and applied the operators in memory,
+// the bounds are added to guard by the number of elements added or removed, so concurrent writes can not exceed them
+func (p *Processor) checkArrayItems(dbc *mgo.Collection, id interface{}, update map[string]interface{}, guard *writeGuard) *Rsp {
+	ops := make(map[string]interface{})
+	selector := bson.M{}
+	for _, op := range []string{"$push", "$addToSet", "$pull"} {
+		fields := make(map[string]interface{})
+		for k, v := range docMap(update[op]) {
+			if f := p.FieldSet.FMap[k]; f.MinItems != nil || f.MaxItems != nil {
+				fields[k] = v
+				selector[p.FieldSet.storageField(k)] = 1
+			}
+		}
+		if len(fields) > 0 {
+			ops[op] = fields
+		}
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+
+	var doc map[string]interface{}
+	err := dbc.Find(bson.M{"_id": id}).Select(selector).One(&doc)
+	if err == mgo.ErrNotFound {
+		// PATCH fails by id not found
+		return nil
+	}
+	if err != nil {
+		return genRsp(http.StatusInternalServerError, "db access fail", nil)
+	}
+	p.FieldSet.apiNames(doc)
+	before := make(map[string]int)
+	for _, v := range ops {
+		for k := range docMap(v) {
+			value, _ := lookupPath(doc, k)
+			arr, _ := value.([]interface{})
+			before[k] = len(arr)
+		}
+	}
+	applyUpdate(doc, ops)
+	for _, v := range ops {
+		for k := range docMap(v) {
+			value, _ := lookupPath(doc, k)
+			arr, _ := value.([]interface{})
+			f := p.FieldSet.FMap[k]
+			if f.MinItems != nil && len(arr) < *f.MinItems {
+				return genRsp(http.StatusBadRequest, fmt.Sprintf("field %s items %d less than minitems %d", k, len(arr), *f.MinItems), nil)
+			}
+			if f.MaxItems != nil && len(arr) > *f.MaxItems {
+				return genRsp(http.StatusBadRequest, fmt.Sprintf("field %s items %d greater than maxitems %d", k, len(arr), *f.MaxItems), nil)
+			}
+			// n elements added: the array stored must have no element at index maxitems-n,
+			// n elements removed: the array stored must have an element at index minitems+n-1
+			sf := p.FieldSet.storageField(k)
+			n := len(arr) - before[k]
+			if f.MaxItems != nil && n > 0 {
+				guard.add(bson.M{sf + "." + strconv.Itoa(*f.MaxItems-n): bson.M{"$exists": false}},
+					fmt.Sprintf("field %s greater than maxitems %d", k, *f.MaxItems))
+			}
+			if f.MinItems != nil && *f.MinItems > 0 && n < 0 {
+				guard.add(bson.M{sf + "." + strconv.Itoa(*f.MinItems-n-1): bson.M{"$exists": true}},
+					fmt.Sprintf("field %s less than minitems %d", k, *f.MinItems))
+			}
+		}
+	}
+	return nil
+}
+
+// checkMinItems check the arrays with minitems omitted by the doc to be created,
+// arrays in sub objects are checked if the sub object exists
+func (fs *FieldSet) checkMinItems(obj map[string]interface{}) error {
+	for k, f := range fs.FMap {
+		if f.MinItems == nil || *f.MinItems == 0 {
+			continue
+		}
+		if _, ok := lookupPath(obj, k); ok {
+			continue
+		}
+		if pos := strings.LastIndex(k, "."); pos >= 0 {
+			parent, _ := lookupPath(obj, k[:pos])
+			switch parent.(type) {
+			case map[string]interface{}, bson.M:
+			default:
+				continue
+			}
+		}
+		return fmt.Errorf("field %s items 0 less than minitems %d", k, *f.MinItems)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package restful
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// KeysetOrder appends id to the sort as the tiebreaker of keyset pagination if absent
+func (fs *FieldSet) KeysetOrder(sort bson.D) bson.D {
+	for _, elem := range sort {
+		if elem.Name == "id" {
+			return sort
+		}
+	}
+	return append(sort, bson.DocElem{Name: "id", Value: int64(1)})
+}
+
+// BuildKeysetObj build the condition of docs after the cursor in the order of sort, for keyset pagination
+// after is the values of sort fields of the last doc, e.g.: {"mtime": 1600000000, "id": "xxx"}
+// sort should end with id as the tiebreaker, see KeysetOrder, nil returned if after is empty as the first page
+func (fs *FieldSet) BuildKeysetObj(after map[string]interface{}, sort bson.D) (map[string]interface{}, error) {
+	if len(after) == 0 {
+		return nil, nil
+	}
+	acceptTimeStrings(after)
+	sorted := make(map[string]bool, len(sort))
+	for _, elem := range sort {
+		sorted[elem.Name] = true
+	}
+	for k := range after {
+		if !sorted[k] {
+			return nil, fmt.Errorf("after field %s not in order", k)
+		}
+	}
+
+	or := make([]interface{}, 0, len(sort))
+	equals := make(map[string]interface{})
+	for _, elem := range sort {
+		k := elem.Name
+		value, ok := after[k]
+		if !ok {
+			return nil, fmt.Errorf("after field %s missing", k)
+		}
+		kind, _ := fs.IsFieldMember(k)
+		if !(kind >= KindBool && kind <= KindString || kind == KindDate || kind == KindDuration || kind == KindDecimal) {
+			return nil, fmt.Errorf("after field %s type not support", k)
+		}
+		v := fs.ParseSimpleValue(value, kind)
+		if v == nil {
+			return nil, fmt.Errorf("after field %s type mismatch", k)
+		}
+		op := "$gt"
+		if dir := CheckInt(elem.Value); dir != nil && dir.(int64) < 0 {
+			op = "$lt"
+		}
+		cond := make(map[string]interface{}, len(equals)+1)
+		for ek, ev := range equals {
+			cond[ek] = ev
+		}
+		cond[fs.storageField(k)] = bson.M{op: v}
+		or = append(or, cond)
+		equals[fs.storageField(k)] = v
+	}
+	return map[string]interface{}{"$or": or}, nil
+}
+
+// KeysetCursor get the values of sort fields of doc read from db, to continue after it by keyset pagination
+// doc is as stored, before OutReplace and redaction, so fields hidden from the result still continue the order
+// nil returned if any value missing
+func (fs *FieldSet) KeysetCursor(doc map[string]interface{}, sort bson.D) map[string]interface{} {
+	cursor := make(map[string]interface{}, len(sort))
+	for _, elem := range sort {
+		var value interface{} = doc
+		for _, seg := range strings.Split(fs.storageField(elem.Name), ".") {
+			switch m := value.(type) {
+			case map[string]interface{}:
+				value = m[seg]
+			case bson.M:
+				value = m[seg]
+			default:
+				return nil
+			}
+		}
+		if value == nil {
+			return nil
+		}
+		if d, ok := value.(bson.Decimal128); ok {
+			value = Decimal(d.String())
+		}
+		cursor[elem.Name] = value
+	}
+	return cursor
+}
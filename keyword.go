@@ -0,0 +1,176 @@
+package restful
+
+import (
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// default field of keywords derived from KeywordFields
+const defaultKeywordsField = "keywords"
+
+// checkKeywordFields checks the keyword fields when init, the keywords field is read only to clients
+func (p *Processor) checkKeywordFields(report *InitReport) {
+	if len(p.KeywordFields) == 0 {
+		return
+	}
+	if p.KeywordsField == "" {
+		p.KeywordsField = defaultKeywordsField
+	}
+	if kind, ok := p.FieldSet.IsFieldMember(p.KeywordsField); !ok || kind != KindArrayString {
+		report.Add(p.Biz, "struct must contain '%s' field of []string when keyword fields set", p.KeywordsField)
+	}
+	for _, field := range p.KeywordFields {
+		kind, ok := p.FieldSet.IsFieldMember(field)
+		if !ok {
+			report.Add(p.Biz, "keyword field %s unknown", field)
+			continue
+		}
+		if kind != KindString && kind != KindArrayString {
+			report.Add(p.Biz, "keyword field %s should be string or []string", field)
+		}
+	}
+	// only derived from keyword fields, after the read only fields set to FieldSet
+	p.ReadOnlyFields = append(p.ReadOnlyFields, p.KeywordsField)
+	p.FieldSet.SetReadOnlyFields([]string{p.KeywordsField})
+}
+
+// Keywords tokenizes the text to normalized keywords, lowercased words of letters and digits,
+// and single characters and bigrams of Han, transliterated by KeywordTransliterate if set
+func (p *Processor) Keywords(text string) []string {
+	seen := make(map[string]bool)
+	keywords := make([]string, 0)
+	add := func(token string) {
+		if token != "" && !seen[token] {
+			seen[token] = true
+			keywords = append(keywords, token)
+		}
+	}
+	addWord := func(word []rune) {
+		if len(word) == 0 {
+			return
+		}
+		if unicode.Is(unicode.Han, word[0]) {
+			for i := range word {
+				add(string(word[i]))
+				if i+1 < len(word) {
+					add(string(word[i : i+2]))
+				}
+			}
+		} else {
+			add(string(word))
+		}
+		if p.KeywordTransliterate != nil {
+			for _, token := range p.KeywordTransliterate(string(word)) {
+				add(strings.ToLower(token))
+			}
+		}
+	}
+
+	word := make([]rune, 0)
+	han := false
+	for _, r := range strings.ToLower(text) {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			addWord(word)
+			word = word[:0]
+			continue
+		}
+		// Han and others are split into words
+		if len(word) > 0 && unicode.Is(unicode.Han, r) != han {
+			addWord(word)
+			word = word[:0]
+		}
+		han = unicode.Is(unicode.Han, r)
+		word = append(word, r)
+	}
+	addWord(word)
+	return keywords
+}
+
+// docKeywords derives the keywords of the doc from KeywordFields
+func (p *Processor) docKeywords(doc map[string]interface{}) []string {
+	texts := make([]string, 0, len(p.KeywordFields))
+	for _, field := range p.KeywordFields {
+		value, _ := lookupPath(doc, field)
+		switch v := value.(type) {
+		case string:
+			texts = append(texts, v)
+		case []interface{}:
+			for _, elem := range v {
+				if s, ok := elem.(string); ok {
+					texts = append(texts, s)
+				}
+			}
+		}
+	}
+	return p.Keywords(strings.Join(texts, " "))
+}
+
+// applyKeywords sets the keywords of the doc to be created
+func (p *Processor) applyKeywords(doc map[string]interface{}) {
+	if len(p.KeywordFields) == 0 {
+		return
+	}
+	doc[p.KeywordsField] = p.docKeywords(doc)
+}
+
+// updateKeywords derives the keywords of the doc after update of PATCH and sets them by the update itself,
+// update is by names in API, the keyword fields read are required unchanged by guard,
+// so the keywords are not derived from values overwritten by concurrent writes
+func (p *Processor) updateKeywords(dbc *mgo.Collection, id interface{}, update map[string]interface{}, guard *writeGuard) *Rsp {
+	if len(p.KeywordFields) == 0 || !p.isKeywordsUpdated(update) {
+		return nil
+	}
+	selector := bson.M{}
+	for _, field := range p.KeywordFields {
+		selector[p.FieldSet.storageField(field)] = 1
+	}
+	var doc map[string]interface{}
+	err := dbc.FindId(id).Select(selector).One(&doc)
+	if err == mgo.ErrNotFound {
+		// PATCH fails by id not found
+		return nil
+	}
+	if err != nil {
+		return genRsp(http.StatusInternalServerError, "db access fail", nil)
+	}
+	p.FieldSet.apiNames(doc)
+	for _, field := range p.KeywordFields {
+		value, _ := lookupPath(doc, field)
+		guard.add(bson.M{p.FieldSet.storageField(field): copyValue(value)}, "keyword fields modified concurrently")
+	}
+	applyUpdate(doc, update)
+	set, ok := update["$set"].(map[string]interface{})
+	if !ok {
+		set = make(map[string]interface{})
+		update["$set"] = set
+	}
+	set[p.KeywordsField] = p.docKeywords(doc)
+	return nil
+}
+
+// isKeywordsUpdated check the update writes the keyword fields or not
+func (p *Processor) isKeywordsUpdated(update map[string]interface{}) bool {
+	for _, v := range update {
+		for k := range docMap(v) {
+			for _, field := range p.KeywordFields {
+				if k == field || strings.HasPrefix(k, field+".") || strings.HasPrefix(field, k+".") {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// BuildKeywordObj build the condition of docs having all keywords of the text
+func (p *Processor) BuildKeywordObj(text string, cond map[string]interface{}) {
+	keywords := p.Keywords(text)
+	if len(keywords) == 0 {
+		return
+	}
+	cond[p.KeywordsField] = bson.M{"$all": keywords}
+}
@@ -0,0 +1,82 @@
+package restful
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// value of masked fields in logs
+const maskedValue = "***"
+
+// checkMaskedFields check the fields of Processor.MaskedFields, and compiles the pattern masking them in bodies logged
+func (p *Processor) checkMaskedFields(report *InitReport) {
+	names := make([]string, 0, len(p.MaskedFields))
+	for _, field := range p.MaskedFields {
+		if _, ok := p.FieldSet.FMap[field]; !ok || field == "id" {
+			report.Add(p.Biz, "masked field %s invalid", field)
+			continue
+		}
+		names = append(names, regexp.QuoteMeta(field[strings.LastIndex(field, ".")+1:]))
+	}
+	// passwords are never logged either
+	for _, field := range p.PasswordFields {
+		names = append(names, regexp.QuoteMeta(field))
+	}
+	if len(names) == 0 {
+		p.maskRegexp = nil
+		return
+	}
+	// "field": "string" or other scalar value, in body which may not be valid json
+	p.maskRegexp = regexp.MustCompile(fmt.Sprintf(`("(?:%s)"\s*:\s*)("(?:[^"\\]|\\.)*"?|[^,}\]\s]*)`, strings.Join(names, "|")))
+}
+
+// maskBody masks the values of MaskedFields in body logged
+func (p *Processor) maskBody(body []byte) string {
+	if p.maskRegexp == nil {
+		return string(body)
+	}
+	return p.maskRegexp.ReplaceAllString(string(body), `${1}"`+maskedValue+`"`)
+}
+
+// MaskString partially masks the string, keeping a quarter of head and tail at most 4 characters, e.g.: 138****5678
+func MaskString(s string) string {
+	runes := []rune(s)
+	keep := len(runes) / 4
+	if keep > 4 {
+		keep = 4
+	}
+	if keep == 0 {
+		return maskedValue
+	}
+	return string(runes[:keep]) + strings.Repeat("*", len(runes)-2*keep) + string(runes[len(runes)-keep:])
+}
+
+// maskPath masks the value of path in doc, through objects and arrays of objects
+// strings are partially masked, others are replaced with "***"
+func maskPath(doc interface{}, path string) {
+	switch v := doc.(type) {
+	case []interface{}:
+		for _, elem := range v {
+			maskPath(elem, path)
+		}
+	case map[string]interface{}, bson.M:
+		m := docMap(v)
+		pos := strings.Index(path, ".")
+		if pos == -1 {
+			value, ok := m[path]
+			if !ok || value == nil {
+				return
+			}
+			if s, ok := value.(string); ok {
+				m[path] = MaskString(s)
+			} else {
+				m[path] = maskedValue
+			}
+			return
+		}
+		maskPath(m[path[:pos]], path[pos+1:])
+	}
+}
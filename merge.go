@@ -0,0 +1,119 @@
+package restful
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// max times to retry a merged PATCH when the doc is modified concurrently
+const mergeMaxRetry = 10
+
+var errMergeConflict = errors.New("too many concurrent modifications")
+
+// checkMergeFields checks the counter fields and set fields when init
+func (p *Processor) checkMergeFields(report *InitReport) {
+	p.counterFields = make(map[string]bool, len(p.CounterFields))
+	for _, field := range p.CounterFields {
+		kind, ok := p.FieldSet.IsFieldMember(field)
+		if !ok {
+			report.Add(p.Biz, "counter field %s unknown", field)
+			continue
+		}
+		if kind != KindInt && kind != KindUint && kind != KindFloat && kind != KindDuration {
+			report.Add(p.Biz, "counter field %s should be number", field)
+			continue
+		}
+		p.counterFields[field] = true
+	}
+	p.setFields = make(map[string]bool, len(p.SetFields))
+	for _, field := range p.SetFields {
+		kind, ok := p.FieldSet.IsFieldMember(field)
+		if !ok {
+			report.Add(p.Biz, "set field %s unknown", field)
+			continue
+		}
+		if kind < KindArrayBool || kind > KindArrayString {
+			report.Add(p.Biz, "set field %s should be array of bool, number or string", field)
+			continue
+		}
+		p.setFields[field] = true
+	}
+}
+
+// checkCounterOps checks the fields of $inc in PATCH are counter fields
+func (p *Processor) checkCounterOps(value interface{}) error {
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("$inc not object")
+	}
+	for k := range fields {
+		if !p.counterFields[k] {
+			return fmt.Errorf("$inc field %s not counter", k)
+		}
+	}
+	return nil
+}
+
+// isMergeable checks the PATCH commutes with concurrent ones, then it is merged instead of rejected by seq
+// only increments of counter fields and adds of set fields commute
+func (p *Processor) isMergeable(info map[string]interface{}, updateOps map[string]interface{}) bool {
+	if len(info) > 0 || len(updateOps) == 0 {
+		return false
+	}
+	for op, value := range updateOps {
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k := range fields {
+			switch {
+			case op == "$inc" && p.counterFields[k]:
+			case op == "$addToSet" && p.setFields[k]:
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// mergePatch applies the mergeable update on the latest seq, retries if the doc is modified concurrently
+// set is the $set of update, seq and mtime are bumped in it, returns the new seq
+// selector matches the doc by _id and conditions like excluding soft-deleted,
+// guardError returned if the doc does not meet the conditions of guard
+func (p *Processor) mergePatch(query url.Values, dbc *mgo.Collection, selector bson.M, update map[string]interface{}, set map[string]interface{}, now int64, guard *writeGuard) (string, error) {
+	for i := 0; i < mergeMaxRetry; i++ {
+		var old map[string]interface{}
+		err := dbc.Find(selector).Select(bson.M{"seq": 1}).One(&old)
+		if err != nil {
+			return "", err
+		}
+		seq := GetString(old["seq"])
+		next, err := nextSeq(seq)
+		if err != nil {
+			return "", fmt.Errorf("seq %s invalid", seq)
+		}
+		set["seq"] = next
+		set["mtime"] = now
+		sel := bson.M{"seq": seq}
+		for k, v := range selector {
+			sel[k] = v
+		}
+		err = p.applyWrite(query, dbc, guard.selector(sel), update, false)
+		if err == mgo.ErrNotFound {
+			if reason := guard.failure(dbc, selector["_id"]); reason != "" {
+				return "", guardError(reason)
+			}
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return next, nil
+	}
+	return "", errMergeConflict
+}
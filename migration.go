@@ -0,0 +1,104 @@
+package restful
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// field of the schema version docs stored by, docs without it are version 0
+const schemaVersionField = "schema_version"
+
+// Migration upgrades a doc stored by the schema version to the next one in place, e.g. renames or splits fields
+// the doc is as stored, with '_id' field, and may be partial if fields are selected by GET
+type Migration func(doc map[string]interface{}) error
+
+// SetMigrations set the current schema version and the migrations upgrading docs of older versions,
+// docs are upgraded on read by OutReplace, key: version migrated from
+func (fs *FieldSet) SetMigrations(version int, migrations map[int]Migration) {
+	fs.schemaVersion = version
+	fs.migrations = migrations
+}
+
+// Migrate upgrades the doc stored to the current schema version by migrations in order,
+// return true if upgraded, versions without migration need no change of docs
+func (fs *FieldSet) Migrate(doc map[string]interface{}) (bool, error) {
+	from := 0
+	if n := CheckInt(doc[schemaVersionField]); n != nil {
+		from = int(n.(int64))
+	}
+	if from >= fs.schemaVersion {
+		return false, nil
+	}
+	for v := from; v < fs.schemaVersion; v++ {
+		fn, ok := fs.migrations[v]
+		if !ok {
+			continue
+		}
+		if err := fn(doc); err != nil {
+			return false, fmt.Errorf("migrate schema version %d fail, %v", v, err)
+		}
+	}
+	doc[schemaVersionField] = fs.schemaVersion
+	return true, nil
+}
+
+// checkMigrations check Processor.SchemaVersion and Processor.Migrations and sets them to FieldSet
+func (p *Processor) checkMigrations(report *InitReport) {
+	if p.SchemaVersion == 0 && len(p.Migrations) == 0 {
+		return
+	}
+	if f, ok := p.FieldSet.FMap[schemaVersionField]; !ok || f.Kind != KindInt {
+		report.Add(p.Biz, "struct must contain int '%s' field when schema version", schemaVersionField)
+	}
+	if p.SchemaVersion < 0 {
+		report.Add(p.Biz, "schema version %d invalid", p.SchemaVersion)
+	}
+	for v, fn := range p.Migrations {
+		if v < 0 || v >= p.SchemaVersion {
+			report.Add(p.Biz, "migration from version %d invalid, should be in [0, %d)", v, p.SchemaVersion)
+		}
+		if fn == nil {
+			report.Add(p.Biz, "migration from version %d nil", v)
+		}
+	}
+	p.FieldSet.SetMigrations(p.SchemaVersion, p.Migrations)
+	// only set by writes of the package
+	p.FieldSet.SetReadOnlyFields([]string{schemaVersionField})
+}
+
+// applySchemaVersion marks the doc written by the current schema version
+func (p *Processor) applySchemaVersion(info map[string]interface{}) {
+	if p.SchemaVersion > 0 {
+		info[schemaVersionField] = p.SchemaVersion
+	}
+}
+
+// upgradeStored upgrades the doc stored to the current schema version before it is updated by operators,
+// the doc is replaced only if not changed since read, and keeps its seq and mtime
+func (p *Processor) upgradeStored(dbc *mgo.Collection, id interface{}) *Rsp {
+	if p.SchemaVersion <= 0 {
+		return nil
+	}
+	var doc map[string]interface{}
+	err := dbc.Find(bson.M{"_id": id, schemaVersionField: bson.M{"$not": bson.M{"$gte": p.SchemaVersion}}}).One(&doc)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return genRsp(http.StatusInternalServerError, "db access fail", nil)
+	}
+	seq := doc["seq"]
+	if _, err = p.FieldSet.Migrate(doc); err != nil {
+		return genRsp(http.StatusInternalServerError, err.Error(), nil)
+	}
+	sorted := p.FieldSet.InSort(&doc)
+	err = dbc.Update(bson.M{"_id": id, "seq": seq}, &sorted)
+	if err != nil && err != mgo.ErrNotFound {
+		return genRsp(http.StatusInternalServerError, "db access fail", nil)
+	}
+	// changed since read, the writer upgraded it
+	return nil
+}
@@ -0,0 +1,233 @@
+package restful
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// max times to retry when the doc is modified concurrently
+const modifyMaxRetry = 3
+
+// ReqModify is the body of POST /path/{id}/__modify
+type ReqModify struct {
+	Filter map[string]interface{} `json:"filter"` // extra condition the doc must match, e.g.: {"status": "pending"}
+	Set    map[string]interface{} `json:"$set"`
+	Inc    map[string]interface{} `json:"$inc"`
+	Return string                 `json:"return"` // return the doc before or after modified, old or new, default: new
+}
+
+func (p *Processor) defaultModify() Handler {
+	return func(vars map[string]string, query url.Values, body []byte) *Rsp {
+		var err error
+		id := vars["id"]
+
+		begin := time.Now()
+		reqID := query.Get("reqid")
+		if reqID == "" {
+			reqID = "sys_" + RandString(8)
+		}
+		Log.Debugf("[req] %v POST %v/%v/__modify query=%v", reqID, p.URLPath, id, query)
+
+		var req ReqModify
+		err = json.Unmarshal(body, &req)
+		if err != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__modify unmarshal fail %v [%v]", reqID, p.URLPath, id, err, p.maskBody(body))
+			return genRsp(http.StatusBadRequest, "invalid Body", nil)
+		}
+		if req.Return == "" {
+			req.Return = "new"
+		}
+		if req.Return != "new" && req.Return != "old" {
+			Log.Warnf("[rsp] %v POST %v/%v/__modify return %v invalid", reqID, p.URLPath, id, req.Return)
+			return genRsp(http.StatusBadRequest, "return invalid", nil)
+		}
+		if len(req.Set) == 0 && len(req.Inc) == 0 {
+			Log.Warnf("[rsp] %v POST %v/%v/__modify need $set or $inc", reqID, p.URLPath, id)
+			return genRsp(http.StatusBadRequest, "need $set or $inc", nil)
+		}
+
+		// build condition and update
+		condition, err := p.buildModifyCondition(req.Filter)
+		if err != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__modify filter param invalid, %v", reqID, p.URLPath, id, err)
+			return genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+		info := req.Set
+		if info == nil {
+			info = make(map[string]interface{})
+		}
+		err = p.ApplyProfile(query, info, false)
+		if err != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__modify profile check fail, err=%v", reqID, p.URLPath, id, err)
+			return genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+		err = p.ValidateUpdate(info)
+		if err != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__modify invalid field exists, biz=%v err=%v", reqID, p.URLPath, id, p.Biz, err)
+			return genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+		err = p.hashPasswords(info)
+		if err != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__modify %v", reqID, p.URLPath, id, err)
+			return genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+		update := map[string]interface{}{"$set": info}
+		if len(req.Inc) > 0 {
+			err = p.FieldSet.BuildIncObj(req.Inc, update)
+			if err != nil {
+				Log.Warnf("[rsp] %v POST %v/%v/__modify update operator invalid, biz=%v err=%v", reqID, p.URLPath, id, p.Biz, err)
+				return genRsp(http.StatusBadRequest, err.Error(), nil)
+			}
+		}
+		if err = p.checkUpdateRoles(query, update); err != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__modify %v", reqID, p.URLPath, id, err)
+			return genRsp(http.StatusForbidden, err.Error(), nil)
+		}
+		if err = p.checkPasswordOps(update); err != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__modify %v", reqID, p.URLPath, id, err)
+			return genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+
+		dbs := gCfg.MgoSess.Clone()
+		defer dbs.Close()
+		dbc := dbs.DB(p.GetDbName(query)).C(p.GetTableName(query))
+
+		// conditions checked atomically with the update
+		guard := &writeGuard{}
+		if errRsp := p.checkImmutable(dbc, id, info, update, false, guard); errRsp != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__modify %v", reqID, p.URLPath, id, errRsp.Msg)
+			return errRsp
+		}
+		if errRsp := p.upgradeStored(dbc, id); errRsp != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__modify %v", reqID, p.URLPath, id, errRsp.Msg)
+			return errRsp
+		}
+		if errRsp := p.checkDocumentUpdate(dbc, id, info, update, guard); errRsp != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__modify invalid doc, err=%v", reqID, p.URLPath, id, errRsp.Msg)
+			return errRsp
+		}
+		if errRsp := p.updateKeywords(dbc, id, update, guard); errRsp != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__modify %v", reqID, p.URLPath, id, errRsp.Msg)
+			return errRsp
+		}
+		p.FieldSet.guardInc(update, guard)
+		p.FieldSet.StoreUpdate(update)
+
+		// seq is a string, so the doc is modified on the seq read to bump it atomically
+		var doc map[string]interface{}
+		conflict := false
+		for i := 0; i < modifyMaxRetry; i++ {
+			conflict = false
+			var old map[string]interface{}
+			err = dbc.FindId(id).Select(bson.M{"seq": 1}).One(&old)
+			if err != nil {
+				break
+			}
+			seq := GetString(old["seq"])
+			next, err2 := nextSeq(seq)
+			if err2 != nil {
+				next = genSeq(0)
+			}
+			info["seq"] = next
+			info["mtime"] = time.Now().Unix()
+
+			selector := p.liveSelector(modifySelector(id, old["seq"], condition))
+			doc = nil
+			_, err = dbc.Find(guard.selector(selector)).Apply(mgo.Change{
+				Update:    update,
+				ReturnNew: req.Return == "new" && !p.KeepRevisions,
+			}, &doc)
+			if err == nil && p.KeepRevisions {
+				// the doc replaced is returned to be kept as a revision
+				p.saveRevision(query, doc)
+				if req.Return == "new" {
+					doc = p.modified(dbc, doc, update, next)
+				}
+			}
+			if err != mgo.ErrNotFound {
+				break
+			}
+			// condition not matched, or seq modified concurrently
+			n, err2 := dbc.Find(bson.M{"_id": id, "seq": old["seq"]}).Count()
+			if err2 != nil || n > 0 {
+				break
+			}
+			conflict = true
+		}
+		if err != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__modify modify id=%s error, %v", reqID, p.URLPath, id, id, err)
+			if err == mgo.ErrNotFound {
+				if reason := guard.failure(dbc, id); reason != "" {
+					return genRsp(http.StatusConflict, reason, nil)
+				}
+				if conflict {
+					return genRsp(http.StatusConflict, errMergeConflict.Error(), nil)
+				}
+				return genRsp(http.StatusNotFound, "id not found or condition not matched", nil)
+			}
+			if field := p.duplicateField(err); field != "" {
+				return genRsp(http.StatusConflict, "duplicate "+field, nil)
+			}
+			return genRsp(http.StatusInternalServerError, "db access fail", nil)
+		}
+		if err = p.FieldSet.OutReplace(&doc); err != nil {
+			// modified already, the doc returned can not be migrated
+			Log.Warnf("[rsp] %v POST %v/%v/__modify %v", reqID, p.URLPath, id, err)
+			return genRsp(http.StatusInternalServerError, "migrate fail", nil)
+		}
+		p.redactFields(query, []interface{}{doc})
+
+		// names in API for hooks
+		p.FieldSet.apiNames(info)
+		p.writeDone("PATCH", vars, query, info)
+
+		costMs := time.Since(begin).Nanoseconds() / int64(time.Millisecond)
+		Log.Warnf("[rsp] %v success, cost %vms", reqID, costMs)
+		return genRsp(http.StatusOK, "modify ok", doc)
+	}
+}
+
+// modified get the doc after modified, by the doc replaced and the update,
+// read by the seq modified to, or applied the update in memory if modified again meanwhile
+func (p *Processor) modified(dbc *mgo.Collection, old map[string]interface{}, update map[string]interface{}, seq string) map[string]interface{} {
+	var doc map[string]interface{}
+	if err := dbc.Find(bson.M{"_id": old["_id"], "seq": seq}).One(&doc); err == nil {
+		return doc
+	}
+	doc = docMap(copyValue(old))
+	applyUpdate(doc, update)
+	return doc
+}
+
+// buildModifyCondition build the condition of filter the doc must match, by names stored,
+// id, seq and dtime are set by the modify itself and can not be filtered
+func (p *Processor) buildModifyCondition(filter map[string]interface{}) (map[string]interface{}, error) {
+	condition := make(map[string]interface{})
+	if len(filter) == 0 {
+		return condition, nil
+	}
+	for _, field := range []string{"id", "_id", "seq", "dtime"} {
+		if _, ok := filter[field]; ok {
+			return nil, fmt.Errorf("filter field %s not allowed", field)
+		}
+	}
+	if err := p.FieldSet.BuildFilterObj(filter, condition); err != nil {
+		return nil, err
+	}
+	p.FieldSet.InReplace(&condition)
+	return condition, nil
+}
+
+// modifySelector get the selector of the doc of id on seq read, the condition is combined by $and,
+// so it never replaces the id or the seq compared
+func modifySelector(id, seq interface{}, condition map[string]interface{}) bson.M {
+	selector := bson.M{"_id": id, "seq": seq}
+	mergeCondition(selector, condition)
+	return selector
+}
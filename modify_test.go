@@ -0,0 +1,43 @@
+package restful
+
+import (
+	"testing"
+)
+
+type modifyDoc struct {
+	ID     *string `json:"id,omitempty" bson:"_id,omitempty"`
+	Status *string `json:"status,omitempty" bson:"status,omitempty"`
+	Btime  *int64  `json:"btime,omitempty" bson:"btime,omitempty"`
+	Mtime  *int64  `json:"mtime,omitempty" bson:"mtime,omitempty"`
+	Seq    *string `json:"seq,omitempty" bson:"seq,omitempty"`
+}
+
+func TestModifyFilterCannotMoveWrite(t *testing.T) {
+	p := &Processor{Biz: "modify", DataStruct: new(modifyDoc)}
+	if err := p.Init(); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	for _, field := range []string{"id", "seq", "dtime"} {
+		if _, err := p.buildModifyCondition(map[string]interface{}{field: "B"}); err == nil {
+			t.Errorf("filter on %s accepted", field)
+		}
+	}
+
+	condition, err := p.buildModifyCondition(map[string]interface{}{"status": "pending"})
+	if err != nil {
+		t.Fatalf("filter on status: %v", err)
+	}
+	// even a condition on _id is combined, never replacing the doc or the seq of the write
+	condition["_id"] = "B"
+	condition["seq"] = "other"
+	selector := modifySelector("A", "s1", condition)
+	if selector["_id"] != "A" || selector["seq"] != "s1" {
+		t.Fatalf("selector moved to %v seq %v", selector["_id"], selector["seq"])
+	}
+	if selector["status"] != "pending" {
+		t.Errorf("filter on status lost: %v", selector)
+	}
+	if and, _ := selector["$and"].([]interface{}); len(and) != 2 {
+		t.Errorf("conditions on _id and seq not combined by $and: %v", selector)
+	}
+}
@@ -1,32 +1,127 @@
 package restful
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/mux"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
 )
 
 // Rsp is a general returning structure for all request
 type Rsp struct {
-	Code int         `json:"code"`
-	Msg  string      `json:"msg"`
-	Data interface{} `json:"data,omitempty"`
+	Code     int         `json:"code"`
+	Msg      string      `json:"msg"`
+	Data     interface{} `json:"data,omitempty"`
+	Warnings []string    `json:"warnings,omitempty"` // e.g. deprecated fields written
+	Header   http.Header `json:"-"`                  // extra http headers to write
+}
+
+// SetHeader set an extra http header of the response
+func (rsp *Rsp) SetHeader(key, value string) {
+	if rsp.Header == nil {
+		rsp.Header = make(http.Header)
+	}
+	rsp.Header.Set(key, value)
 }
 
 // RspGetPageData is a general returning structure in `data` field for GetPage request
 type RspGetPageData struct {
-	Total int64         `json:"total"`
-	Hits  []interface{} `json:"hits"`
+	Total   int64                  `json:"total"`
+	Hits    []interface{}          `json:"hits"`
+	Summary map[string]interface{} `json:"summary,omitempty"` // aggregate values over all docs matched
+	Next    map[string]interface{} `json:"next,omitempty"`    // cursor of next page by keyset pagination, as URL Query 'after'
+
+	// pagination state if Processor.PageMetadata, pages is absent if total count skipped
+	Page    int    `json:"page,omitempty"`
+	Size    int    `json:"size,omitempty"`
+	Pages   *int64 `json:"pages,omitempty"`
+	HasNext *bool  `json:"has_next,omitempty"`
+}
+
+// setPagination sets the pagination state of the page
+func (data *RspGetPageData) setPagination(page, size int, keyset bool) {
+	data.Page = page
+	data.Size = size
+	hasNext := false
+	switch {
+	case keyset:
+		hasNext = data.Next != nil
+	case data.Total >= 0 && size > 0:
+		hasNext = int64(page*size) < data.Total
+	case size > 0:
+		hasNext = len(data.Hits) == size
+	}
+	data.HasNext = &hasNext
+	if data.Total >= 0 {
+		pages := int64(1)
+		if size > 0 {
+			pages = (data.Total + int64(size) - 1) / int64(size)
+		}
+		data.Pages = &pages
+	}
 }
 
+// RspTooLargeData is the returning structure in `data` field when response exceeds GlobalConfig.MaxResponseBytes
+type RspTooLargeData struct {
+	Size  int `json:"size"`  // measured bytes of the response
+	Limit int `json:"limit"` // max bytes allowed
+}
+
+// OutputTransformer is a hook to alter the response just before written
+// rsp.Code is the http status code, return the envelope to marshal as body, or nil to marshal rsp
+type OutputTransformer func(rsp *Rsp, r *http.Request) interface{}
+
 // Handler is a template function for Restful Handler
 type Handler func(vars map[string]string, query url.Values, body []byte) *Rsp
 
+// StreamHandler is a template function for Restful Handler reading or writing body by itself, e.g. export, import
+// return a rsp to write, or nil after body written
+type StreamHandler func(vars map[string]string, query url.Values, r *http.Request, w http.ResponseWriter) *Rsp
+
+// RegisterStream is a function to register stream handler to http mux
+// the route is returned for more matchers, e.g. headers
+func RegisterStream(method, pattern string, h StreamHandler) *mux.Route {
+	return gCfg.Mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		query, err := url.ParseQuery(r.URL.RawQuery)
+		if err != nil {
+			rsp := genRsp(http.StatusBadRequest, fmt.Sprintf("query parser failed: %v", err), nil)
+			writeRsp(w, r, rsp, false)
+			return
+		}
+		if profile := r.Header.Get("X-Profile"); profile != "" && query.Get("profile") == "" {
+			query.Set("profile", profile)
+		}
+		if gCfg.GetCaller != nil {
+			query.Set("caller", gCfg.GetCaller(r))
+		}
+		setRoles(r, query)
+		if gCfg.DegradeReadOnly && method != "GET" && isReadOnly() {
+			writeRsp(w, r, readOnlyRsp(), false)
+			return
+		}
+		begin := time.Now()
+		status := http.StatusOK
+		if rsp := h(vars, query, r, w); rsp != nil {
+			status = writeRsp(w, r, rsp, strings.ToLower(query.Get("pretty")) == "true")
+		}
+		captureRequest(r, nil, status, begin)
+	}).Methods(method)
+}
+
 // Register is a function to register handler to http mux
 func Register(method, pattern string, h Handler) {
 	handler := genHandler(h)
@@ -36,32 +131,114 @@ func Register(method, pattern string, h Handler) {
 func genHandler(h Handler) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var rsp *Rsp
+		var body []byte
+		status := 0
+		begin := time.Now()
+		defer func() {
+			captureRequest(r, body, status, begin)
+		}()
 		vars := mux.Vars(r)
 		query, err := url.ParseQuery(r.URL.RawQuery)
 		if err != nil {
 			rsp = genRsp(http.StatusBadRequest, fmt.Sprintf("query parser failed: %v", err), nil)
-			writeRsp(w, rsp, false)
+			status = writeRsp(w, r, rsp, false)
 			return
 		}
+		if gCfg.GetCaller != nil {
+			query.Set("caller", gCfg.GetCaller(r))
+		}
+		setRoles(r, query)
+		// X-Profile: cn
+		if profile := r.Header.Get("X-Profile"); profile != "" && query.Get("profile") == "" {
+			query.Set("profile", profile)
+		}
+		// Prefer: return=representation
+		if query.Get("return") == "" {
+			for _, prefer := range strings.Split(r.Header.Get("Prefer"), ",") {
+				if strings.TrimSpace(prefer) == "return=representation" {
+					query.Set("return", "representation")
+				}
+			}
+		}
+		// If-Match: "seq", only the header is honored
+		query.Del("if_match")
+		if seqs := parseIfMatch(r.Header.Get("If-Match")); len(seqs) > 0 {
+			query["if_match"] = seqs
+		}
 		pretty := false
 		if strings.ToLower(query.Get("pretty")) == "true" {
 			pretty = true
 		}
 
 		if r.Method == "POST" || r.Method == "PUT" || r.Method == "PATCH" {
-			body, err := ioutil.ReadAll(r.Body)
+			body, err = ioutil.ReadAll(r.Body)
 			if err != nil {
 				rsp = genRsp(http.StatusInternalServerError, fmt.Sprintf("read body error: %v", err), nil)
-				writeRsp(w, rsp, pretty)
+				status = writeRsp(w, r, rsp, pretty)
 				return
 			}
 			defer r.Body.Close()
+			var code int
+			body, code, err = decodeBody(r.Header.Get("Content-Type"), body)
+			if err != nil {
+				rsp = genRsp(code, err.Error(), nil)
+				status = writeRsp(w, r, rsp, pretty)
+				return
+			}
 			rsp = h(vars, query, body)
 		} else {
 			rsp = h(vars, query, nil)
 		}
-		writeRsp(w, rsp, pretty)
+		status = writeRsp(w, r, rsp, pretty)
+	}
+}
+
+// decodeBody checks the content type of body, converts it to utf-8 and strips the BOM
+func decodeBody(contentType string, body []byte) ([]byte, int, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if gCfg.StrictContentType {
+		if err != nil {
+			return nil, http.StatusUnsupportedMediaType, fmt.Errorf("content type invalid")
+		}
+		supported := false
+		for _, t := range gCfg.ContentTypes {
+			if strings.EqualFold(t, mediaType) {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return nil, http.StatusUnsupportedMediaType, fmt.Errorf("content type %s not supported", mediaType)
+		}
+	}
+
+	charset := strings.ToLower(params["charset"])
+	if charset != "" && charset != "utf-8" && charset != "utf8" {
+		var enc encoding.Encoding
+		if gCfg.ConvertCharset {
+			enc, _ = htmlindex.Get(charset)
+		}
+		if enc != nil {
+			buf, _, err := transform.Bytes(unicode.BOMOverride(enc.NewDecoder()), body)
+			if err != nil {
+				return nil, http.StatusBadRequest, fmt.Errorf("body charset %s convert fail", charset)
+			}
+			body = buf
+		} else if gCfg.StrictContentType {
+			return nil, http.StatusUnsupportedMediaType, fmt.Errorf("charset %s not supported", charset)
+		}
 	}
+
+	body = bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))
+	if gCfg.StrictContentType && !utf8.Valid(body) {
+		return nil, http.StatusBadRequest, fmt.Errorf("body not valid utf-8")
+	}
+	return body, http.StatusOK, nil
+}
+
+// isReturnRepresentation check the write request wants the full stored doc returned or not
+func isReturnRepresentation(query url.Values) bool {
+	return query.Get("return") == "representation"
 }
 
 func genRsp(code int, msg string, data interface{}) *Rsp {
@@ -72,20 +249,73 @@ func genRsp(code int, msg string, data interface{}) *Rsp {
 	}
 }
 
-func writeRsp(w http.ResponseWriter, rsp *Rsp, pretty bool) {
-	statusCode := rsp.Code
-	if statusCode >= 100 && statusCode < 400 {
-		rsp.Code = 0
-	}
-	var pBuf *[]byte
+func marshalRsp(output interface{}, pretty bool) *[]byte {
+	var buf []byte
 	if pretty {
-		buf, _ := json.MarshalIndent(rsp, "", "    ")
-		pBuf = &buf
+		buf, _ = json.MarshalIndent(output, "", "    ")
 	} else {
-		buf, _ := json.Marshal(rsp)
-		pBuf = &buf
+		buf, _ = json.Marshal(output)
+	}
+	return &buf
+}
+
+// writeRsp writes the rsp, returns the http status code written
+func writeRsp(w http.ResponseWriter, r *http.Request, rsp *Rsp, pretty bool) int {
+	statusCode, pBuf := renderRsp(r, rsp, pretty)
+	if gCfg.MaxResponseBytes > 0 && len(*pBuf) > gCfg.MaxResponseBytes && statusCode < 400 {
+		Log.Warnf("[rsp] %s %s response too large, size: %d, limit: %d", r.Method, r.URL.Path, len(*pBuf), gCfg.MaxResponseBytes)
+		tooLarge := genRsp(http.StatusRequestEntityTooLarge, "response too large, use select to pick fields, slice to limit arrays or smaller size to limit page", RspTooLargeData{
+			Size:  len(*pBuf),
+			Limit: gCfg.MaxResponseBytes,
+		})
+		statusCode, pBuf = renderRsp(r, tooLarge, pretty)
+	} else {
+		for k, v := range rsp.Header {
+			w.Header()[k] = v
+		}
 	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	// body is discarded by net/http for HEAD request, Content-Length kept
+	w.Header().Set("Content-Length", strconv.Itoa(len(*pBuf)))
 	w.WriteHeader(statusCode)
 	w.Write(*pBuf)
+	return statusCode
+}
+
+// renderRsp get the http status code and the body of rsp, by the output transformer if set,
+// the transformer sees the status code of rsp before the code of success is cleared for the body
+func renderRsp(r *http.Request, rsp *Rsp, pretty bool) (int, *[]byte) {
+	// output transformer can change rsp.Code to change http status code
+	var output interface{}
+	if gCfg.OutputTransformer != nil {
+		output = gCfg.OutputTransformer(rsp, r)
+	}
+	statusCode := rsp.Code
+	if statusCode >= 100 && statusCode < 400 {
+		rsp.Code = 0
+	}
+	if output == nil {
+		output = rsp
+	}
+	return statusCode, marshalRsp(output, pretty)
+}
+
+// parseIfMatch get the seqs of If-Match header, e.g.: "3", "4", nil if absent or *
+// weak tags like W/"3" are kept as is, so never match seqs by strong comparison
+func parseIfMatch(header string) []string {
+	seqs := make([]string, 0)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if tag == "*" {
+			return nil
+		}
+		if !strings.HasPrefix(tag, "W/") {
+			tag = strings.Trim(tag, "\"")
+		}
+		seqs = append(seqs, tag)
+	}
+	return seqs
 }
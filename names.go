@@ -0,0 +1,165 @@
+package restful
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Storage names of fields declared by `restful` tag of DataStruct, e.g. legacy column names kept out of API:
+//   UserName string `json:"user_name" restful:"store=uname"`
+// only top level fields can be stored by other names, translated like id and _id:
+// by InReplace for docs written, conditions and selectors, and by OutReplace for docs read
+
+// internal fields always stored by their names
+var internalFields = []string{"id", "btime", "mtime", "seq", "dtime", schemaVersionField}
+
+// setStore set the storage name of the top level field at path
+func (fs *FieldSet) setStore(path, name string) error {
+	if strings.Contains(path, ".") {
+		return fmt.Errorf("store only for top level field")
+	}
+	for _, field := range internalFields {
+		if path == field {
+			return fmt.Errorf("store not for internal field")
+		}
+	}
+	if name == "" || name == "_id" || strings.Contains(name, ".") || strings.HasPrefix(name, "$") {
+		return fmt.Errorf("store %s invalid", name)
+	}
+	if fs.stores == nil {
+		fs.stores = make(map[string]string)
+		fs.names = make(map[string]string)
+	}
+	fs.stores[path] = name
+	fs.names[name] = path
+	return nil
+}
+
+// checkStores check the storage names not colliding with names of other fields or each other
+func (fs *FieldSet) checkStores() []string {
+	errs := make([]string, 0)
+	for path, name := range fs.stores {
+		if _, ok := fs.FMap[name]; ok {
+			errs = append(errs, fmt.Sprintf("field %s tag store %s collides with field", path, name))
+		}
+		if fs.names[name] != path {
+			errs = append(errs, fmt.Sprintf("field %s tag store %s collides with field %s", path, name, fs.names[name]))
+		}
+	}
+	return errs
+}
+
+// storageField get the field name stored in db
+func (fs *FieldSet) storageField(field string) string {
+	if field == "id" {
+		return "_id"
+	}
+	if len(fs.stores) == 0 {
+		return field
+	}
+	top, rest := field, ""
+	if pos := strings.Index(field, "."); pos >= 0 {
+		top, rest = field[:pos], field[pos:]
+	}
+	if name, ok := fs.stores[top]; ok {
+		return name + rest
+	}
+	return field
+}
+
+// apiField get the field name in API of the name stored in db
+func (fs *FieldSet) apiField(field string) string {
+	if field == "_id" {
+		return "id"
+	}
+	if len(fs.names) == 0 {
+		return field
+	}
+	top, rest := field, ""
+	if pos := strings.Index(field, "."); pos >= 0 {
+		top, rest = field[:pos], field[pos:]
+	}
+	if name, ok := fs.names[top]; ok {
+		return name + rest
+	}
+	return field
+}
+
+// renameKeys renames the keys of m in place by rename, keys like a.b are renamed by their top level fields
+func renameKeys(m map[string]interface{}, rename func(string) string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	for _, k := range keys {
+		if name := rename(k); name != k {
+			m[name] = m[k]
+			delete(m, k)
+		}
+	}
+}
+
+// storeNames renames the fields of doc or condition to the names stored, id is kept
+func (fs *FieldSet) storeNames(m map[string]interface{}) {
+	if len(fs.stores) == 0 {
+		return
+	}
+	renameKeys(m, func(k string) string {
+		if k == "id" {
+			return k
+		}
+		return fs.storageField(k)
+	})
+}
+
+// apiNames renames the fields of doc read from db to the names in API, _id is kept
+func (fs *FieldSet) apiNames(m map[string]interface{}) {
+	if len(fs.names) == 0 {
+		return
+	}
+	renameKeys(m, func(k string) string {
+		if k == "_id" {
+			return k
+		}
+		return fs.apiField(k)
+	})
+}
+
+// StoreUpdate renames the fields of all operators of update built by PATCH to the names stored, in place
+func (fs *FieldSet) StoreUpdate(update map[string]interface{}) {
+	for _, v := range update {
+		if m := docMap(v); m != nil {
+			fs.storeNames(m)
+		}
+	}
+}
+
+// storageSort get the sort by the names stored, for sort of pipeline
+func (fs *FieldSet) storageSort(sort bson.D) bson.D {
+	order := make(bson.D, 0, len(sort))
+	for _, elem := range sort {
+		elem.Name = fs.storageField(elem.Name)
+		order = append(order, elem)
+	}
+	return order
+}
+
+// storageIndexKey get the index key by the names stored, e.g.: ["-user_name"] to ["-uname"]
+func (fs *FieldSet) storageIndexKey(key []string) []string {
+	if len(fs.stores) == 0 {
+		return key
+	}
+	r := make([]string, 0, len(key))
+	for _, k := range key {
+		prefix := ""
+		if i := strings.Index(k, ":"); strings.HasPrefix(k, "$") && i > 0 {
+			prefix, k = k[:i+1], k[i+1:]
+		} else if strings.HasPrefix(k, "-") || strings.HasPrefix(k, "+") {
+			prefix, k = k[:1], k[1:]
+		}
+		r = append(r, prefix+fs.storageField(k))
+	}
+	return r
+}
@@ -0,0 +1,278 @@
+package restful
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// algorithms of Processor.PasswordHash
+const (
+	PasswordBcrypt   = "bcrypt"
+	PasswordArgon2id = "argon2id"
+)
+
+// parameters of argon2id, as recommended by RFC 9106 second choice
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+// checkPasswordFields check the fields of Processor.PasswordFields and the algorithm when init
+func (p *Processor) checkPasswordFields(report *InitReport) {
+	for _, field := range p.PasswordFields {
+		if strings.Contains(field, ".") {
+			report.Add(p.Biz, "password field %s not top level", field)
+			continue
+		}
+		f, ok := p.FieldSet.FMap[field]
+		if !ok || field == "id" {
+			report.Add(p.Biz, "password field %s invalid", field)
+			continue
+		}
+		if f.Kind != KindString {
+			report.Add(p.Biz, "password field %s not string", field)
+		}
+	}
+	if p.PasswordMaxFailures <= 0 {
+		p.PasswordMaxFailures = 5
+	}
+	if p.PasswordLockout <= 0 {
+		p.PasswordLockout = 15 * time.Minute
+	}
+	p.pwFailures = &failureCounter{m: make(map[string]*failure)}
+	switch p.PasswordHash {
+	case "":
+		p.PasswordHash = PasswordBcrypt
+	case PasswordBcrypt, PasswordArgon2id:
+	default:
+		report.Add(p.Biz, "password hash %s unknown", p.PasswordHash)
+	}
+}
+
+// isPasswordField check the field is one of Processor.PasswordFields or not
+func (p *Processor) isPasswordField(field string) bool {
+	for _, f := range p.PasswordFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// HashPassword hashes the password by the algorithm of Processor.PasswordHash, bcrypt by default
+// the hash is encoded with its algorithm and parameters, e.g.: $2a$10$... or $argon2id$v=19$m=65536,t=3,p=4$salt$key
+func (p *Processor) HashPassword(password string) (string, error) {
+	if p.PasswordHash != PasswordArgon2id {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	}
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// VerifyPassword check the password matches the hash or not
+// the algorithm is taken from the hash, so hashes stored before changing Processor.PasswordHash still verify
+func VerifyPassword(hash, password string) bool {
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false
+	}
+	var version int
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+	other := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+// hashPasswords replaces the passwords written in info with their hashes, after info validated
+// info is the body of POST or PUT, or $set of PATCH
+func (p *Processor) hashPasswords(info map[string]interface{}) error {
+	for _, field := range p.PasswordFields {
+		value, ok := info[field]
+		if !ok || value == nil {
+			continue
+		}
+		password, ok := value.(string)
+		if !ok || password == "" {
+			return fmt.Errorf("password field %s empty", field)
+		}
+		hash, err := p.HashPassword(password)
+		if err != nil {
+			return fmt.Errorf("password field %s hash fail, %v", field, err)
+		}
+		info[field] = hash
+	}
+	return nil
+}
+
+// checkPasswordOps check password fields are only written by $set of PATCH, as their values are hashes
+func (p *Processor) checkPasswordOps(update map[string]interface{}) error {
+	for op, v := range update {
+		if op == "$set" {
+			continue
+		}
+		for k := range docMap(v) {
+			for _, field := range p.PasswordFields {
+				if k == field || strings.HasPrefix(k, field+".") {
+					return fmt.Errorf("password field %s can not be written by %s", field, op)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// keepPasswords keeps the hashes stored of password fields absent in info replacing the doc,
+// as reads never return them and clients can not send them back by PUT
+func (p *Processor) keepPasswords(info map[string]interface{}, old map[string]interface{}) {
+	for _, field := range p.PasswordFields {
+		if _, ok := info[field]; ok {
+			continue
+		}
+		if v, ok := old[field]; ok && v != nil {
+			info[field] = v
+		}
+	}
+}
+
+// passwordSelector get the selector of fields read from the doc stored before replacing it
+func (p *Processor) passwordSelector(selector bson.M) bson.M {
+	for _, field := range p.PasswordFields {
+		selector[p.FieldSet.storageField(field)] = 1
+	}
+	return selector
+}
+
+// verifyPassword handles the trigger verify_password, checks the password candidate against the hash stored
+// e.g.: {"type": "verify_password", "id": "xxx", "field": "password", "password": "candidate"}
+// field can be omitted if only one password field
+func (p *Processor) verifyPassword(query url.Values, info map[string]interface{}) *Rsp {
+	id := GetString(info["id"])
+	if id == "" {
+		return genRsp(http.StatusBadRequest, "need id", nil)
+	}
+	field := GetString(info["field"])
+	if field == "" && len(p.PasswordFields) == 1 {
+		field = p.PasswordFields[0]
+	}
+	if !p.isPasswordField(field) {
+		return genRsp(http.StatusBadRequest, fmt.Sprintf("password field %s invalid", field), nil)
+	}
+	password, ok := info["password"].(string)
+	if !ok || password == "" {
+		return genRsp(http.StatusBadRequest, "need password", nil)
+	}
+
+	// guessing is locked out by doc, whoever guesses
+	key := p.GetDbName(query) + "/" + p.GetTableName(query) + "/" + id + "/" + field
+	if p.pwFailures.locked(key, p.PasswordMaxFailures) {
+		return genRsp(http.StatusTooManyRequests, "too many failures, try later", nil)
+	}
+
+	// read from secondaries too when degraded
+	dbs := readSession()
+	defer dbs.Close()
+	dbc := dbs.DB(p.GetDbName(query)).C(p.GetTableName(query))
+
+	var doc map[string]interface{}
+	err := dbc.Find(p.excludeDeleted(map[string]interface{}{"_id": id}, url.Values{})).Select(bson.M{p.FieldSet.storageField(field): 1}).One(&doc)
+	if err == mgo.ErrNotFound {
+		return genRsp(http.StatusNotFound, "id not found", nil)
+	}
+	if err != nil {
+		return genRsp(http.StatusInternalServerError, "db access fail", nil)
+	}
+	hash := GetString(doc[p.FieldSet.storageField(field)])
+	verified := hash != "" && VerifyPassword(hash, password)
+	if verified {
+		p.pwFailures.reset(key)
+	} else {
+		p.pwFailures.add(key, p.PasswordLockout)
+	}
+	return genRsp(http.StatusOK, "verify ok", map[string]interface{}{"id": id, "verified": verified})
+}
+
+// failureCounter counts failures of verify_password by key within the lockout window
+type failureCounter struct {
+	sync.Mutex
+	m map[string]*failure
+}
+
+type failure struct {
+	count int
+	until time.Time
+}
+
+// locked check the failures of key reach max within the window or not
+func (c *failureCounter) locked(key string, max int) bool {
+	c.Lock()
+	defer c.Unlock()
+	f, ok := c.m[key]
+	return ok && f.count >= max && time.Now().Before(f.until)
+}
+
+// add counts a failure of key, the window begins at the first failure
+func (c *failureCounter) add(key string, window time.Duration) {
+	now := time.Now()
+	c.Lock()
+	defer c.Unlock()
+	f, ok := c.m[key]
+	if !ok || !now.Before(f.until) {
+		// drop expired ones before adding, keeps memory bounded by keys failing within the window
+		for k, v := range c.m {
+			if !now.Before(v.until) {
+				delete(c.m, k)
+			}
+		}
+		f = &failure{until: now.Add(window)}
+		c.m[key] = f
+	}
+	f.count++
+}
+
+// reset clears the failures of key after verified
+func (c *failureCounter) reset(key string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.m, key)
+}
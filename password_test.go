@@ -0,0 +1,110 @@
+package restful
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type passwordDoc struct {
+	ID       *string `json:"id,omitempty" bson:"_id,omitempty"`
+	Name     *string `json:"name,omitempty" bson:"name,omitempty"`
+	Password *string `json:"password,omitempty" bson:"password,omitempty"`
+	Btime    *int64  `json:"btime,omitempty" bson:"btime,omitempty"`
+	Mtime    *int64  `json:"mtime,omitempty" bson:"mtime,omitempty"`
+	Seq      *string `json:"seq,omitempty" bson:"seq,omitempty"`
+}
+
+func newPasswordProcessor(t *testing.T, hash string) *Processor {
+	p := &Processor{Biz: "password_" + hash, DataStruct: new(passwordDoc), PasswordFields: []string{"password"}, PasswordHash: hash}
+	if err := p.Init(); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	return p
+}
+
+func TestPasswordHashedOnWrite(t *testing.T) {
+	for _, algo := range []string{PasswordBcrypt, PasswordArgon2id} {
+		p := newPasswordProcessor(t, algo)
+		info := map[string]interface{}{"name": "alice", "password": "s3cret"}
+		if err := p.hashPasswords(info); err != nil {
+			t.Fatalf("%s hash: %v", algo, err)
+		}
+		hash, _ := info["password"].(string)
+		if hash == "" || hash == "s3cret" {
+			t.Fatalf("%s password stored as %q", algo, hash)
+		}
+		if algo == PasswordArgon2id && !strings.HasPrefix(hash, "$argon2id$") {
+			t.Errorf("argon2id hash %q", hash)
+		}
+		if info["name"] != "alice" {
+			t.Errorf("%s other fields changed: %v", algo, info)
+		}
+		if !VerifyPassword(hash, "s3cret") {
+			t.Errorf("%s password not verified", algo)
+		}
+		if VerifyPassword(hash, "wrong") {
+			t.Errorf("%s wrong password verified", algo)
+		}
+		if err := p.hashPasswords(map[string]interface{}{"password": ""}); err == nil {
+			t.Errorf("%s empty password hashed", algo)
+		}
+	}
+	p := newPasswordProcessor(t, "")
+	if err := p.checkPasswordOps(map[string]interface{}{"$unset": map[string]interface{}{"password": ""}}); err == nil {
+		t.Errorf("password written by $unset")
+	}
+}
+
+func TestVerifyPasswordRequest(t *testing.T) {
+	p := newPasswordProcessor(t, "")
+	for _, info := range []map[string]interface{}{
+		{"password": "x"},
+		{"id": "a", "field": "name", "password": "x"},
+		{"id": "a"},
+	} {
+		if rsp := p.verifyPassword(url.Values{}, info); rsp.Code != http.StatusBadRequest {
+			t.Errorf("verify %v code %d", info, rsp.Code)
+		}
+	}
+}
+
+func TestVerifyPasswordLockout(t *testing.T) {
+	p := newPasswordProcessor(t, "")
+	p.PasswordMaxFailures = 3
+	p.PasswordLockout = 100 * time.Millisecond
+	query := url.Values{}
+	key := p.GetDbName(query) + "/" + p.GetTableName(query) + "/a/password"
+	info := map[string]interface{}{"id": "a", "password": "guess"}
+
+	for i := 0; i < p.PasswordMaxFailures; i++ {
+		if p.pwFailures.locked(key, p.PasswordMaxFailures) {
+			t.Fatalf("locked after %d failures", i)
+		}
+		p.pwFailures.add(key, p.PasswordLockout)
+	}
+	// locked before the doc is read
+	if rsp := p.verifyPassword(query, info); rsp.Code != http.StatusTooManyRequests {
+		t.Fatalf("verify after max failures code %d", rsp.Code)
+	}
+	if other := p.GetDbName(query) + "/" + p.GetTableName(query) + "/b/password"; p.pwFailures.locked(other, p.PasswordMaxFailures) {
+		t.Errorf("other doc locked")
+	}
+
+	// verified clears failures
+	p.pwFailures.reset(key)
+	if p.pwFailures.locked(key, p.PasswordMaxFailures) {
+		t.Errorf("locked after reset")
+	}
+
+	// the window expires
+	for i := 0; i < p.PasswordMaxFailures; i++ {
+		p.pwFailures.add(key, p.PasswordLockout)
+	}
+	time.Sleep(p.PasswordLockout + 20*time.Millisecond)
+	if p.pwFailures.locked(key, p.PasswordMaxFailures) {
+		t.Errorf("locked after lockout window")
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"net/http"
 	"net/url"
 	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/globalsign/mgo"
@@ -28,6 +30,12 @@ type Processor struct {
 	// URL Path as service, usually equal to Biz
 	URLPath string
 
+	// old URL Paths still working after resource renamed, e.g.: /teachers
+	// if AliasDeprecated, Deprecation header is emitted when accessed by alias
+	AliasPaths      []string
+	AliasDeprecated bool
+	aliasHits       map[string]*int64
+
 	// for fields type parsing
 	DataStruct interface{}
 
@@ -36,6 +44,10 @@ type Processor struct {
 	// field's type must be string or []string
 	SearchFields []string
 
+	// fields returned as summary of hits in global search /__search?hydrate=true
+	// all fields returned if empty
+	SearchSummaryFields []string
+
 	// fields for search implemented by db regex
 	RegexSearchFields []string
 
@@ -43,41 +55,290 @@ type Processor struct {
 	// fields can only be written when creating by POST or PUT
 	CreateOnlyFields []string
 
+	// roles allowed to read fields, key: field, e.g.: {"salary": ["hr", "admin"]}
+	// fields are stripped from responses for callers without any of roles, see GlobalConfig.GetRoles
+	FieldReadRoles map[string][]string
+
+	// roles allowed to write fields, key: field, e.g.: {"salary": ["hr"]}
+	// writes of fields by callers without any of roles are rejected by 403, see GlobalConfig.GetRoles
+	// PUT and revert by such callers keep the values stored of the fields
+	FieldWriteRoles map[string][]string
+
+	// fields masked as "***" in bodies logged, e.g. PII like phone or id card
+	// and partially masked in responses if MaskResponses, e.g.: 138****5678
+	MaskedFields  []string
+	MaskResponses bool
+	maskRegexp    *regexp.Regexp
+
+	// fields of passwords, hashed by PasswordHash before stored, "bcrypt" by default or "argon2id"
+	// they are never returned, and checked by trigger: {"type": "verify_password", "id": "xxx", "password": "candidate"}
+	PasswordFields []string
+	PasswordHash   string
+	// verify_password of a doc is locked by 429 for PasswordLockout after PasswordMaxFailures failures within it,
+	// 5 failures and 15 minutes by default
+	PasswordMaxFailures int
+	PasswordLockout     time.Duration
+	pwFailures          *failureCounter
+
+	// fields Immutable once set
+	// fields can be written by any write while empty, but never changed afterwards, e.g. owner assigned late
+	// PUT keeps the values stored if absent, and changes are rejected by 409
+	ImmutableFields []string
+
 	// fields ReadOnly
 	// fields can not be written or update, data should be loaded into DB by other ways
 	ReadOnlyFields []string
 
+	// fields Hidden
+	// fields are stripped from every response and select projection even when stored, e.g. internal bookkeeping
+	HiddenFields []string
+
+	// version of the schema docs written by, stored in 'schema_version' int field required
+	// docs of older versions, or without the field as version 0, are upgraded lazily by Migrations in order:
+	// in responses when read, and stored before updated by PATCH, key: version migrated from
+	SchemaVersion int
+	Migrations    map[int]Migration
+
+	// DELETE sets 'dtime' field instead of removing the doc, 'dtime' field required
+	// soft-deleted docs are excluded from GET, unless URL Query: /path?include_deleted=true
+	SoftDelete bool
+
+	// convert string value like "42" or "true" to the kind of field instead of type mismatch
+	// for form-like clients, Coerce for all fields, or CoerceFields for some fields
+	Coerce       bool
+	CoerceFields []string
+
+	// convert string value like "42" or "true" in filter, range, in, nin, ne and all to the kind of field,
+	// as query params from frontends are often strings, instead of type mismatch
+	CoerceFilter bool
+
+	// business rules of fields checked when written, key: field, e.g.: {"isbn": checkISBN}
+	// more can be registered by FieldSet.RegisterValidator after Init
+	Validators map[string]func(value interface{}) error
+
+	// business rules across fields of the doc written by POST, PUT and PATCH, e.g. end_time after start_time
+	// called after fields checked, old is the doc stored, nil if creating, new is the doc after written
+	// both are with '_id' field and names in API, return an error as the reason rejected by 400
+	ValidateDocument func(old, new map[string]interface{}) error
+
+	// reject non-integral floats for int fields and negative values for uint fields
+	// instead of truncating them silently
+	StrictNumber bool
+
+	// decimal places float fields rounded to before written, key: field, value: decimal places
+	// field's type must be float, []float or map[string]float
+	FloatPrecision map[string]int
+
+	// keep revisions of docs written in table ${TableName}__revisions, the doc replaced by each write is kept
+	// a revision can be restored by POST /path/{id}/__revert with body {"seq": "3"}
+	KeepRevisions bool
+	// max revisions kept of each doc, the oldest removed beyond, 100 if 0
+	MaxRevisions int
+
+	// record GET accesses of docs by id or list to GlobalConfig.AuditSink, for regulated resources like PII
+	// sample rate in (0, 1] of requests audited, all if 0
+	AuditReads      bool
+	AuditSampleRate float64
+
+	// backfill btime, mtime and seq of legacy docs and convert ObjectId '_id' to string in background when init,
+	// for a pre-existing table not written by the package, see Adopt
+	AdoptTable bool
+
+	// validation profiles of regions or locales, key: profile name
+	// selected per request by GetProfile, using URL Query 'profile' or DefaultProfile by default
+	// e.g.: /path?profile=cn, or header X-Profile: cn
+	Profiles       map[string]*Profile
+	DefaultProfile string
+
+	// format of btime, mtime and dtime rendered, unix or rfc3339, using unix if empty
+	// both forms are accepted in filters and ranges
+	TimeFormat string
+
+	// match strings case-insensitively in filters of GET list and count by collation
+	// can also be set by URL Query: /path?ci=true
+	// index with the same collation is required to be used by such queries
+	CaseInsensitive bool
+
+	// locale of collation sorting and matching strings, e.g.: zh, de, zh@collation=pinyin, byte order if empty
+	// can also be set by URL Query: /path?collation=zh
+	// index with the same collation is required to be used by such queries
+	Collation string
+
+	// max size of a page of GET list, larger size is capped, using GlobalConfig.MaxPageSize if 0, unlimited if both 0
+	// size=-1 to get all docs matched is forbidden if max size set, unless AllowAllPage
+	MaxPageSize  int
+	AllowAllPage bool
+
+	// GET list returns pagination state page, size, pages and has_next besides total and hits
+	PageMetadata bool
+
+	// GET list skips counting all docs matched and returns total -1, for fast pages of big tables
+	// can also be set by URL Query: /path?total=false
+	SkipCount bool
+
+	// GET list with order runs as an aggregate allowing disk use, for sorts of big tables exceeding db memory limit
+	// without it, such a sort is rejected by 400 instead of 500
+	AllowDiskUse bool
+
+	// GET list rejects filters and orders not covered by Indexes with 400, protecting big tables from scans
+	// filtered by the first key of an index, or ordered by keys of an index following the filtered keys
+	RequireIndexedQueries bool
+
+	// PUT can not create a new doc when id not exists, return 404 instead
+	// can also be set by URL Query: /path/{id}?upsert=false
+	PutNoUpsert bool
+
+	// fields merged on concurrent PATCHes instead of rejected by seq, a PATCH with only
+	// {"$inc": {counter: n}} of CounterFields and {"$addToSet": {set: [...]}} of SetFields commutes,
+	// so it is applied on the latest seq, and seq or If-Match is not required
+	// CounterFields' type must be number, SetFields' type must be array of bool, number or string
+	CounterFields []string
+	SetFields     []string
+	counterFields map[string]bool
+	setFields     map[string]bool
+
+	// fields deprecated, writes still succeed with warnings in response, counted by DeprecatedWrites
+	// a migration period before the field is removed from DataStruct
+	DeprecatedFields []string
+	deprecatedWrites map[string]*int64
+
+	// fields keywords derived from, maintained in field KeywordsField ("keywords" if empty) on every write,
+	// lowercased words, and single characters and bigrams of Han, transliterated by KeywordTransliterate if set, e.g. pinyin
+	// docs having all keywords of URL Query are matched by indexed query without es: /path?keyword=hello
+	// field's type must be string or []string, KeywordsField's type must be []string, and is read only
+	KeywordFields        []string
+	KeywordsField        string
+	KeywordTransliterate func(word string) []string
+
+	// fields NFC
+	// string value will be normalized to unicode NFC form before written
+	// field's type must be string, []string or map[string]string
+	NFCFields []string
+
+	// fields holding ids of docs of other Processors, key: field, value: Biz of the referenced Processor
+	// field's type must be string or []string
+	// referenced docs are embedded by URL Query: /path?expand=director,actors
+	References map[string]string
+
+	// sample rate in (0, 1] of field access statistics, disabled if 0
+	// reads and writes of fields are reported by FieldStats() to identify dead fields
+	FieldStatsSampleRate float64
+
+	// examples of docs and queries returned by introspection, checked when init
+	Examples []Example
+
 	// indexes will be created in database/table
 	Indexes []Index
 
+	// fields unique besides id, unique indexes are created for them
+	// writes of duplicate values are rejected by 409 naming the field instead of 500
+	UniqueFields []string
+
+	// depth of fields recursive types in DataStruct expanded to, e.g.: Category with Children []*Category
+	// objects below it are accepted without validating their members, using 4 if 0
+	MaxFieldDepth int
+
 	// fields type and R/W config
 	FieldSet *FieldSet
 
 	// CURD handler
-	PostHandler    Handler
-	PutHandler     Handler
-	PatchHandler   Handler
-	GetHandler     Handler
-	GetPageHandler Handler
-	DeleteHandler  Handler
-	TriggerHandler Handler
+	PostHandler      Handler
+	PutHandler       Handler
+	PatchHandler     Handler
+	GetHandler       Handler
+	GetPageHandler   Handler
+	CountHandler     Handler
+	DeleteHandler    Handler
+	TriggerHandler   Handler
+	AggregateHandler Handler
+	RevertHandler    Handler
+	ModifyHandler    Handler
+	CloneHandler     Handler
+	SampleHandler    Handler
+	StatsHandler     Handler
+	ExportHandler    StreamHandler
+	ImportHandler    StreamHandler
+	// GET list of size=-1 with header Accept: application/x-ndjson, streams docs one per line
+	StreamPageHandler StreamHandler
+
+	// requests served, reported by GET /path/__stats
+	reads  *rateCounter
+	writes *rateCounter
 
 	// Do something after data write success
 	//   1. update search data to es
 	OnWriteDone func(method string, vars map[string]string, query url.Values, data map[string]interface{})
 
+	// Cache-Control header emitted on GET success, no header if nil
+	CacheControl *CacheControl
+
+	// es refresh policy after data write success, none, wait_for or immediate
+	// using none if empty, can also be set by URL Query: /path?es_refresh=wait_for
+	// the write request waits for es sync if policy is not none
+	EsRefresh string
+
 	// specify db and table name from URL Query
 	// e.g.: /path?db=dbName&table=tableName
 	// default db name: restful
 	// default table name: ${TableName}
 	GetDbName    func(query url.Values) string
 	GetTableName func(query url.Values) string
+
+	// select the validation profile from URL Query, e.g. by tenant, no profile if empty
+	GetProfile func(query url.Values) string
+}
+
+// formats of time fields rendered
+const (
+	TimeFormatUnix    = "unix"
+	TimeFormatRFC3339 = "rfc3339"
+)
+
+// CacheControl is the http caching policy of a Restful resource
+type CacheControl struct {
+	NoStore              bool // no-store for sensitive resources, others ignored
+	Private              bool // private, response can only be cached by client
+	MaxAge               int  // max-age in seconds of GET by id
+	ListMaxAge           int  // max-age in seconds of GET list
+	StaleWhileRevalidate int  // stale-while-revalidate in seconds of GET list
+}
+
+func (c *CacheControl) headerValue(list bool) string {
+	if c.NoStore {
+		return "no-store"
+	}
+	directives := make([]string, 0)
+	if c.Private {
+		directives = append(directives, "private")
+	}
+	if list {
+		if c.ListMaxAge > 0 {
+			directives = append(directives, fmt.Sprintf("max-age=%d", c.ListMaxAge))
+		}
+		if c.StaleWhileRevalidate > 0 {
+			directives = append(directives, fmt.Sprintf("stale-while-revalidate=%d", c.StaleWhileRevalidate))
+		}
+	} else if c.MaxAge > 0 {
+		directives = append(directives, fmt.Sprintf("max-age=%d", c.MaxAge))
+	}
+	return strings.Join(directives, ", ")
 }
 
 // Init a processor
 func (p *Processor) Init() error {
+	report := &InitReport{}
+	p.validate(report)
+	if report.HasProblems() {
+		return report
+	}
+	p.setDefault()
+	return nil
+}
+
+// validate checks the config of processor, and adds all problems found to the report
+func (p *Processor) validate(report *InitReport) {
 	if p.Biz == "" {
-		return fmt.Errorf("biz is empty")
+		report.Add(p.Biz, "biz is empty")
 	}
 	if p.TableName == "" {
 		p.TableName = p.Biz
@@ -85,57 +346,189 @@ func (p *Processor) Init() error {
 	if p.URLPath == "" {
 		p.URLPath = "/" + p.Biz
 	}
+	if !isURLPathValid(p.URLPath) {
+		report.Add(p.Biz, "url path %s invalid", p.URLPath)
+	}
+	p.aliasHits = make(map[string]*int64)
+	for _, alias := range p.AliasPaths {
+		if !isURLPathValid(alias) || alias == p.URLPath {
+			report.Add(p.Biz, "alias path %s invalid", alias)
+			continue
+		}
+		if _, ok := p.aliasHits[alias]; ok {
+			report.Add(p.Biz, "alias path %s dup", alias)
+			continue
+		}
+		p.aliasHits[alias] = new(int64)
+	}
+
+	if p.EsRefresh == "" {
+		p.EsRefresh = EsRefreshNone
+	}
+	if !isEsRefreshValid(p.EsRefresh) {
+		report.Add(p.Biz, "es refresh %s invalid", p.EsRefresh)
+	}
+
+	if p.TimeFormat == "" {
+		p.TimeFormat = TimeFormatUnix
+	}
+	if p.Collation != "" && !isCollationLocale(p.Collation) {
+		report.Add(p.Biz, "collation %s invalid", p.Collation)
+	}
+	if p.TimeFormat != TimeFormatUnix && p.TimeFormat != TimeFormatRFC3339 {
+		report.Add(p.Biz, "time format %s invalid", p.TimeFormat)
+	}
+
+	if p.DataStruct == nil {
+		report.Add(p.Biz, "data struct is nil")
+		return
+	}
 	// DataStruct must contain 'id', 'btime', 'mtime', 'seq' fields
 	//   id: primary key
 	//   btime: means birth time, the time when the doc created
 	//   mtime: means modify time, the time when the doc modified
 	//   seq: means the version of the doc
-	p.FieldSet = BuildFieldSet(reflect.TypeOf(p.DataStruct))
-	if _, ok := p.FieldSet.FMap["id"]; !ok {
-		return fmt.Errorf("%s struct must contain 'id' field", p.Biz)
+	if p.MaxFieldDepth < 0 {
+		report.Add(p.Biz, "max field depth %d invalid", p.MaxFieldDepth)
 	}
-	if _, ok := p.FieldSet.FMap["btime"]; !ok {
-		return fmt.Errorf("%s struct must contain 'btime' field", p.Biz)
+	if p.MaxFieldDepth > 0 {
+		p.FieldSet = BuildFieldSetDepth(reflect.TypeOf(p.DataStruct), p.MaxFieldDepth)
+	} else {
+		p.FieldSet = BuildFieldSet(reflect.TypeOf(p.DataStruct))
 	}
-	if _, ok := p.FieldSet.FMap["mtime"]; !ok {
-		return fmt.Errorf("%s struct must contain 'mtime' field", p.Biz)
+	for _, field := range []string{"id", "btime", "mtime", "seq"} {
+		if _, ok := p.FieldSet.FMap[field]; !ok {
+			report.Add(p.Biz, "struct must contain '%s' field", field)
+		}
 	}
-	if _, ok := p.FieldSet.FMap["seq"]; !ok {
-		return fmt.Errorf("%s struct must contain 'seq' field", p.Biz)
+
+	if err := p.FieldSet.CheckFieldTags(); err != nil {
+		report.Add(p.Biz, "%s", err.Error())
 	}
 
-	err := p.FieldSet.CheckSearchFields(p.SearchFields)
-	if err != nil {
-		return fmt.Errorf("%s %s", p.Biz, err.Error())
+	if _, ok := p.FieldSet.FMap["dtime"]; p.SoftDelete && !ok {
+		report.Add(p.Biz, "struct must contain 'dtime' field when soft delete")
+	}
+	if p.SoftDelete {
+		// dtime is only set by DELETE
+		p.ReadOnlyFields = append(p.ReadOnlyFields, "dtime")
 	}
 
-	err = p.FieldSet.CheckRegexSearchFields(p.RegexSearchFields)
-	if err != nil {
-		return fmt.Errorf("%s %s", p.Biz, err.Error())
+	if err := p.FieldSet.CheckSearchFields(p.SearchFields); err != nil {
+		report.Add(p.Biz, "%s", err.Error())
 	}
 
-	if p.Indexes != nil {
-		for i := 0; i < len(p.Indexes); i++ {
-			formatFields, err := p.FieldSet.CheckIndexFields(p.Indexes[i].Key)
-			if err != nil {
-				return fmt.Errorf("%s index[%v] check err: %s", p.Biz, p.Indexes[i].Key, err.Error())
-			}
-			p.Indexes[i].Key = formatFields
+	for _, field := range p.SearchSummaryFields {
+		if _, ok := p.FieldSet.IsFieldMember(field); !ok {
+			report.Add(p.Biz, "search summary field %s unknown", field)
+		}
+	}
+
+	if p.MaxPageSize < 0 {
+		report.Add(p.Biz, "max page size %d invalid", p.MaxPageSize)
+	}
+	if p.AuditSampleRate < 0 || p.AuditSampleRate > 1 {
+		report.Add(p.Biz, "audit sample rate %v invalid", p.AuditSampleRate)
+	}
+
+	if err := p.FieldSet.CheckFloatPrecision(p.FloatPrecision); err != nil {
+		report.Add(p.Biz, "%s", err.Error())
+	}
+
+	for _, field := range p.CoerceFields {
+		if _, ok := p.FieldSet.IsFieldMember(field); !ok {
+			report.Add(p.Biz, "coerce field %s unknown", field)
+		}
+	}
+
+	if err := p.FieldSet.CheckRegexSearchFields(p.RegexSearchFields); err != nil {
+		report.Add(p.Biz, "%s", err.Error())
+	}
+
+	if err := p.FieldSet.CheckHiddenFields(p.HiddenFields); err != nil {
+		report.Add(p.Biz, "%s", err.Error())
+	}
+
+	p.deprecatedWrites = make(map[string]*int64)
+	for _, field := range p.DeprecatedFields {
+		if _, ok := p.FieldSet.IsFieldMember(field); !ok {
+			report.Add(p.Biz, "deprecated field %s unknown", field)
+			continue
 		}
+		p.deprecatedWrites[field] = new(int64)
 	}
 
+	if err := p.FieldSet.CheckNFCFields(p.NFCFields); err != nil {
+		report.Add(p.Biz, "%s", err.Error())
+	}
+
+	refFields := make([]string, 0, len(p.References))
+	for field := range p.References {
+		refFields = append(refFields, field)
+	}
+	if err := p.FieldSet.CheckReferenceFields(refFields); err != nil {
+		report.Add(p.Biz, "%s", err.Error())
+	}
+
+	for i := 0; i < len(p.Indexes); i++ {
+		formatFields, err := p.FieldSet.CheckIndexFields(p.Indexes[i].Key)
+		if err != nil {
+			report.Add(p.Biz, "index[%v] check err: %s", p.Indexes[i].Key, err.Error())
+			continue
+		}
+		p.Indexes[i].Key = formatFields
+	}
+	// geo fields are queried by 2dsphere index
+	p.Indexes = append(p.Indexes, p.FieldSet.geoIndexes(p.Indexes)...)
+	p.checkUniqueFields(report)
+	p.checkImmutableFields(report)
+	p.checkFieldReadRoles(report)
+	p.checkFieldWriteRoles(report)
+	p.checkPasswordFields(report)
+	p.checkMaskedFields(report)
+
 	p.FieldSet.SetCreateOnlyFields(p.CreateOnlyFields)
 	p.FieldSet.SetReadOnlyFields(p.ReadOnlyFields)
+	// passwords are hidden as well
+	p.FieldSet.SetHiddenFields(append(append([]string{}, p.HiddenFields...), p.PasswordFields...))
+	p.FieldSet.SetNFCFields(p.NFCFields)
+	p.FieldSet.SetStrictNumber(p.StrictNumber)
+	p.FieldSet.SetFloatPrecision(p.FloatPrecision)
+	p.FieldSet.SetTimeFormat(p.TimeFormat)
+	p.FieldSet.SetCoerceFilter(p.CoerceFilter)
+	if p.Coerce {
+		p.FieldSet.SetCoerceFields(p.FieldSet.FSli)
+	} else {
+		p.FieldSet.SetCoerceFields(p.CoerceFields)
+	}
+	// before stats enabled, examples are not accesses
+	p.checkExamples(report)
+	p.checkProfiles(report)
+	p.checkMergeFields(report)
+	p.checkKeywordFields(report)
+	p.checkValidators(report)
+	p.checkMigrations(report)
+	p.FieldSet.SetStatsSampleRate(p.FieldStatsSampleRate)
 
 	Log.Debugf("%v FieldSet %v", p.Biz, p.FieldSet)
+}
+
+// isURLPathValid check the path starts with '/' and not ends with '/'
+func isURLPathValid(path string) bool {
+	return len(path) > 1 && strings.HasPrefix(path, "/") && !strings.HasSuffix(path, "/")
+}
 
-	// default value
+// setDefault sets the default functions and handlers of processor
+func (p *Processor) setDefault() {
 	if p.GetDbName == nil {
 		p.GetDbName = p.defaultGetDbName()
 	}
 	if p.GetTableName == nil {
 		p.GetTableName = p.defaultGetTableName()
 	}
+	if p.GetProfile == nil {
+		p.GetProfile = p.defaultGetProfile()
+	}
 	if p.PostHandler == nil {
 		p.PostHandler = p.defaultPost()
 	}
@@ -151,32 +544,184 @@ func (p *Processor) Init() error {
 	if p.GetPageHandler == nil {
 		p.GetPageHandler = p.defaultGetPage()
 	}
+	if p.CountHandler == nil {
+		p.CountHandler = p.defaultCount()
+	}
 	if p.DeleteHandler == nil {
 		p.DeleteHandler = p.defaultDelete()
 	}
 	if p.TriggerHandler == nil {
 		p.TriggerHandler = p.defaultTrigger()
 	}
+	if p.AggregateHandler == nil {
+		p.AggregateHandler = p.defaultAggregate()
+	}
+	if p.RevertHandler == nil {
+		p.RevertHandler = p.defaultRevert()
+	}
+	if p.ModifyHandler == nil {
+		p.ModifyHandler = p.defaultModify()
+	}
+	if p.CloneHandler == nil {
+		p.CloneHandler = p.defaultClone()
+	}
+	if p.SampleHandler == nil {
+		p.SampleHandler = p.defaultSample()
+	}
+	if p.StatsHandler == nil {
+		p.StatsHandler = p.defaultStats()
+	}
+	if p.ExportHandler == nil {
+		p.ExportHandler = p.defaultExport()
+	}
+	if p.ImportHandler == nil {
+		p.ImportHandler = p.defaultImport()
+	}
+	if p.StreamPageHandler == nil {
+		p.StreamPageHandler = p.defaultStreamPage()
+	}
 	if p.OnWriteDone == nil {
 		p.OnWriteDone = p.defaultOnWriteDone()
 	}
-
-	return nil
+	p.reads = newRateCounter()
+	p.writes = newRateCounter()
 }
 
 // Load is a function to register handlers
 func (p *Processor) Load() {
-	path := p.URLPath
-	pathWithID := p.URLPath + "/{id}"
-	pathWithTrigger := p.URLPath + "/__trigger"
-	Register("POST", path, p.PostHandler)
-	Register("PUT", pathWithID, p.PutHandler)
-	Register("PATCH", pathWithID, p.PatchHandler)
-	Register("GET", pathWithID, p.GetHandler)
-	Register("GET", path, p.GetPageHandler)
-	Register("DELETE", pathWithID, p.DeleteHandler)
+	p.load(p.URLPath, func(h Handler) Handler { return h }, func(h StreamHandler) StreamHandler { return h })
+	for _, alias := range p.AliasPaths {
+		p.load(alias, p.aliasHandler(alias), p.aliasStreamHandler(alias))
+	}
+}
+
+func (p *Processor) load(urlPath string, wrap func(h Handler) Handler, wrapStream func(h StreamHandler) StreamHandler) {
+	path := urlPath
+	pathWithID := urlPath + "/{id}"
+	pathWithTrigger := urlPath + "/__trigger"
+	pathWithCount := urlPath + "/__count"
+	// register before path with id, or it is matched as id
+	Register("GET", pathWithCount, wrap(p.rateHandler(p.CountHandler, false)))
+	Register("GET", urlPath+"/__sample", wrap(p.SampleHandler))
+	if gCfg.AdminEnable {
+		// capacity and traffic of the table
+		Register("GET", urlPath+"/__stats", wrap(p.StatsHandler))
+		// rebuild index with new options without downtime
+		Register("POST", urlPath+"/__rebuild_index", wrap(degradeHandler(p.defaultRebuildIndex())))
+		Register("GET", urlPath+"/__rebuild_index", wrap(p.defaultGetRebuildJob()))
+	}
+	RegisterStream("GET", urlPath+"/__export", wrapStream(p.streamHandler(p.ExportHandler, false, false)))
+	RegisterStream("POST", urlPath+"/__import", wrapStream(p.streamHandler(p.ImportHandler, true, false)))
+	Register("POST", path, wrap(degradeHandler(p.rateHandler(p.deprecatedHandler(p.PostHandler), true))))
+	Register("PUT", pathWithID, wrap(degradeHandler(p.rateHandler(p.deprecatedHandler(p.PutHandler), true))))
+	Register("PATCH", pathWithID, wrap(degradeHandler(p.rateHandler(p.deprecatedHandler(p.PatchHandler), true))))
+	Register("GET", pathWithID, wrap(p.rateHandler(p.cacheHandler(p.GetHandler, false), false)))
+	// register before GET list, or it is matched by GET list
+	RegisterStream("GET", path, wrapStream(p.streamHandler(p.StreamPageHandler, false, true))).MatcherFunc(isNDJSONPage)
+	Register("GET", path, wrap(p.rateHandler(p.cacheHandler(p.GetPageHandler, true), false)))
+	Register("HEAD", pathWithID, wrap(p.rateHandler(p.cacheHandler(p.GetHandler, false), false)))
+	Register("HEAD", path, wrap(p.rateHandler(p.cacheHandler(p.GetPageHandler, true), false)))
+	Register("DELETE", pathWithID, wrap(degradeHandler(p.rateHandler(p.DeleteHandler, true))))
 	// TriggerHandler do something internal
-	Register("POST", pathWithTrigger, p.TriggerHandler)
+	Register("POST", pathWithTrigger, wrap(degradeTrigger(p.rateHandler(p.TriggerHandler, true))))
+	// AggregateHandler runs a safe aggregate pipeline
+	Register("POST", urlPath+"/__aggregate", wrap(p.AggregateHandler))
+	// RevertHandler restores a revision of doc
+	Register("POST", pathWithID+"/__revert", wrap(degradeHandler(p.rateHandler(p.deprecatedHandler(p.RevertHandler), true))))
+	// ModifyHandler updates and returns the doc atomically
+	Register("POST", pathWithID+"/__modify", wrap(degradeHandler(p.rateHandler(p.deprecatedHandler(p.ModifyHandler), true))))
+	// CloneHandler copies a doc to a new id
+	Register("POST", pathWithID+"/__clone", wrap(degradeHandler(p.rateHandler(p.deprecatedHandler(p.CloneHandler), true))))
+	// OPTIONS lists allowed methods and schema summary
+	Register("OPTIONS", path, wrap(p.defaultOptions([]string{"GET", "HEAD", "POST", "OPTIONS"})))
+	Register("OPTIONS", pathWithID, wrap(p.defaultOptions([]string{"GET", "HEAD", "PUT", "PATCH", "DELETE", "OPTIONS"})))
+}
+
+// streamHandler wraps the stream handler like handlers registered: counted by rate, and Cache-Control emitted if list,
+// the header is set before the body streamed, and dropped if a failure rsp returned instead
+func (p *Processor) streamHandler(h StreamHandler, write bool, list bool) StreamHandler {
+	counter := p.reads
+	if write {
+		counter = p.writes
+	}
+	value := ""
+	if list && p.CacheControl != nil {
+		value = p.CacheControl.headerValue(true)
+	}
+	return func(vars map[string]string, query url.Values, r *http.Request, w http.ResponseWriter) *Rsp {
+		if value != "" {
+			w.Header().Set("Cache-Control", value)
+		}
+		rsp := h(vars, query, r, w)
+		if rsp != nil && rsp.Code != http.StatusOK {
+			w.Header().Del("Cache-Control")
+		}
+		if rsp == nil || rsp.Code < http.StatusBadRequest {
+			counter.add()
+		}
+		return rsp
+	}
+}
+
+// cacheHandler emits Cache-Control header on GET success
+func (p *Processor) cacheHandler(h Handler, list bool) Handler {
+	if p.CacheControl == nil {
+		return h
+	}
+	value := p.CacheControl.headerValue(list)
+	return func(vars map[string]string, query url.Values, body []byte) *Rsp {
+		rsp := h(vars, query, body)
+		if rsp != nil && rsp.Code == http.StatusOK && value != "" {
+			rsp.SetHeader("Cache-Control", value)
+		}
+		return rsp
+	}
+}
+
+// aliasHandler counts the hits of alias path and emits Deprecation header
+func (p *Processor) aliasHandler(alias string) func(h Handler) Handler {
+	return func(h Handler) Handler {
+		return func(vars map[string]string, query url.Values, body []byte) *Rsp {
+			atomic.AddInt64(p.aliasHits[alias], 1)
+			rsp := h(vars, query, body)
+			if p.AliasDeprecated && rsp != nil {
+				rsp.SetHeader("Deprecation", "true")
+				rsp.SetHeader("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", p.URLPath))
+				Log.Debugf("%v deprecated alias path %v accessed", p.Biz, alias)
+			}
+			return rsp
+		}
+	}
+}
+
+// aliasStreamHandler counts hits of alias path and emits deprecation headers like aliasHandler,
+// headers are set before the body streamed
+func (p *Processor) aliasStreamHandler(alias string) func(h StreamHandler) StreamHandler {
+	return func(h StreamHandler) StreamHandler {
+		return func(vars map[string]string, query url.Values, r *http.Request, w http.ResponseWriter) *Rsp {
+			atomic.AddInt64(p.aliasHits[alias], 1)
+			if p.AliasDeprecated {
+				w.Header().Set("Deprecation", "true")
+				w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", p.URLPath))
+				Log.Debugf("%v deprecated alias path %v accessed", p.Biz, alias)
+			}
+			return h(vars, query, r, w)
+		}
+	}
+}
+
+// AliasHits returns the hits of each alias path since started
+func (p *Processor) AliasHits() map[string]int64 {
+	hits := make(map[string]int64)
+	for alias, n := range p.aliasHits {
+		hits[alias] = atomic.LoadInt64(n)
+	}
+	return hits
+}
+
+// FieldStats get the sampled access statistics of fields, nil if FieldStatsSampleRate is 0
+func (p *Processor) FieldStats() []FieldStat {
+	return p.FieldSet.Stats()
 }
 
 func (p *Processor) defaultGetDbName() func(query url.Values) string {
@@ -209,10 +754,9 @@ func (p *Processor) defaultPost() Handler {
 		}
 		Log.Debugf("[req] %v POST %v query=%v", reqID, p.URLPath, query)
 
-		var err error
-		var info map[string]interface{}
-		if err = json.Unmarshal(body, &info); err != nil {
-			Log.Warnf("[rsp] %v POST %v unmarshal fail %v [%v]", reqID, p.URLPath, err, string(body))
+		info, err := ParseBody(body)
+		if err != nil {
+			Log.Warnf("[rsp] %v POST %v unmarshal fail %v [%v]", reqID, p.URLPath, err, p.maskBody(body))
 			return genRsp(http.StatusBadRequest, "invalid Body", nil)
 		}
 
@@ -222,7 +766,7 @@ func (p *Processor) defaultPost() Handler {
 				Log.Warnf("[rsp] %v POST %v custom id empty", reqID, p.URLPath)
 				return genRsp(http.StatusBadRequest, "custom id empty", nil)
 			}
-			if len(v) > 128 {
+			if StringLength(v) > 128 {
 				Log.Warnf("[rsp] %v POST %v custom id too long", reqID, p.URLPath)
 				return genRsp(http.StatusBadRequest, "custom id too long", nil)
 			}
@@ -230,17 +774,32 @@ func (p *Processor) defaultPost() Handler {
 			info["id"] = GenUniqueID()
 		}
 
-		err = p.FieldSet.CheckObject(info, false)
+		err = p.CheckWriteRoles(query, info)
+		if err != nil {
+			Log.Warnf("[rsp] %v POST %v %v", reqID, p.URLPath, err)
+			return genRsp(http.StatusForbidden, err.Error(), nil)
+		}
+		err = p.ApplyProfile(query, info, true)
+		if err != nil {
+			Log.Warnf("[rsp] %v POST %v profile check fail, err=%v", reqID, p.URLPath, err)
+			return genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+		err = p.ValidateCreate(info)
 		if err != nil {
 			Log.Warnf("[rsp] %v POST %v invalid field exists, biz=%v err=%v", reqID, p.URLPath, p.Biz, err)
 			return genRsp(http.StatusBadRequest, err.Error(), nil)
 		}
-		p.FieldSet.InReplace(&info)
-
-		now := time.Now().Unix()
-		info["btime"] = now
-		info["mtime"] = now
-		info["seq"] = genSeq(0)
+		if errRsp := p.validateDocument(nil, info); errRsp != nil {
+			Log.Warnf("[rsp] %v POST %v invalid doc, err=%v", reqID, p.URLPath, errRsp.Msg)
+			return errRsp
+		}
+		err = p.hashPasswords(info)
+		if err != nil {
+			Log.Warnf("[rsp] %v POST %v %v", reqID, p.URLPath, err)
+			return genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+		ApplyInternalFields(info, nil)
+		p.applySchemaVersion(info)
 
 		dbs := gCfg.MgoSess.Clone()
 		defer dbs.Close()
@@ -250,15 +809,16 @@ func (p *Processor) defaultPost() Handler {
 		err = dbc.Insert(&doc)
 		if err != nil {
 			Log.Warnf("[rsp] %v POST %v db access fail, err=%v", reqID, p.URLPath, err)
+			if field := p.duplicateField(err); field != "" {
+				return genRsp(http.StatusConflict, "duplicate "+field, nil)
+			}
 			if mgo.IsDup(err) {
 				return genRsp(http.StatusBadRequest, "duplicate id", nil)
 			}
 			return genRsp(http.StatusInternalServerError, "db access fail", nil)
 		}
 
-		if p.OnWriteDone != nil {
-			go p.OnWriteDone("POST", vars, query, info)
-		}
+		p.writeDone("POST", vars, query, info)
 		// ensure index
 		if p.Indexes != nil && len(p.Indexes) > 0 {
 			getIndexEnsureList().Push(&IndexToEnsureStruct{
@@ -268,6 +828,16 @@ func (p *Processor) defaultPost() Handler {
 			})
 		}
 
+		if isReturnRepresentation(query) {
+			doc, err := p.getRepresentation(dbc, query, info["_id"])
+			if err == nil {
+				costMs := time.Since(begin).Nanoseconds() / int64(time.Millisecond)
+				Log.Warnf("[rsp] %v success, cost %vms", reqID, costMs)
+				return genRsp(http.StatusOK, "post ok", doc)
+			}
+			Log.Warnf("[rsp] %v POST %v get representation fail, err=%v", reqID, p.URLPath, err)
+		}
+
 		costMs := time.Since(begin).Nanoseconds() / int64(time.Millisecond)
 		Log.Warnf("[rsp] %v success, cost %vms", reqID, costMs)
 		return genRsp(http.StatusOK, "post ok", map[string]interface{}{"id": info["_id"], "seq": info["seq"]})
@@ -286,65 +856,126 @@ func (p *Processor) defaultPut() Handler {
 		}
 		Log.Debugf("[req] %v PUT %v/%v query=%v", reqID, p.URLPath, id, query)
 
-		var info map[string]interface{}
-		if err = json.Unmarshal(body, &info); err != nil {
-			Log.Warnf("[rsp] %v PUT %v/%v unmarshal fail %v [%v]", p.URLPath, id, err, string(body))
+		info, err := ParseBody(body)
+		if err != nil {
+			Log.Warnf("[rsp] %v PUT %v/%v unmarshal fail %v [%v]", reqID, p.URLPath, id, err, p.maskBody(body))
 			return genRsp(http.StatusBadRequest, "invalid Body", nil)
 		}
 
 		info["id"] = id
-		if len(id) > 128 {
+		if StringLength(id) > 128 {
 			Log.Warnf("[rsp] %v PUT %v/%v id too long", reqID, p.URLPath, id)
 			return genRsp(http.StatusBadRequest, "id too long", nil)
 		}
-		err = p.FieldSet.CheckObject(info, false)
+		err = p.CheckWriteRoles(query, info)
+		if err != nil {
+			Log.Warnf("[rsp] %v PUT %v/%v %v", reqID, p.URLPath, id, err)
+			return genRsp(http.StatusForbidden, err.Error(), nil)
+		}
+		err = p.ApplyProfile(query, info, true)
+		if err != nil {
+			Log.Warnf("[rsp] %v PUT %v/%v profile check fail, err=%v", reqID, p.URLPath, id, err)
+			return genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+		err = p.ValidateCreate(info)
 		if err != nil {
 			Log.Warnf("[rsp] %v PUT %v/%v invalid field exists, biz=%v err=%v", reqID, p.URLPath, id, p.Biz, err)
 			return genRsp(http.StatusBadRequest, err.Error(), nil)
 		}
-		p.FieldSet.InReplace(&info)
+		err = p.hashPasswords(info)
+		if err != nil {
+			Log.Warnf("[rsp] %v PUT %v/%v %v", reqID, p.URLPath, id, err)
+			return genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
 
-		now := time.Now().Unix()
-		info["btime"] = now
-		info["mtime"] = now
-		info["seq"] = genSeq(0)
+		upsert := !p.PutNoUpsert
+		if strings.ToLower(query.Get("upsert")) == "false" {
+			upsert = false
+		}
+		// If-Match: "seq"
+		ifMatch := len(query["if_match"]) > 0
 
 		dbs := gCfg.MgoSess.Clone()
 		defer dbs.Close()
 		dbc := dbs.DB(p.GetDbName(query)).C(p.GetTableName(query))
 
+		// conditions checked atomically with the write
+		guard := &writeGuard{}
+		if errRsp := p.checkImmutable(dbc, id, info, nil, true, guard); errRsp != nil {
+			Log.Warnf("[rsp] %v PUT %v/%v %v", reqID, p.URLPath, id, errRsp.Msg)
+			return errRsp
+		}
 		var old map[string]interface{}
-		err = dbc.Find(bson.M{"_id": id}).Select(bson.M{"btime": 1, "seq": 1}).One(&old)
-		if err == nil {
-			if v, ok := old["btime"]; ok {
-				info["btime"] = v
-			} else {
-				info["btime"] = now
-			}
-
-			if v, ok := old["seq"]; ok {
-				nextSeq, err2 := nextSeq(v.(string))
-				if err2 == nil {
-					info["seq"] = nextSeq
-				} else {
-					info["seq"] = genSeq(0)
-				}
+		err = dbc.Find(p.liveSelector(bson.M{"_id": id})).Select(p.restrictedSelector(query, p.passwordSelector(bson.M{"btime": 1, "seq": 1}))).One(&old)
+		if err == mgo.ErrNotFound && p.SoftDelete {
+			// soft-deleted docs are not revived by PUT
+			if n, err2 := dbc.FindId(id).Count(); err2 == nil && n > 0 {
+				Log.Warnf("[rsp] %v PUT %v/%v id deleted", reqID, p.URLPath, id)
+				return genRsp(http.StatusConflict, "id deleted", nil)
 			}
+		}
+		if err == nil {
+			ApplyInternalFields(info, old)
+			p.FieldSet.apiNames(old)
+			p.keepPasswords(info, old)
+			p.keepRestricted(query, info, old)
 		} else if err != mgo.ErrNotFound {
 			Log.Warnf("[rsp] %v PUT %v/%v db access fail, err=%v", reqID, p.URLPath, id, err)
 			return genRsp(http.StatusInternalServerError, "db access fail", nil)
+		} else if ifMatch {
+			Log.Warnf("[rsp] %v PUT %v/%v id not found, if-match %v", reqID, p.URLPath, id, query["if_match"])
+			return genRsp(http.StatusPreconditionFailed, "id not found or seq conflict", nil)
+		} else if !upsert {
+			Log.Warnf("[rsp] %v PUT %v/%v id not found", reqID, p.URLPath, id)
+			return genRsp(http.StatusNotFound, "id not found", nil)
+		} else {
+			ApplyInternalFields(info, nil)
+		}
+		p.applySchemaVersion(info)
+		// the doc validated is the one written, with internal fields and passwords kept
+		if errRsp := p.checkDocumentUpdate(dbc, id, info, nil, guard); errRsp != nil {
+			Log.Warnf("[rsp] %v PUT %v/%v invalid doc, err=%v", reqID, p.URLPath, id, errRsp.Msg)
+			return errRsp
 		}
 
 		doc := p.FieldSet.InSort(&info)
-		_, err = dbc.Upsert(bson.M{"_id": id}, &doc)
+		if upsert && !ifMatch {
+			err = p.applyWrite(query, dbc, guard.selector(p.liveSelector(bson.M{"_id": id})), &doc, true)
+		} else {
+			selector := p.liveSelector(bson.M{"_id": id})
+			if ifMatch {
+				selector["seq"] = bson.M{"$in": query["if_match"]}
+			}
+			err = p.applyWrite(query, dbc, guard.selector(selector), &doc, false)
+			if err == mgo.ErrNotFound {
+				if reason := guard.failure(dbc, id); reason != "" {
+					Log.Warnf("[rsp] %v PUT %v/%v %v", reqID, p.URLPath, id, reason)
+					return genRsp(http.StatusConflict, reason, nil)
+				}
+				if ifMatch {
+					Log.Warnf("[rsp] %v PUT %v/%v id not found or seq conflict", reqID, p.URLPath, id)
+					return genRsp(http.StatusPreconditionFailed, "id not found or seq conflict", nil)
+				}
+				Log.Warnf("[rsp] %v PUT %v/%v id not found", reqID, p.URLPath, id)
+				return genRsp(http.StatusNotFound, "id not found", nil)
+			}
+		}
+		if mgo.IsDup(err) {
+			// upsert inserts if the doc stored does not meet the guard
+			if reason := guard.failure(dbc, id); reason != "" {
+				Log.Warnf("[rsp] %v PUT %v/%v %v", reqID, p.URLPath, id, reason)
+				return genRsp(http.StatusConflict, reason, nil)
+			}
+		}
 		if err != nil {
 			Log.Warnf("[rsp] %v PUT %v/%v db access fail, err=%v", reqID, p.URLPath, id, err)
+			if field := p.duplicateField(err); field != "" {
+				return genRsp(http.StatusConflict, "duplicate "+field, nil)
+			}
 			return genRsp(http.StatusInternalServerError, "db access fail", nil)
 		}
 
-		if p.OnWriteDone != nil {
-			go p.OnWriteDone("PUT", vars, query, info)
-		}
+		p.writeDone("PUT", vars, query, info)
 		// ensure index
 		if p.Indexes != nil && len(p.Indexes) > 0 {
 			getIndexEnsureList().Push(&IndexToEnsureStruct{
@@ -354,6 +985,16 @@ func (p *Processor) defaultPut() Handler {
 			})
 		}
 
+		if isReturnRepresentation(query) {
+			doc, err := p.getRepresentation(dbc, query, id)
+			if err == nil {
+				costMs := time.Since(begin).Nanoseconds() / int64(time.Millisecond)
+				Log.Warnf("[rsp] %v success, cost %vms", reqID, costMs)
+				return genRsp(http.StatusOK, "put ok", doc)
+			}
+			Log.Warnf("[rsp] %v PUT %v/%v get representation fail, err=%v", reqID, p.URLPath, id, err)
+		}
+
 		costMs := time.Since(begin).Nanoseconds() / int64(time.Millisecond)
 		Log.Warnf("[rsp] %v success, cost %vms", reqID, costMs)
 		return genRsp(http.StatusOK, "put ok", map[string]interface{}{"id": info["_id"], "seq": info["seq"]})
@@ -372,26 +1013,75 @@ func (p *Processor) defaultPatch() Handler {
 		}
 		Log.Debugf("[req] %v PATCH %v/%v query=%v", reqID, p.URLPath, id, query)
 
-		var info map[string]interface{}
-		if err = json.Unmarshal(body, &info); err != nil {
-			Log.Warnf("[rsp] %v PATCH %v/%v unmarshal fail %v [%v]", reqID, p.URLPath, id, err, string(body))
+		info, err := ParseBody(body)
+		if err != nil {
+			Log.Warnf("[rsp] %v PATCH %v/%v unmarshal fail %v [%v]", reqID, p.URLPath, id, err, p.maskBody(body))
 			return genRsp(http.StatusBadRequest, "invalid Body", nil)
 		}
 
-		err = p.FieldSet.CheckObject(info, true)
+		// update operators
+		updateOps := make(map[string]interface{})
+		for _, op := range []string{"$push", "$pull", "$addToSet", "$unset", "$inc"} {
+			if v, ok := info[op]; ok {
+				updateOps[op] = v
+				delete(info, op)
+			}
+		}
+
+		err = p.ApplyProfile(query, info, false)
+		if err != nil {
+			Log.Warnf("[rsp] %v PATCH %v/%v profile check fail, err=%v", reqID, p.URLPath, id, err)
+			return genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+		err = p.ValidateUpdate(info)
 		if err != nil {
 			Log.Warnf("[rsp] %v PATCH %v/%v invalid field exists, biz=%v err=%v", reqID, p.URLPath, id, p.Biz, err)
 			return genRsp(http.StatusBadRequest, err.Error(), nil)
 		}
-		p.FieldSet.InReplace(&info)
+		err = p.hashPasswords(info)
+		if err != nil {
+			Log.Warnf("[rsp] %v PATCH %v/%v %v", reqID, p.URLPath, id, err)
+			return genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
 
-		// check seq param
+		update := map[string]interface{}{"$set": info}
+		for op, v := range updateOps {
+			if op == "$unset" {
+				err = p.FieldSet.BuildUnsetObj(v, update)
+			} else if op == "$inc" {
+				if err = p.checkCounterOps(v); err == nil {
+					err = p.FieldSet.BuildIncObj(v, update)
+				}
+			} else {
+				err = p.FieldSet.BuildArrayOpObj(op, v, update)
+			}
+			if err != nil {
+				Log.Warnf("[rsp] %v PATCH %v/%v update operator invalid, biz=%v err=%v", reqID, p.URLPath, id, p.Biz, err)
+				return genRsp(http.StatusBadRequest, err.Error(), nil)
+			}
+		}
+		if err = p.checkUpdateRoles(query, update); err != nil {
+			Log.Warnf("[rsp] %v PATCH %v/%v %v", reqID, p.URLPath, id, err)
+			return genRsp(http.StatusForbidden, err.Error(), nil)
+		}
+		if err = p.checkPasswordOps(update); err != nil {
+			Log.Warnf("[rsp] %v PATCH %v/%v %v", reqID, p.URLPath, id, err)
+			return genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+
+		// check seq param, If-Match header works as seq
 		seq := query.Get("seq")
+		ifMatch := false
+		if seq == "" && len(query["if_match"]) > 0 {
+			seq = query.Get("if_match")
+			ifMatch = true
+		}
 		ignoreSeq := false
 		if strings.ToLower(query.Get("ignore_seq")) == "true" {
 			ignoreSeq = true
 		}
-		if !ignoreSeq && seq == "" {
+		merge := !ignoreSeq && p.isMergeable(info, updateOps)
+		if !ignoreSeq && !merge && seq == "" {
 			Log.Warnf("[rsp] %v PATCH %v/%v need seq", reqID, p.URLPath, id)
 			return genRsp(http.StatusBadRequest, "need seq", nil)
 		}
@@ -402,35 +1092,99 @@ func (p *Processor) defaultPatch() Handler {
 		defer dbs.Close()
 		dbc := dbs.DB(p.GetDbName(query)).C(p.GetTableName(query))
 
+		// conditions checked atomically with the update
+		guard := &writeGuard{}
+		if errRsp := p.checkImmutable(dbc, id, info, update, false, guard); errRsp != nil {
+			Log.Warnf("[rsp] %v PATCH %v/%v %v", reqID, p.URLPath, id, errRsp.Msg)
+			return errRsp
+		}
+		if errRsp := p.upgradeStored(dbc, id); errRsp != nil {
+			Log.Warnf("[rsp] %v PATCH %v/%v %v", reqID, p.URLPath, id, errRsp.Msg)
+			return errRsp
+		}
+		if errRsp := p.checkDocumentUpdate(dbc, id, info, update, guard); errRsp != nil {
+			Log.Warnf("[rsp] %v PATCH %v/%v invalid doc, err=%v", reqID, p.URLPath, id, errRsp.Msg)
+			return errRsp
+		}
+		if errRsp := p.checkArrayItems(dbc, id, update, guard); errRsp != nil {
+			Log.Warnf("[rsp] %v PATCH %v/%v %v", reqID, p.URLPath, id, errRsp.Msg)
+			return errRsp
+		}
+		if errRsp := p.updateKeywords(dbc, id, update, guard); errRsp != nil {
+			Log.Warnf("[rsp] %v PATCH %v/%v %v", reqID, p.URLPath, id, errRsp.Msg)
+			return errRsp
+		}
+		p.FieldSet.guardInc(update, guard)
+		p.FieldSet.StoreUpdate(update)
+
 		if ignoreSeq {
 			if _, ok := info["seq"]; ok {
 				delete(info, "seq")
 			}
 			info["mtime"] = now
-			err = dbc.Update(bson.M{"_id": id}, bson.M{"$set": info})
+			err = p.applyWrite(query, dbc, guard.selector(p.liveSelector(bson.M{"_id": id})), update, false)
+			if err == mgo.ErrNotFound {
+				if reason := guard.failure(dbc, id); reason != "" {
+					Log.Warnf("[rsp] %v PATCH %v/%v %v", reqID, p.URLPath, id, reason)
+					return genRsp(http.StatusConflict, reason, nil)
+				}
+				Log.Warnf("[rsp] %v PATCH %v/%v id not found", reqID, p.URLPath, id)
+				return genRsp(http.StatusNotFound, "id not found", nil)
+			}
+		} else if merge {
+			_, err = p.mergePatch(query, dbc, p.liveSelector(bson.M{"_id": id}), update, info, now, guard)
+			if err == mgo.ErrNotFound {
+				Log.Warnf("[rsp] %v PATCH %v/%v id not found", reqID, p.URLPath, id)
+				return genRsp(http.StatusNotFound, "id not found", nil)
+			}
+			if _, ok := err.(guardError); ok || err == errMergeConflict {
+				Log.Warnf("[rsp] %v PATCH %v/%v %v", reqID, p.URLPath, id, err)
+				return genRsp(http.StatusConflict, err.Error(), nil)
+			}
 		} else {
+			if ifMatch && len(query["if_match"]) > 1 {
+				// one of seqs listed, the seq stored is bumped if matched
+				var old map[string]interface{}
+				if err = dbc.FindId(id).Select(bson.M{"seq": 1}).One(&old); err == nil && matchIfMatch(query, GetString(old["seq"])) {
+					seq = GetString(old["seq"])
+				}
+			}
 			nextSeq, err2 := nextSeq(seq)
 			if err2 != nil {
 				Log.Warnf("[rsp] %v PATCH %v/%v invalid seq: %s", reqID, p.URLPath, id, seq)
+				if ifMatch {
+					// weak tags never match
+					return genRsp(http.StatusPreconditionFailed, "id not found or seq conflict", nil)
+				}
 				return genRsp(http.StatusBadRequest, "invalid seq", nil)
 			}
 			info["seq"] = nextSeq
 			info["mtime"] = now
-			err = dbc.Update(bson.M{"_id": id, "seq": seq}, bson.M{"$set": info})
+			err = p.applyWrite(query, dbc, guard.selector(p.liveSelector(bson.M{"_id": id, "seq": seq})), update, false)
 			if err == mgo.ErrNotFound {
+				if reason := guard.failure(dbc, id); reason != "" {
+					Log.Warnf("[rsp] %v PATCH %v/%v %v", reqID, p.URLPath, id, reason)
+					return genRsp(http.StatusConflict, reason, nil)
+				}
 				Log.Warnf("[rsp] %v PATCH %v/%v id not found or seq conflict", reqID, p.URLPath, id)
+				if ifMatch {
+					return genRsp(http.StatusPreconditionFailed, "id not found or seq conflict", nil)
+				}
 				return genRsp(http.StatusBadRequest, "id not found or seq conflict", nil)
 			}
 		}
 
 		if err != nil {
 			Log.Warnf("[rsp] %v PATCH %v/%v db access fail, err=%v", reqID, p.URLPath, id, err)
+			if field := p.duplicateField(err); field != "" {
+				return genRsp(http.StatusConflict, "duplicate "+field, nil)
+			}
 			return genRsp(http.StatusInternalServerError, "db access fail", nil)
 		}
 
-		if p.OnWriteDone != nil {
-			go p.OnWriteDone("PATCH", vars, query, info)
-		}
+		// names in API for hooks
+		p.FieldSet.apiNames(info)
+		p.writeDone("PATCH", vars, query, info)
 		// ensure index
 		if p.Indexes != nil && len(p.Indexes) > 0 {
 			getIndexEnsureList().Push(&IndexToEnsureStruct{
@@ -440,6 +1194,16 @@ func (p *Processor) defaultPatch() Handler {
 			})
 		}
 
+		if isReturnRepresentation(query) {
+			doc, err := p.getRepresentation(dbc, query, id)
+			if err == nil {
+				costMs := time.Since(begin).Nanoseconds() / int64(time.Millisecond)
+				Log.Warnf("[rsp] %v success, cost %vms", reqID, costMs)
+				return genRsp(http.StatusOK, "patch ok", doc)
+			}
+			Log.Warnf("[rsp] %v PATCH %v/%v get representation fail, err=%v", reqID, p.URLPath, id, err)
+		}
+
 		costMs := time.Since(begin).Nanoseconds() / int64(time.Millisecond)
 		Log.Warnf("[rsp] %v success, cost %vms", reqID, costMs)
 		if ignoreSeq {
@@ -464,17 +1228,32 @@ func (p *Processor) defaultGet() Handler {
 		// build select
 		selector := make(map[string]interface{})
 		if query.Get("select") != "" {
-			var selSlice []string
-			err := json.Unmarshal([]byte(query.Get("select")), &selSlice)
+			var entries []interface{}
+			err := json.Unmarshal([]byte(query.Get("select")), &entries)
 			if err != nil {
 				Log.Warnf("[rsp] %v GET %v/%v unmarshal select error: %v", reqID, p.URLPath, id, err)
 				return genRsp(http.StatusBadRequest, "select invalid", nil)
 			}
-			err = p.FieldSet.BuildSelectObj(selSlice, selector)
+			err = p.FieldSet.BuildSelectEntries(entries, selector)
 			if err != nil {
 				Log.Warnf("[rsp] %v GET %v/%v select param invalid, %v", reqID, p.URLPath, id, err)
 				return genRsp(http.StatusBadRequest, err.Error(), nil)
 			}
+		} else {
+			p.FieldSet.recordRead(nil)
+		}
+		if query.Get("slice") != "" {
+			var slice map[string]interface{}
+			err := json.Unmarshal([]byte(query.Get("slice")), &slice)
+			if err != nil {
+				Log.Warnf("[rsp] %v GET %v/%v unmarshal slice error: %v", reqID, p.URLPath, id, err)
+				return genRsp(http.StatusBadRequest, "slice invalid", nil)
+			}
+			err = p.FieldSet.BuildSliceObj(slice, selector)
+			if err != nil {
+				Log.Warnf("[rsp] %v GET %v/%v slice param invalid, %v", reqID, p.URLPath, id, err)
+				return genRsp(http.StatusBadRequest, err.Error(), nil)
+			}
 		}
 		p.FieldSet.InReplace(&selector)
 
@@ -487,12 +1266,12 @@ func (p *Processor) defaultGet() Handler {
 			})
 		}
 
-		dbs := gCfg.MgoSess.Clone()
+		dbs := readSession()
 		defer dbs.Close()
 		dbc := dbs.DB(p.GetDbName(query)).C(p.GetTableName(query))
 
 		var info map[string]interface{}
-		err = dbc.Find(bson.M{"_id": id}).Select(selector).One(&info)
+		err = dbc.Find(p.excludeDeleted(bson.M{"_id": id}, query)).Select(selector).One(&info)
 		if err != nil {
 			Log.Warnf("[rsp] %v GET %v/%v get id=%s error, %v", reqID, p.URLPath, id, id, err)
 			if err == mgo.ErrNotFound {
@@ -500,11 +1279,36 @@ func (p *Processor) defaultGet() Handler {
 			}
 			return genRsp(http.StatusInternalServerError, "db access fail", nil)
 		}
-		p.FieldSet.OutReplace(&info)
+		// unix timestamp before rendered
+		mtime := CheckInt(info["mtime"])
+		if err = p.FieldSet.OutReplace(&info); err != nil {
+			Log.Warnf("[rsp] %v GET %v/%v %v", reqID, p.URLPath, id, err)
+			return genRsp(http.StatusInternalServerError, "migrate fail", nil)
+		}
+		p.redactFields(query, []interface{}{info})
+		p.auditReads(reqID, query, []interface{}{info})
+
+		if query.Get("expand") != "" {
+			err = p.ExpandReferences(dbs, query, []interface{}{info})
+			if err != nil {
+				Log.Warnf("[rsp] %v GET %v/%v expand error, %v", reqID, p.URLPath, id, err)
+				return genRsp(http.StatusBadRequest, err.Error(), nil)
+			}
+		}
 
 		costMs := time.Since(begin).Nanoseconds() / int64(time.Millisecond)
 		Log.Warnf("[rsp] %v success, cost %vms", reqID, costMs)
-		return genRsp(http.StatusOK, "get ok", info)
+		if isExtJSON(query) {
+			info = ToExtJSON(info).(map[string]interface{})
+		}
+		rsp := genRsp(http.StatusOK, "get ok", info)
+		if seq := GetString(info["seq"]); seq != "" {
+			rsp.SetHeader("ETag", strconv.Quote(seq))
+		}
+		if mtime != nil {
+			rsp.SetHeader("Last-Modified", time.Unix(mtime.(int64), 0).UTC().Format(http.TimeFormat))
+		}
+		return rsp
 	}
 }
 
@@ -517,237 +1321,321 @@ func (p *Processor) defaultGetPage() Handler {
 		}
 		Log.Debugf("[req] %v GET PAGE %v query=%v", reqID, p.URLPath, query)
 
-		var err error
-		size := 0
-		page := 0
-		size, err = strconv.Atoi(query.Get("size"))
-		if err != nil || (size <= 0 && size != -1) {
-			Log.Warnf("[rsp] %v GET %v size error", reqID, p.URLPath)
-			return genRsp(http.StatusBadRequest, "need size or size invalid", nil)
+		rsp := p.ExecuteFindPage(reqID, query)
+		if rsp.Code == http.StatusOK {
+			costMs := time.Since(begin).Nanoseconds() / int64(time.Millisecond)
+			Log.Warnf("[rsp] %v success, cost %vms", reqID, costMs)
 		}
+		return rsp
+	}
+}
 
-		page, err = strconv.Atoi(query.Get("page"))
-		if err != nil || page <= 0 {
-			Log.Warnf("[rsp] %v GET %v page error", reqID, p.URLPath)
-			return genRsp(http.StatusBadRequest, "need page or page invalid", nil)
+func (p *Processor) defaultCount() Handler {
+	return func(vars map[string]string, query url.Values, body []byte) *Rsp {
+		begin := time.Now()
+		reqID := query.Get("reqid")
+		if reqID == "" {
+			reqID = "sys_" + RandString(8)
 		}
+		Log.Debugf("[req] %v GET %v/__count query=%v", reqID, p.URLPath, query)
 
-		// build condition
-		condition := make(map[string]interface{})
-		if query.Get("filter") != "" {
-			var filter map[string]interface{}
-			err := json.Unmarshal([]byte(query.Get("filter")), &filter)
-			if err != nil {
-				Log.Warnf("[rsp] %v GET %v unmarshal filter error: %v", reqID, p.URLPath, err)
-				return genRsp(http.StatusBadRequest, "filter invalid", nil)
-			}
-			err = p.FieldSet.BuildFilterObj(filter, condition)
-			if err != nil {
-				Log.Warnf("[rsp] %v GET %v filter param invalid, %v", reqID, p.URLPath, err)
-				return genRsp(http.StatusBadRequest, err.Error(), nil)
-			}
-		}
-		if query.Get("range") != "" {
-			var rang map[string]interface{}
-			err := json.Unmarshal([]byte(query.Get("range")), &rang)
-			if err != nil {
-				Log.Warnf("[rsp] %v GET %v unmarshal range error: %v", reqID, p.URLPath, err)
-				return genRsp(http.StatusBadRequest, "range invalid", nil)
-			}
-			err = p.FieldSet.BuildRangeObj(rang, condition)
-			if err != nil {
-				Log.Warnf("[rsp] %v GET %v range param invalid, %v", reqID, p.URLPath, err)
-				return genRsp(http.StatusBadRequest, err.Error(), nil)
-			}
-		}
-		if query.Get("in") != "" {
-			var in map[string]interface{}
-			err := json.Unmarshal([]byte(query.Get("in")), &in)
-			if err != nil {
-				Log.Warnf("[rsp] %v GET %v unmarshal in error: %v", reqID, p.URLPath, err)
-				return genRsp(http.StatusBadRequest, "in invalid", nil)
-			}
-			err = p.FieldSet.BuildInObj(in, condition)
-			if err != nil {
-				Log.Warnf("[rsp] %v GET %v in param invalid, %v", reqID, p.URLPath, err)
-				return genRsp(http.StatusBadRequest, err.Error(), nil)
-			}
-		}
-		if query.Get("nin") != "" {
-			var nin map[string]interface{}
-			err := json.Unmarshal([]byte(query.Get("nin")), &nin)
-			if err != nil {
-				Log.Warnf("[rsp] %v GET %v unmarshal nin error: %v", reqID, p.URLPath, err)
-				return genRsp(http.StatusBadRequest, "nin invalid", nil)
-			}
-			err = p.FieldSet.BuildNinObj(nin, condition)
-			if err != nil {
-				Log.Warnf("[rsp] %v GET %v nin param invalid, %v", reqID, p.URLPath, err)
-				return genRsp(http.StatusBadRequest, err.Error(), nil)
-			}
-		}
-		if query.Get("all") != "" {
-			var all map[string]interface{}
-			err := json.Unmarshal([]byte(query.Get("all")), &all)
-			if err != nil {
-				Log.Warnf("[rsp] %v GET %v unmarshal all error: %v", reqID, p.URLPath, err)
-				return genRsp(http.StatusBadRequest, "all invalid", nil)
-			}
-			err = p.FieldSet.BuildAllObj(all, condition)
-			if err != nil {
-				Log.Warnf("[rsp] %v GET %v all param invalid, %v", reqID, p.URLPath, err)
-				return genRsp(http.StatusBadRequest, err.Error(), nil)
-			}
+		condition, empty, errRsp := p.buildCondition(reqID, query)
+		if errRsp != nil {
+			return errRsp
 		}
-		if query.Get("or") != "" {
-			var or []interface{}
-			err := json.Unmarshal([]byte(query.Get("or")), &or)
-			if err != nil {
-				Log.Warnf("[rsp] %v GET %v unmarshal or error: %v", reqID, p.URLPath, err)
-				return genRsp(http.StatusBadRequest, "or invalid", nil)
-			}
-			err = p.FieldSet.BuildOrObj(or, condition)
-			if err != nil {
-				Log.Warnf("[rsp] %v GET %v or param invalid, %v", reqID, p.URLPath, err)
-				return genRsp(http.StatusBadRequest, err.Error(), nil)
-			}
+		if empty {
+			return genRsp(http.StatusOK, "count ok", map[string]interface{}{"total": 0})
 		}
-		if query.Get("search") != "" {
-			search := query.Get("search")
-			if search != "" {
-				regexSearchByDB := false
-				if len(p.RegexSearchFields) > 0 {
-					regexSearchByDB = true
-					err = p.FieldSet.BuildRegexSearchObj(search, p.RegexSearchFields, condition)
-					if err != nil {
-						Log.Warnf("[rsp] %v GET %v build regex search condition error: %v", reqID, p.URLPath, err)
-						return genRsp(http.StatusBadRequest, "build regex search condition error", nil)
-					}
-				}
-				if gCfg.EsEnable {
-					ids, err := esSearch(p.GetDbName(query), p.GetTableName(query), search, 2000, 0)
-					if err != nil {
-						Log.Warnf("[rsp] %v GET %v EsSearch err, %v", reqID, p.URLPath, err)
-						return genRsp(http.StatusInternalServerError, err.Error(), nil)
-					}
-					if !regexSearchByDB {
-						if len(ids) == 0 {
-							infos := make([]interface{}, 0)
-							Log.Debugf("[rsp] %v GET %v search no results", reqID, p.URLPath)
-							return genRsp(http.StatusOK, "no results found", RspGetPageData{Total: 0, Hits: infos})
-						}
-						if _, exist := condition["id"]; exist {
-							Log.Warnf("[rsp] %v GET %v search id condition conflict", reqID, p.URLPath)
-							return genRsp(http.StatusBadRequest, "search id condition conflict", nil)
-						}
-						condition["id"] = map[string]interface{}{"$in": ids}
-					} else {
-						if len(ids) > 0 {
-							if orCond, exist := condition["$or"]; exist {
-								switch orCondValue := orCond.(type) {
-								case []interface{}:
-									cond := make(map[string]interface{})
-									cond["id"] = map[string]interface{}{"$in": ids}
-									orCondValue = append(orCondValue, cond)
-									condition["$or"] = orCondValue
-								default:
-									Log.Warnf("[rsp] %v GET %v search condition conflict", reqID, p.URLPath)
-									return genRsp(http.StatusBadRequest, "search condition conflict", nil)
-								}
-							}
-						}
-					}
-				}
-				if !regexSearchByDB && !gCfg.EsEnable {
-					Log.Warnf("[rsp] %v GET %v search not config", reqID, p.URLPath)
-					return genRsp(http.StatusInternalServerError, "search not config", nil)
-				}
-			}
+		if err := p.checkIndexedQuery(condition, nil); err != nil {
+			Log.Warnf("[rsp] %v GET %v/__count %v", reqID, p.URLPath, err)
+			return genRsp(http.StatusBadRequest, err.Error(), nil)
 		}
-		p.FieldSet.InReplace(&condition)
+		Log.Debugf("[req] %v condition=%v", reqID, condition)
 
-		// build sort
-		sort := make(bson.D, 0, 0)
-		if query.Get("order") != "" {
-			var order []string
-			err := json.Unmarshal([]byte(query.Get("order")), &order)
-			if err != nil {
-				Log.Warnf("[rsp] %v GET %v unmarshal order error: %v", p.URLPath, err)
-				return genRsp(http.StatusBadRequest, "order invalid", nil)
-			}
-			err = p.FieldSet.BuildOrderArray(order, &sort)
-			if err != nil {
-				Log.Warnf("[rsp] %v GET %v order param invalid, %v", p.URLPath, err)
-				return genRsp(http.StatusBadRequest, err.Error(), nil)
-			}
-		}
-		orderFields := p.FieldSet.OrderArray2Slice(&sort)
+		dbs := readSession()
+		defer dbs.Close()
+		dbc := dbs.DB(p.GetDbName(query)).C(p.GetTableName(query))
 
-		// build select
-		selector := make(map[string]interface{})
-		if query.Get("select") != "" {
-			var selSlice []string
-			err := json.Unmarshal([]byte(query.Get("select")), &selSlice)
-			if err != nil {
-				Log.Warnf("[rsp] %v GET %v unmarshal select error: %v", p.URLPath, err)
-				return genRsp(http.StatusBadRequest, "select invalid", nil)
-			}
-			err = p.FieldSet.BuildSelectObj(selSlice, selector)
-			if err != nil {
-				Log.Warnf("[rsp] %v GET %v select param invalid, %v", p.URLPath, err)
-				return genRsp(http.StatusBadRequest, err.Error(), nil)
-			}
+		total, err := limitRegex(dbc.Find(countCondition(condition)), condition).Collation(p.getCollation(query)).Count()
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v/__count count error: %v", reqID, p.URLPath, err)
+			return genRsp(http.StatusInternalServerError, "db access fail", nil)
 		}
-		p.FieldSet.InReplace(&selector)
 
-		Log.Debugf("[req] %v condition=%v order=%v select=%v", reqID, condition, orderFields, selector)
+		costMs := time.Since(begin).Nanoseconds() / int64(time.Millisecond)
+		Log.Warnf("[rsp] %v success, cost %vms", reqID, costMs)
+		return genRsp(http.StatusOK, "count ok", map[string]interface{}{"total": total})
+	}
+}
 
-		// ensure index
-		if p.Indexes != nil && len(p.Indexes) > 0 {
-			getIndexEnsureList().Push(&IndexToEnsureStruct{
-				DB:        p.GetDbName(query),
-				Table:     p.GetTableName(query),
-				Processor: p,
-			})
-		}
+// buildCondition builds the query condition by filter, range, in, nin, ne, elem_match, all, or, search params of URL Query
+// empty is true when search no results, then no need to query db
+func (p *Processor) buildCondition(reqID string, query url.Values) (condition map[string]interface{}, empty bool, errRsp *Rsp) {
+	condition, _, empty, errRsp = p.buildScoredCondition(reqID, query)
+	return condition, empty, errRsp
+}
 
-		dbs := gCfg.MgoSess.Clone()
-		defer dbs.Close()
-		dbc := dbs.DB(p.GetDbName(query)).C(p.GetTableName(query))
+// searchScores is the relevance scores of docs searched by es
+type searchScores struct {
+	IDs    []string
+	Scores []float64
+}
 
-		// count
-		total := 0
-		total, err = dbc.Find(condition).Count()
+// buildScoredCondition builds the query condition like buildCondition
+// scores is not nil when searched by es
+func (p *Processor) buildScoredCondition(reqID string, query url.Values) (condition map[string]interface{}, scores *searchScores, empty bool, errRsp *Rsp) {
+	var err error
+	if query.Get("collation") != "" && !isCollationLocale(query.Get("collation")) {
+		Log.Warnf("[rsp] %v GET %v collation %v invalid", reqID, p.URLPath, query.Get("collation"))
+		return nil, nil, false, genRsp(http.StatusBadRequest, "collation invalid", nil)
+	}
+	condition = make(map[string]interface{})
+	if query.Get("filter") != "" {
+		var filter map[string]interface{}
+		err := json.Unmarshal([]byte(query.Get("filter")), &filter)
 		if err != nil {
-			Log.Warnf("[rsp] %v GET %v get page count error: %v", p.URLPath, err)
-			return genRsp(http.StatusInternalServerError, "db access fail", nil)
+			Log.Warnf("[rsp] %v GET %v unmarshal filter error: %v", reqID, p.URLPath, err)
+			return nil, nil, false, genRsp(http.StatusBadRequest, "filter invalid", nil)
 		}
-		if total <= 0 {
-			infos := make([]interface{}, 0)
-			return genRsp(http.StatusOK, "no results found", RspGetPageData{Total: 0, Hits: infos})
+		err = mergeBuild(condition, func(part map[string]interface{}) error { return p.FieldSet.BuildFilterObj(filter, part) })
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v filter param invalid, %v", reqID, p.URLPath, err)
+			return nil, nil, false, genRsp(http.StatusBadRequest, err.Error(), nil)
 		}
-
-		// results
-		var infos []interface{}
-		switch {
-		case size == -1:
-			err = dbc.Find(condition).Sort(orderFields...).Select(selector).All(&infos)
-		case size > 0:
-			err = dbc.Find(condition).Skip(size * (page - 1)).Limit(size).Sort(orderFields...).Select(selector).All(&infos)
-		default:
-			err = fmt.Errorf("unknown")
+	}
+	if query.Get("range") != "" {
+		var rang map[string]interface{}
+		err := json.Unmarshal([]byte(query.Get("range")), &rang)
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v unmarshal range error: %v", reqID, p.URLPath, err)
+			return nil, nil, false, genRsp(http.StatusBadRequest, "range invalid", nil)
 		}
+		err = mergeBuild(condition, func(part map[string]interface{}) error { return p.FieldSet.BuildRangeObj(rang, part) })
 		if err != nil {
-			Log.Warnf("[rsp] %v GET %v get page results error: %v", reqID, p.URLPath, err)
-			return genRsp(http.StatusInternalServerError, "db access fail", nil)
+			Log.Warnf("[rsp] %v GET %v range param invalid, %v", reqID, p.URLPath, err)
+			return nil, nil, false, genRsp(http.StatusBadRequest, err.Error(), nil)
 		}
-
-		p.FieldSet.OutReplaceArray(infos)
-
-		costMs := time.Since(begin).Nanoseconds() / int64(time.Millisecond)
-		Log.Warnf("[rsp] %v success, cost %vms", reqID, costMs)
-		return genRsp(http.StatusOK, "get page ok", RspGetPageData{Total: int64(total), Hits: infos})
 	}
+	if query.Get("in") != "" {
+		var in map[string]interface{}
+		err := json.Unmarshal([]byte(query.Get("in")), &in)
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v unmarshal in error: %v", reqID, p.URLPath, err)
+			return nil, nil, false, genRsp(http.StatusBadRequest, "in invalid", nil)
+		}
+		err = mergeBuild(condition, func(part map[string]interface{}) error { return p.FieldSet.BuildInObj(in, part) })
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v in param invalid, %v", reqID, p.URLPath, err)
+			return nil, nil, false, genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+	}
+	if query.Get("ids") != "" {
+		var ids []interface{}
+		err := json.Unmarshal([]byte(query.Get("ids")), &ids)
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v unmarshal ids error: %v", reqID, p.URLPath, err)
+			return nil, nil, false, genRsp(http.StatusBadRequest, "ids invalid", nil)
+		}
+		err = mergeBuild(condition, func(part map[string]interface{}) error { return p.FieldSet.BuildIdsObj(ids, part) })
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v ids param invalid, %v", reqID, p.URLPath, err)
+			return nil, nil, false, genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+	}
+	if query.Get("since") != "" || query.Get("until") != "" {
+		field := query.Get("time_field")
+		if field == "" {
+			field = "mtime"
+		}
+		err := mergeBuild(condition, func(part map[string]interface{}) error {
+			return p.FieldSet.BuildTimeWindowObj(field, query.Get("since"), query.Get("until"), part)
+		})
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v time window param invalid, %v", reqID, p.URLPath, err)
+			return nil, nil, false, genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+	}
+	if query.Get("nin") != "" {
+		var nin map[string]interface{}
+		err := json.Unmarshal([]byte(query.Get("nin")), &nin)
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v unmarshal nin error: %v", reqID, p.URLPath, err)
+			return nil, nil, false, genRsp(http.StatusBadRequest, "nin invalid", nil)
+		}
+		err = mergeBuild(condition, func(part map[string]interface{}) error { return p.FieldSet.BuildNinObj(nin, part) })
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v nin param invalid, %v", reqID, p.URLPath, err)
+			return nil, nil, false, genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+	}
+	if query.Get("ne") != "" {
+		var ne map[string]interface{}
+		err := json.Unmarshal([]byte(query.Get("ne")), &ne)
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v unmarshal ne error: %v", reqID, p.URLPath, err)
+			return nil, nil, false, genRsp(http.StatusBadRequest, "ne invalid", nil)
+		}
+		err = mergeBuild(condition, func(part map[string]interface{}) error { return p.FieldSet.BuildNeObj(ne, part) })
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v ne param invalid, %v", reqID, p.URLPath, err)
+			return nil, nil, false, genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+	}
+	if query.Get("near") != "" {
+		var near map[string]interface{}
+		err := json.Unmarshal([]byte(query.Get("near")), &near)
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v unmarshal near error: %v", reqID, p.URLPath, err)
+			return nil, nil, false, genRsp(http.StatusBadRequest, "near invalid", nil)
+		}
+		err = mergeBuild(condition, func(part map[string]interface{}) error { return p.FieldSet.BuildNearObj(near, part) })
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v near param invalid, %v", reqID, p.URLPath, err)
+			return nil, nil, false, genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+	}
+	if query.Get("geo_within") != "" {
+		var within map[string]interface{}
+		err := json.Unmarshal([]byte(query.Get("geo_within")), &within)
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v unmarshal geo_within error: %v", reqID, p.URLPath, err)
+			return nil, nil, false, genRsp(http.StatusBadRequest, "geo_within invalid", nil)
+		}
+		err = mergeBuild(condition, func(part map[string]interface{}) error { return p.FieldSet.BuildGeoWithinObj(within, part) })
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v geo_within param invalid, %v", reqID, p.URLPath, err)
+			return nil, nil, false, genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+	}
+	if query.Get("elem_match") != "" {
+		var elemMatch map[string]interface{}
+		err := json.Unmarshal([]byte(query.Get("elem_match")), &elemMatch)
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v unmarshal elem_match error: %v", reqID, p.URLPath, err)
+			return nil, nil, false, genRsp(http.StatusBadRequest, "elem_match invalid", nil)
+		}
+		err = mergeBuild(condition, func(part map[string]interface{}) error { return p.FieldSet.BuildElemMatchObj(elemMatch, part) })
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v elem_match param invalid, %v", reqID, p.URLPath, err)
+			return nil, nil, false, genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+	}
+	if query.Get("regex") != "" {
+		var regex map[string]interface{}
+		err := json.Unmarshal([]byte(query.Get("regex")), &regex)
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v unmarshal regex error: %v", reqID, p.URLPath, err)
+			return nil, nil, false, genRsp(http.StatusBadRequest, "regex invalid", nil)
+		}
+		err = mergeBuild(condition, func(part map[string]interface{}) error { return p.FieldSet.BuildRegexObj(regex, part) })
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v regex param invalid, %v", reqID, p.URLPath, err)
+			return nil, nil, false, genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+	}
+	if query.Get("all") != "" {
+		var all map[string]interface{}
+		err := json.Unmarshal([]byte(query.Get("all")), &all)
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v unmarshal all error: %v", reqID, p.URLPath, err)
+			return nil, nil, false, genRsp(http.StatusBadRequest, "all invalid", nil)
+		}
+		err = mergeBuild(condition, func(part map[string]interface{}) error { return p.FieldSet.BuildAllObj(all, part) })
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v all param invalid, %v", reqID, p.URLPath, err)
+			return nil, nil, false, genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+	}
+	if query.Get("not") != "" {
+		var not map[string]interface{}
+		err := json.Unmarshal([]byte(query.Get("not")), &not)
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v unmarshal not error: %v", reqID, p.URLPath, err)
+			return nil, nil, false, genRsp(http.StatusBadRequest, "not invalid", nil)
+		}
+		err = p.FieldSet.BuildNotObj(not, condition)
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v not param invalid, %v", reqID, p.URLPath, err)
+			return nil, nil, false, genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+	}
+	if query.Get("or") != "" {
+		var or []interface{}
+		err := json.Unmarshal([]byte(query.Get("or")), &or)
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v unmarshal or error: %v", reqID, p.URLPath, err)
+			return nil, nil, false, genRsp(http.StatusBadRequest, "or invalid", nil)
+		}
+		err = mergeBuild(condition, func(part map[string]interface{}) error { return p.FieldSet.BuildOrObj(or, part) })
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v or param invalid, %v", reqID, p.URLPath, err)
+			return nil, nil, false, genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+	}
+	if query.Get("keyword") != "" {
+		if len(p.KeywordFields) == 0 {
+			Log.Warnf("[rsp] %v GET %v keyword not config", reqID, p.URLPath)
+			return nil, nil, false, genRsp(http.StatusBadRequest, "keyword not config", nil)
+		}
+		part := make(map[string]interface{})
+		p.BuildKeywordObj(query.Get("keyword"), part)
+		mergeCondition(condition, part)
+	}
+	if query.Get("search") != "" {
+		search := query.Get("search")
+		if search != "" {
+			// conditions of search are combined with others by $and
+			searchCond := make(map[string]interface{})
+			regexSearchByDB := false
+			if len(p.RegexSearchFields) > 0 {
+				regexSearchByDB = true
+				err = p.FieldSet.BuildRegexSearchObj(search, p.RegexSearchFields, searchCond)
+				if err != nil {
+					Log.Warnf("[rsp] %v GET %v build regex search condition error: %v", reqID, p.URLPath, err)
+					return nil, nil, false, genRsp(http.StatusBadRequest, "build regex search condition error", nil)
+				}
+			}
+			if gCfg.EsEnable {
+				ids, idScores, err := esSearchScores(p.GetDbName(query), p.GetTableName(query), search, 2000, 0)
+				if err != nil {
+					Log.Warnf("[rsp] %v GET %v EsSearch err, %v", reqID, p.URLPath, err)
+					return nil, nil, false, genRsp(http.StatusInternalServerError, err.Error(), nil)
+				}
+				scores = &searchScores{IDs: ids, Scores: idScores}
+				if !regexSearchByDB {
+					if len(ids) == 0 {
+						// callers render their own empty results
+						Log.Debugf("[rsp] %v GET %v search no results", reqID, p.URLPath)
+						return nil, nil, true, nil
+					}
+					searchCond["id"] = map[string]interface{}{"$in": ids}
+				} else {
+					if len(ids) > 0 {
+						if orCond, exist := searchCond["$or"]; exist {
+							switch orCondValue := orCond.(type) {
+							case []interface{}:
+								cond := make(map[string]interface{})
+								cond["id"] = map[string]interface{}{"$in": ids}
+								orCondValue = append(orCondValue, cond)
+								searchCond["$or"] = orCondValue
+							default:
+								Log.Warnf("[rsp] %v GET %v search condition conflict", reqID, p.URLPath)
+								return nil, nil, false, genRsp(http.StatusBadRequest, "search condition conflict", nil)
+							}
+						}
+					}
+				}
+			}
+			if !regexSearchByDB && !gCfg.EsEnable {
+				Log.Warnf("[rsp] %v GET %v search not config", reqID, p.URLPath)
+				return nil, nil, false, genRsp(http.StatusInternalServerError, "search not config", nil)
+			}
+			mergeCondition(condition, searchCond)
+		}
+	}
+	p.FieldSet.InReplace(&condition)
+	condition = p.excludeDeleted(condition, query)
+	return condition, scores, false, nil
 }
 
 func (p *Processor) defaultDelete() Handler {
@@ -766,7 +1654,23 @@ func (p *Processor) defaultDelete() Handler {
 		defer dbs.Close()
 		dbc := dbs.DB(p.GetDbName(query)).C(p.GetTableName(query))
 
-		err = dbc.Remove(bson.M{"_id": id})
+		// If-Match: "seq"
+		selector := bson.M{"_id": id}
+		if ifMatch := query["if_match"]; len(ifMatch) > 0 {
+			selector["seq"] = bson.M{"$in": ifMatch}
+		}
+		if p.SoftDelete {
+			err = p.softDelete(dbc, selector)
+		} else {
+			err = dbc.Remove(selector)
+		}
+		if err == mgo.ErrNotFound && len(selector) > 1 {
+			n, err2 := dbc.Find(p.excludeDeleted(bson.M{"_id": id}, url.Values{})).Count()
+			if err2 == nil && n > 0 {
+				Log.Warnf("[rsp] %v DELETE %v/%v seq conflict", reqID, p.URLPath, id)
+				return genRsp(http.StatusPreconditionFailed, "seq conflict", nil)
+			}
+		}
 		if err != nil {
 			Log.Warnf("[rsp] %v DELETE %v/%v delete id=%s error, %v", reqID, p.URLPath, id, err)
 			if err == mgo.ErrNotFound {
@@ -775,9 +1679,7 @@ func (p *Processor) defaultDelete() Handler {
 			return genRsp(http.StatusInternalServerError, "db access fail", nil)
 		}
 
-		if p.OnWriteDone != nil {
-			go p.OnWriteDone("DELETE", vars, query, nil)
-		}
+		p.writeDone("DELETE", vars, query, nil)
 		// ensure index
 		if p.Indexes != nil && len(p.Indexes) > 0 {
 			getIndexEnsureList().Push(&IndexToEnsureStruct{
@@ -793,6 +1695,44 @@ func (p *Processor) defaultDelete() Handler {
 	}
 }
 
+// softDelete sets dtime of the doc matched by selector, the soft-deleted doc is not matched
+func (p *Processor) softDelete(dbc *mgo.Collection, selector bson.M) error {
+	cond := bson.M{"dtime": bson.M{"$exists": false}}
+	for k, v := range selector {
+		cond[k] = v
+	}
+	var old map[string]interface{}
+	err := dbc.Find(cond).Select(bson.M{"seq": 1}).One(&old)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	update := bson.M{"dtime": now, "mtime": now}
+	if seq, err := nextSeq(GetString(old["seq"])); err == nil {
+		update["seq"] = seq
+	}
+	cond["seq"] = old["seq"]
+	return dbc.Update(cond, bson.M{"$set": update})
+}
+
+// excludeDeleted adds the condition excluding soft-deleted docs, unless URL Query include_deleted=true,
+// conditions of the client on dtime are kept along with it
+func (p *Processor) excludeDeleted(condition map[string]interface{}, query url.Values) map[string]interface{} {
+	if p.SoftDelete && strings.ToLower(query.Get("include_deleted")) != "true" {
+		mergeCondition(condition, map[string]interface{}{"dtime": bson.M{"$exists": false}})
+	}
+	return condition
+}
+
+// liveSelector adds the condition excluding soft-deleted docs to the selector of writes,
+// soft-deleted docs are never written, include_deleted not honored
+func (p *Processor) liveSelector(selector bson.M) bson.M {
+	if p.SoftDelete {
+		mergeCondition(selector, map[string]interface{}{"dtime": bson.M{"$exists": false}})
+	}
+	return selector
+}
+
 func (p *Processor) defaultTrigger() Handler {
 	return func(vars map[string]string, query url.Values, body []byte) *Rsp {
 		begin := time.Now()
@@ -826,6 +1766,15 @@ func (p *Processor) defaultTrigger() Handler {
 				vars["id"] = id
 				go p.OnWriteDone("PATCH", vars, query, nil)
 			}
+		case "verify_password":
+			rsp := p.verifyPassword(query, info)
+			if rsp.Code != http.StatusOK {
+				Log.Warnf("[rsp] %v POST %v/__trigger verify_password %v", reqID, p.URLPath, rsp.Msg)
+				return rsp
+			}
+			costMs := time.Since(begin).Nanoseconds() / int64(time.Millisecond)
+			Log.Warnf("[rsp] %v success, cost %vms", reqID, costMs)
+			return rsp
 		default:
 			Log.Warnf("[rsp] %v POST %v/__trigger trigger type: %v unknown", reqID, p.URLPath, typ)
 			return genRsp(http.StatusBadRequest, fmt.Sprintf("trigger type: %v unknown", typ), nil)
@@ -837,51 +1786,103 @@ func (p *Processor) defaultTrigger() Handler {
 	}
 }
 
-func (p *Processor) defaultOnWriteDone() func(method string, vars map[string]string, query url.Values, data map[string]interface{}) {
-	return func(method string, vars map[string]string, query url.Values, data map[string]interface{}) {
-		var err error
-		db := p.GetDbName(query)
-		table := p.GetTableName(query)
-		switch method {
-		case "POST":
-			fallthrough
-		case "PUT":
-			if gCfg.EsEnable {
-				id := GetString(data["_id"])
-				content := p.FieldSet.BuildSearchContent(data, p.SearchFields)
-				if content != "" {
-					err = esUpsert(db, table, id, content)
-				} else {
-					err = esRemove(db, table, id)
-				}
-			}
-		case "PATCH":
-			if gCfg.EsEnable {
-				dbs := gCfg.MgoSess.Clone()
-				defer dbs.Close()
-				dbc := dbs.DB(p.GetDbName(query)).C(p.GetTableName(query))
-				id := vars["id"]
-				var info map[string]interface{}
-				err = dbc.Find(bson.M{"_id": id}).One(&info)
-				if err != nil {
-					Log.Warnf("OnWriteDone [%v][%v] db fail %v", p.Biz, method, err)
-					return
-				}
-				content := p.FieldSet.BuildSearchContent(info, p.SearchFields)
-				if content != "" {
-					err = esUpsert(db, table, id, content)
-				} else {
-					err = esRemove(db, table, id)
-				}
-			}
-		case "DELETE":
-			if gCfg.EsEnable {
-				id := vars["id"]
-				err = esRemove(db, table, id)
-			}
+// getRepresentation get the full stored doc to return after data write
+func (p *Processor) getRepresentation(dbc *mgo.Collection, query url.Values, id interface{}) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	err := dbc.Find(bson.M{"_id": id}).One(&doc)
+	if err != nil {
+		return nil, err
+	}
+	if err = p.FieldSet.OutReplace(&doc); err != nil {
+		return nil, err
+	}
+	p.redactFields(query, []interface{}{doc})
+	return doc, nil
+}
+
+func (p *Processor) getEsRefresh(query url.Values) string {
+	if refresh := query.Get("es_refresh"); isEsRefreshValid(refresh) {
+		return refresh
+	}
+	return p.EsRefresh
+}
+
+// getMaxPageSize get the max size of a page of GET list, 0 if unlimited
+func (p *Processor) getMaxPageSize() int {
+	if p.MaxPageSize > 0 {
+		return p.MaxPageSize
+	}
+	return gCfg.MaxPageSize
+}
+
+// getCollation get the collation of queries, nil if case sensitive in byte order
+func (p *Processor) getCollation(query url.Values) *mgo.Collation {
+	ci := p.CaseInsensitive
+	if v, err := strconv.ParseBool(query.Get("ci")); err == nil {
+		ci = v
+	}
+	locale := p.Collation
+	if query.Get("collation") != "" {
+		locale = query.Get("collation")
+	}
+	if !ci && locale == "" {
+		return nil
+	}
+	collation := &mgo.Collation{Locale: locale}
+	if locale == "" {
+		collation.Locale = "en"
+	}
+	if ci {
+		collation.Strength = 2
+	}
+	return collation
+}
+
+// collation locale like zh, en_US or zh@collation=pinyin
+var collationLocaleRegexp = regexp.MustCompile(`^([a-z]{2,3}(_[A-Za-z0-9]+)*(@[a-z]+=[a-z0-9]+)?|simple)$`)
+
+func isCollationLocale(locale string) bool {
+	return collationLocaleRegexp.MatchString(locale)
+}
+
+// writeDone calls OnWriteDone, waits for it if es refresh policy is not none
+func (p *Processor) writeDone(method string, vars map[string]string, query url.Values, data map[string]interface{}) {
+	if p.OnWriteDone == nil {
+		return
+	}
+	if gCfg.EsEnable && p.getEsRefresh(query) != EsRefreshNone {
+		p.OnWriteDone(method, vars, query, data)
+		return
+	}
+	go p.OnWriteDone(method, vars, query, data)
+}
+
+func (p *Processor) defaultOptions(methods []string) Handler {
+	return func(vars map[string]string, query url.Values, body []byte) *Rsp {
+		data := map[string]interface{}{
+			"biz":     p.Biz,
+			"methods": methods,
+			"fields":  p.FieldSet.Describe(),
 		}
-		if err != nil {
-			Log.Warnf("OnWriteDone [%v][%v] es access fail %v", p.Biz, method, err)
+		if len(p.Examples) > 0 {
+			data["examples"] = p.Examples
+		}
+		rsp := genRsp(http.StatusOK, "options ok", data)
+		rsp.SetHeader("Allow", strings.Join(methods, ", "))
+		return rsp
+	}
+}
+
+func (p *Processor) defaultOnWriteDone() func(method string, vars map[string]string, query url.Values, data map[string]interface{}) {
+	return p.SyncSearch
+}
+
+// matchIfMatch check the seq matches one of the seqs of If-Match header
+func matchIfMatch(query url.Values, seq string) bool {
+	for _, v := range query["if_match"] {
+		if v == seq {
+			return true
 		}
 	}
+	return false
 }
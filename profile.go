@@ -0,0 +1,127 @@
+package restful
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Profile is a validation profile of region or locale, selected per request by Processor.GetProfile
+type Profile struct {
+	// patterns string values should match, key: field, e.g.: {"phone": `^\+86\d{11}$`}
+	// field's type must be string or []string
+	Patterns map[string]string
+
+	// values of fields set when creating by POST or PUT if absent, key: field, e.g.: {"currency": "CNY"}
+	Defaults map[string]interface{}
+
+	patterns map[string]*regexp.Regexp
+}
+
+// checkProfiles checks the profiles when init, and compiles the patterns
+func (p *Processor) checkProfiles(report *InitReport) {
+	if p.DefaultProfile != "" {
+		if _, ok := p.Profiles[p.DefaultProfile]; !ok {
+			report.Add(p.Biz, "default profile %s unknown", p.DefaultProfile)
+		}
+	}
+	for name, profile := range p.Profiles {
+		if profile == nil {
+			report.Add(p.Biz, "profile %s nil", name)
+			continue
+		}
+		profile.patterns = make(map[string]*regexp.Regexp, len(profile.Patterns))
+		for field, pattern := range profile.Patterns {
+			kind, ok := p.FieldSet.IsFieldMember(field)
+			if !ok {
+				report.Add(p.Biz, "profile %s pattern field %s unknown", name, field)
+				continue
+			}
+			if kind != KindString && kind != KindArrayString {
+				report.Add(p.Biz, "profile %s pattern field %s should be string or []string", name, field)
+				continue
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				report.Add(p.Biz, "profile %s pattern of field %s invalid: %v", name, field, err)
+				continue
+			}
+			profile.patterns[field] = re
+		}
+		for field, value := range profile.Defaults {
+			if err := p.FieldSet.CheckDocument(map[string]interface{}{field: value}); err != nil {
+				report.Add(p.Biz, "profile %s default %s", name, err.Error())
+			}
+		}
+	}
+}
+
+func (p *Processor) defaultGetProfile() func(query url.Values) string {
+	return func(query url.Values) string {
+		if profile := query.Get("profile"); profile != "" {
+			return profile
+		}
+		return p.DefaultProfile
+	}
+}
+
+// ApplyProfile sets the defaults when creating and checks the patterns of the profile selected by request
+// info is the doc to be created by POST or PUT if create, or the fields to be updated by PATCH
+func (p *Processor) ApplyProfile(query url.Values, info map[string]interface{}, create bool) error {
+	name := p.GetProfile(query)
+	if name == "" {
+		return nil
+	}
+	profile, ok := p.Profiles[name]
+	if !ok || profile == nil {
+		return fmt.Errorf("profile %s unknown", name)
+	}
+	if create {
+		for field, value := range profile.Defaults {
+			if _, ok := lookupPath(info, field); !ok {
+				importSetPath(info, field, value)
+			}
+		}
+	}
+	for field, re := range profile.patterns {
+		value, ok := lookupPath(info, field)
+		if !ok || value == nil {
+			continue
+		}
+		values, isArray := value.([]interface{})
+		if !isArray {
+			values = []interface{}{value}
+		}
+		for _, v := range values {
+			s, ok := v.(string)
+			if !ok {
+				continue
+			}
+			if !re.MatchString(s) {
+				return fmt.Errorf("field %s not match pattern of profile %s", field, name)
+			}
+		}
+	}
+	return nil
+}
+
+// lookupPath get the value of field path in doc, path like a.b can be a key or nested
+func lookupPath(doc map[string]interface{}, path string) (interface{}, bool) {
+	if v, ok := doc[path]; ok {
+		return v, true
+	}
+	pos := strings.Index(path, ".")
+	if pos == -1 {
+		return nil, false
+	}
+	switch sub := doc[path[:pos]].(type) {
+	case map[string]interface{}:
+		return lookupPath(sub, path[pos+1:])
+	case bson.M:
+		return lookupPath(sub, path[pos+1:])
+	}
+	return nil, false
+}
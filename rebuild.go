@@ -0,0 +1,219 @@
+package restful
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+)
+
+// status of index rebuild job
+const (
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// IndexRebuildJob describes an index rebuild running in background
+type IndexRebuildJob struct {
+	ID      string   `json:"id"`
+	DB      string   `json:"db"`
+	Table   string   `json:"table"`
+	Key     []string `json:"key"`
+	Unique  bool     `json:"unique"`
+	Replace string   `json:"replace,omitempty"` // name of old index dropped after the new one built
+	Status  string   `json:"status"`
+	Step    string   `json:"step"`
+	Error   string   `json:"error,omitempty"`
+	Btime   int64    `json:"btime"`
+	Etime   int64    `json:"etime,omitempty"`
+
+	storageKey []string // key by the names stored
+}
+
+// ReqRebuildIndex is the body of POST /{biz}/__rebuild_index
+type ReqRebuildIndex struct {
+	Key     []string `json:"key"`     // index key fields, prefix with +/-
+	Unique  bool     `json:"unique"`  // options of the new index
+	Replace string   `json:"replace"` // name of old index to drop, optional if key not changed
+}
+
+// jobs of index rebuild, key: job id
+var rebuildJobs = struct {
+	sync.RWMutex
+	m map[string]*IndexRebuildJob
+}{m: make(map[string]*IndexRebuildJob)}
+
+func getRebuildJob(id string) *IndexRebuildJob {
+	rebuildJobs.RLock()
+	defer rebuildJobs.RUnlock()
+	if job, ok := rebuildJobs.m[id]; ok {
+		cp := *job
+		return &cp
+	}
+	return nil
+}
+
+func updateRebuildJob(job *IndexRebuildJob, f func(job *IndexRebuildJob)) {
+	rebuildJobs.Lock()
+	defer rebuildJobs.Unlock()
+	f(job)
+}
+
+// RebuildIndex builds an index with new options without downtime, runs in background
+// key is like ["+name", "-age"], the index with same key or named replace is dropped after the new one built,
+// if the old index has the same key, a temporary index {key..., _id} serves queries while rebuilding
+// Processor.Indexes should be changed to the new one too, or the old one is ensured again
+func (p *Processor) RebuildIndex(db, table string, key []string, unique bool, replace string) (*IndexRebuildJob, error) {
+	formatKey, err := p.FieldSet.CheckIndexFields(key)
+	if err != nil {
+		return nil, err
+	}
+	job := &IndexRebuildJob{
+		ID:      RandString(16),
+		DB:      db,
+		Table:   table,
+		Key:     formatKey,
+		Unique:  unique,
+		Replace: replace,
+		Status:  JobRunning,
+		Btime:   time.Now().Unix(),
+	}
+	job.storageKey = p.FieldSet.storageIndexKey(formatKey)
+	rebuildJobs.Lock()
+	rebuildJobs.m[job.ID] = job
+	rebuildJobs.Unlock()
+
+	go func() {
+		err := runIndexRebuild(job)
+		status := JobDone
+		if err != nil {
+			status = JobFailed
+		}
+		updateRebuildJob(job, func(job *IndexRebuildJob) {
+			job.Etime = time.Now().Unix()
+			job.Status = status
+			if err != nil {
+				job.Error = err.Error()
+			}
+		})
+		Log.Warnf("db=%s table=%s RebuildIndex(%v) job %s %s, err: %v", db, table, formatKey, job.ID, status, err)
+	}()
+	return getRebuildJob(job.ID), nil
+}
+
+func runIndexRebuild(job *IndexRebuildJob) error {
+	step := func(s string) {
+		updateRebuildJob(job, func(job *IndexRebuildJob) { job.Step = s })
+	}
+	dbs := gCfg.MgoSess.Clone()
+	defer dbs.Close()
+	dbc := dbs.DB(job.DB).C(job.Table)
+
+	step("list indexes")
+	indexesInDB, err := dbc.Indexes()
+	if err != nil {
+		return err
+	}
+	var old *mgo.Index
+	for i := range indexesInDB {
+		idx := &indexesInDB[i]
+		if reflect.DeepEqual(idx.Key, job.storageKey) && idx.Unique == job.Unique {
+			if job.Replace == "" || job.Replace == idx.Name {
+				return nil
+			}
+			return fmt.Errorf("index with same key and options exists: %s", idx.Name)
+		}
+		if (job.Replace == "" && reflect.DeepEqual(idx.Key, job.storageKey)) || (job.Replace != "" && job.Replace == idx.Name) {
+			old = idx
+		}
+	}
+	if job.Replace != "" && old == nil {
+		return fmt.Errorf("index %s not found", job.Replace)
+	}
+	index := mgo.Index{Key: job.storageKey, Unique: job.Unique, Background: true}
+
+	// key changed, build the new one then drop the old one
+	if old == nil || !reflect.DeepEqual(old.Key, job.storageKey) {
+		step("build new index")
+		if err := dbc.EnsureIndex(index); err != nil {
+			return err
+		}
+		if old != nil {
+			step("drop old index")
+			return dbc.DropIndexName(old.Name)
+		}
+		return nil
+	}
+
+	// same key, db rejects two indexes of same key, a temporary one serves queries while rebuilding
+	temp := mgo.Index{Key: append(append([]string{}, job.storageKey...), "_id"), Name: old.Name + "_rebuild_tmp", Background: true}
+	step("build temporary index")
+	if err := dbc.EnsureIndex(temp); err != nil {
+		return err
+	}
+	step("drop old index")
+	if err := dbc.DropIndexName(old.Name); err != nil {
+		return err
+	}
+	step("build new index")
+	if err := dbc.EnsureIndex(index); err != nil {
+		// restore the old one, e.g. duplicate keys found when building unique index
+		old.Background = true
+		if e := dbc.EnsureIndex(*old); e != nil {
+			return fmt.Errorf("%v, restore old index fail: %v, temporary index %s kept", err, e, temp.Name)
+		}
+		dbc.DropIndexName(temp.Name)
+		return err
+	}
+	step("drop temporary index")
+	return dbc.DropIndexName(temp.Name)
+}
+
+func (p *Processor) defaultRebuildIndex() Handler {
+	return func(vars map[string]string, query url.Values, body []byte) *Rsp {
+		begin := time.Now()
+		reqID := query.Get("reqid")
+		if reqID == "" {
+			reqID = "sys_" + RandString(8)
+		}
+		Log.Debugf("[req] %v POST %v/__rebuild_index query=%v body=%v", reqID, p.URLPath, query, string(body))
+
+		var req ReqRebuildIndex
+		if err := json.Unmarshal(body, &req); err != nil {
+			Log.Warnf("[rsp] %v POST %v/__rebuild_index unmarshal fail %v [%v]", reqID, p.URLPath, err, string(body))
+			return genRsp(http.StatusBadRequest, "invalid Body", nil)
+		}
+		job, err := p.RebuildIndex(p.GetDbName(query), p.GetTableName(query), req.Key, req.Unique, req.Replace)
+		if err != nil {
+			Log.Warnf("[rsp] %v POST %v/__rebuild_index param invalid, %v", reqID, p.URLPath, err)
+			return genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+
+		costMs := time.Since(begin).Nanoseconds() / int64(time.Millisecond)
+		Log.Warnf("[rsp] %v success, cost %vms", reqID, costMs)
+		return genRsp(http.StatusAccepted, "rebuild index started", job)
+	}
+}
+
+func (p *Processor) defaultGetRebuildJob() Handler {
+	return func(vars map[string]string, query url.Values, body []byte) *Rsp {
+		reqID := query.Get("reqid")
+		if reqID == "" {
+			reqID = "sys_" + RandString(8)
+		}
+		Log.Debugf("[req] %v GET %v/__rebuild_index query=%v", reqID, p.URLPath, query)
+
+		job := getRebuildJob(query.Get("job"))
+		if job == nil || job.DB != p.GetDbName(query) || job.Table != p.GetTableName(query) {
+			Log.Warnf("[rsp] %v GET %v/__rebuild_index job %v not found", reqID, p.URLPath, query.Get("job"))
+			return genRsp(http.StatusNotFound, "job not found", nil)
+		}
+		return genRsp(http.StatusOK, "get job ok", job)
+	}
+}
@@ -0,0 +1,88 @@
+package restful
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// ExpandReferences embeds the docs referenced by the fields in URL Query expand into docs
+// e.g.: /path?expand=director,actors
+// the id in a string field is replaced by the referenced doc, or null if not found
+// the ids in a []string field are replaced by the referenced docs found, in the same order
+func (p *Processor) ExpandReferences(dbs *mgo.Session, query url.Values, docs []interface{}) error {
+	fields := RemoveDupArray(strings.Split(query.Get("expand"), ","))
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		biz, ok := p.References[field]
+		if !ok {
+			return fmt.Errorf("expand field %s not reference", field)
+		}
+		ref, ok := gProcessors[biz]
+		if !ok {
+			return fmt.Errorf("expand field %s biz %s unknown", field, biz)
+		}
+
+		// collect ids of all docs to fetch in one query
+		ids := make([]interface{}, 0)
+		for _, doc := range docs {
+			switch v := docMap(doc)[field].(type) {
+			case string:
+				ids = append(ids, v)
+			case []interface{}:
+				ids = append(ids, v...)
+			}
+		}
+		refDocs := make(map[interface{}]interface{})
+		if len(ids) > 0 {
+			// referenced doc lives in the same db, in its own table
+			refQuery := url.Values{}
+			refQuery.Set("db", query.Get("db"))
+			dbc := dbs.DB(ref.GetDbName(refQuery)).C(ref.GetTableName(url.Values{}))
+			var infos []interface{}
+			// soft-deleted docs are expanded as missing
+			err := dbc.Find(ref.excludeDeleted(map[string]interface{}{"_id": bson.M{"$in": ids}}, query)).All(&infos)
+			if err != nil {
+				return fmt.Errorf("expand field %s db access fail", field)
+			}
+			if err = ref.FieldSet.OutReplaceArray(infos); err != nil {
+				return fmt.Errorf("expand field %s %v", field, err)
+			}
+			ref.redactFields(query, infos)
+			for _, info := range infos {
+				refDocs[docMap(info)["id"]] = info
+			}
+		}
+
+		for _, doc := range docs {
+			m := docMap(doc)
+			switch v := m[field].(type) {
+			case string:
+				m[field] = refDocs[v]
+			case []interface{}:
+				expanded := make([]interface{}, 0, len(v))
+				for _, id := range v {
+					if refDoc, ok := refDocs[id]; ok {
+						expanded = append(expanded, refDoc)
+					}
+				}
+				m[field] = expanded
+			}
+		}
+	}
+	return nil
+}
+
+// docMap returns the doc read from db as map
+func docMap(doc interface{}) map[string]interface{} {
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		return v
+	case bson.M:
+		return v
+	}
+	return map[string]interface{}{}
+}
@@ -0,0 +1,85 @@
+package restful
+
+import (
+	"fmt"
+	"regexp/syntax"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// max time of queries with regex conditions, so slow patterns can not hold the db
+const regexMaxTime = 10 * time.Second
+
+// checkRegexPattern check the pattern from client has no nested or quantified groups like ^(a+)+$,
+// which backtrack catastrophically, only single characters, classes and literals can be quantified
+func checkRegexPattern(pattern string) error {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return err
+	}
+	return checkRegexNode(re)
+}
+
+func checkRegexNode(re *syntax.Regexp) error {
+	switch re.Op {
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		switch re.Sub[0].Op {
+		case syntax.OpLiteral, syntax.OpCharClass, syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		default:
+			return fmt.Errorf("quantified group not allowed")
+		}
+	}
+	for _, sub := range re.Sub {
+		if err := checkRegexNode(sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasRegex check the condition has regex
+func hasRegex(condition interface{}) bool {
+	switch v := condition.(type) {
+	case bson.RegEx:
+		return true
+	case map[string]interface{}:
+		for k, elem := range v {
+			if k == "$regex" || hasRegex(elem) {
+				return true
+			}
+		}
+	case bson.M:
+		return hasRegex(map[string]interface{}(v))
+	case []interface{}:
+		for _, elem := range v {
+			if hasRegex(elem) {
+				return true
+			}
+		}
+	case []bson.M:
+		for _, elem := range v {
+			if hasRegex(elem) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// limitRegex sets maxTimeMS of the query with regex conditions
+func limitRegex(q *mgo.Query, condition interface{}) *mgo.Query {
+	if hasRegex(condition) {
+		q.SetMaxTime(regexMaxTime)
+	}
+	return q
+}
+
+// limitRegexPipe sets maxTimeMS of the pipeline with regex conditions
+func limitRegexPipe(pipe *mgo.Pipe, pipeline interface{}) *mgo.Pipe {
+	if hasRegex(pipeline) {
+		pipe.SetMaxTime(regexMaxTime)
+	}
+	return pipe
+}
@@ -0,0 +1,251 @@
+package restful
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CaptureConfig is the config of capturing requests into a replayable log
+type CaptureConfig struct {
+	Writer       io.Writer // log written to, one CapturedRequest in json per line
+	SampleRate   float64   // sample rate in (0, 1], 1 if 0
+	WithBody     bool      // record bodies, or body sizes only
+	RedactFields []string  // body fields replaced by "***" besides PasswordFields and MaskedFields, e.g.: profile.phone
+	RedactQuery  []string  // URL Query params replaced by "***", e.g.: token
+	OmitHeaders  []string  // headers not recorded besides Authorization, Cookie and Proxy-Authorization, e.g.: X-Token
+}
+
+// CapturedRequest is a request recorded in replay log
+type CapturedRequest struct {
+	Time     int64           `json:"time"` // unix timestamp in milliseconds
+	Method   string          `json:"method"`
+	Path     string          `json:"path"`
+	Query    string          `json:"query,omitempty"`
+	Header   http.Header     `json:"header,omitempty"` // e.g. If-Match and headers of roles, credentials omitted
+	BodySize int             `json:"body_size"`
+	Body     json.RawMessage `json:"body,omitempty"`
+	Status   int             `json:"status"`
+	CostMs   int64           `json:"cost_ms"`
+}
+
+// redacted value of sensitive fields
+const redactedValue = "***"
+
+// headers never recorded, credentials and those of the connection or the raw body
+var omittedHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization",
+	"Connection", "Content-Length", "Content-Encoding", "Transfer-Encoding"}
+
+var captureLock sync.Mutex
+
+// captureRequest records the request into replay log if capture enabled
+func captureRequest(r *http.Request, body []byte, status int, begin time.Time) {
+	c := gCfg.Capture
+	if c == nil || c.Writer == nil {
+		return
+	}
+	if c.SampleRate > 0 && c.SampleRate < 1 && rand.Float64() >= c.SampleRate {
+		return
+	}
+	query := r.URL.Query()
+	for _, k := range c.RedactQuery {
+		if _, ok := query[k]; ok {
+			query.Set(k, redactedValue)
+		}
+	}
+	captured := CapturedRequest{
+		Time:     begin.UnixNano() / int64(time.Millisecond),
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Query:    query.Encode(),
+		Header:   captureHeader(r.Header, c.OmitHeaders),
+		BodySize: len(body),
+		Status:   status,
+		CostMs:   time.Since(begin).Nanoseconds() / int64(time.Millisecond),
+	}
+	if c.WithBody && len(body) > 0 {
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err == nil {
+			for _, field := range append(sensitiveFields(), c.RedactFields...) {
+				redactBody(v, field)
+			}
+			captured.Body, _ = json.Marshal(v)
+		}
+	}
+	line, err := json.Marshal(&captured)
+	if err != nil {
+		return
+	}
+	captureLock.Lock()
+	defer captureLock.Unlock()
+	c.Writer.Write(append(line, '\n'))
+}
+
+// captureHeader get the headers of request recorded, without the headers omitted
+func captureHeader(header http.Header, omit []string) http.Header {
+	h := header.Clone()
+	for _, k := range append(omittedHeaders, omit...) {
+		h.Del(k)
+	}
+	if len(h) == 0 {
+		return nil
+	}
+	return h
+}
+
+// sensitiveFields get the fields always redacted from bodies captured:
+// PasswordFields and MaskedFields of all processors, and the password candidate of trigger verify_password
+func sensitiveFields() []string {
+	fields := []string{"password"}
+	for _, p := range gProcessors {
+		fields = append(fields, p.PasswordFields...)
+		fields = append(fields, p.MaskedFields...)
+	}
+	return RemoveDupArray(fields)
+}
+
+// redactBody redacts the field in body, in the body as POST or PUT, and in update operators of PATCH like $set
+func redactBody(body interface{}, field string) {
+	path := strings.Split(field, ".")
+	redactField(body, path)
+	m, ok := body.(map[string]interface{})
+	if !ok {
+		return
+	}
+	for op, v := range m {
+		fields, ok := v.(map[string]interface{})
+		if !strings.HasPrefix(op, "$") || !ok {
+			continue
+		}
+		// keys of operators are paths like a.b
+		for k := range fields {
+			if k == field || strings.HasPrefix(k, field+".") {
+				fields[k] = redactedValue
+			}
+		}
+		redactField(fields, path)
+	}
+}
+
+// redactField replaces the field by path in value, elements of arrays are redacted too
+func redactField(value interface{}, path []string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		elem, ok := v[path[0]]
+		if !ok {
+			return
+		}
+		if len(path) == 1 {
+			v[path[0]] = redactedValue
+			return
+		}
+		redactField(elem, path[1:])
+	case []interface{}:
+		for _, elem := range v {
+			redactField(elem, path)
+		}
+	}
+}
+
+// ReplayOptions is the options of replaying a log
+type ReplayOptions struct {
+	Client *http.Client // http.DefaultClient if nil
+	Speed  float64      // speed of replay, 2 means twice as fast as captured, 0 means as fast as possible
+	Header http.Header  // extra headers of each request overriding the captured, e.g.: Authorization
+}
+
+// ReplayStats is the result of replaying a log
+type ReplayStats struct {
+	Total    int         `json:"total"`
+	Failed   int         `json:"failed"`   // requests not sent or got no response
+	Statuses map[int]int `json:"statuses"` // count of each status code
+	Mismatch int         `json:"mismatch"` // status code differs from captured
+}
+
+// Replay sends the requests in replay log to baseURL, e.g.: http://staging:8080
+// requests captured without body are sent with an empty body of the same size
+func Replay(replayLog io.Reader, baseURL string, opts ReplayOptions) (*ReplayStats, error) {
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	stats := &ReplayStats{Statuses: make(map[int]int)}
+	reader := bufio.NewReader(replayLog)
+	var first int64
+	start := time.Now()
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return stats, err
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			var captured CapturedRequest
+			if err := json.Unmarshal(line, &captured); err != nil {
+				return stats, err
+			}
+			// keep the intervals of requests captured
+			if first == 0 {
+				first = captured.Time
+			}
+			if opts.Speed > 0 {
+				offset := time.Duration(float64(captured.Time-first)/opts.Speed) * time.Millisecond
+				if wait := offset - time.Since(start); wait > 0 {
+					time.Sleep(wait)
+				}
+			}
+			replayRequest(client, baseURL, &captured, opts.Header, stats)
+		}
+		if err == io.EOF {
+			return stats, nil
+		}
+	}
+}
+
+func replayRequest(client *http.Client, baseURL string, captured *CapturedRequest, header http.Header, stats *ReplayStats) {
+	stats.Total++
+	body := []byte(captured.Body)
+	if len(body) == 0 && captured.BodySize > 0 {
+		body = bytes.Repeat([]byte(" "), captured.BodySize)
+	}
+	u := strings.TrimSuffix(baseURL, "/") + captured.Path
+	if captured.Query != "" {
+		if query, err := url.ParseQuery(captured.Query); err == nil {
+			u += "?" + query.Encode()
+		}
+	}
+	req, err := http.NewRequest(captured.Method, u, bytes.NewReader(body))
+	if err != nil {
+		stats.Failed++
+		return
+	}
+	for k, v := range captured.Header {
+		req.Header[k] = v
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	// body captured is decoded to utf-8 json
+	if len(body) > 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		stats.Failed++
+		return
+	}
+	io.Copy(ioutil.Discard, rsp.Body)
+	rsp.Body.Close()
+	stats.Statuses[rsp.StatusCode]++
+	if rsp.StatusCode != captured.Status {
+		stats.Mismatch++
+	}
+}
@@ -0,0 +1,223 @@
+package restful
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// revision of a doc stored in table ${TableName}__revisions
+type revision struct {
+	ID    string                 `bson:"_id"` // ${id}@${seq}
+	DocID interface{}            `bson:"doc_id"`
+	Seq   string                 `bson:"seq"`
+	Mtime int64                  `bson:"mtime"`
+	Doc   map[string]interface{} `bson:"doc"`
+}
+
+// revisionTable get the table name of revisions
+func (p *Processor) revisionTable(query url.Values) string {
+	return p.GetTableName(query) + "__revisions"
+}
+
+// max revisions kept of each doc by default
+const defaultMaxRevisions = 100
+
+// applyWrite writes the doc matched by selector by update, a replacement or update operators,
+// the doc replaced is returned by the write itself and saved as a revision if KeepRevisions,
+// so revisions are not missed or mixed up by concurrent writes
+func (p *Processor) applyWrite(query url.Values, dbc *mgo.Collection, selector bson.M, update interface{}, upsert bool) error {
+	if !p.KeepRevisions {
+		if upsert {
+			_, err := dbc.Upsert(selector, update)
+			return err
+		}
+		return dbc.Update(selector, update)
+	}
+	var old map[string]interface{}
+	_, err := dbc.Find(selector).Apply(mgo.Change{Update: update, Upsert: upsert, ReturnNew: false}, &old)
+	if err == nil && old != nil {
+		p.saveRevision(query, old)
+	}
+	return err
+}
+
+// saveRevision saves the doc replaced as a revision, and removes the oldest revisions beyond MaxRevisions
+func (p *Processor) saveRevision(query url.Values, doc map[string]interface{}) {
+	dbs := gCfg.MgoSess.Clone()
+	defer dbs.Close()
+	dbc := dbs.DB(p.GetDbName(query)).C(p.revisionTable(query))
+
+	id := doc["_id"]
+	seq := GetString(doc["seq"])
+	rev := revision{
+		ID:    GetString(id) + "@" + seq,
+		DocID: id,
+		Seq:   seq,
+		Mtime: time.Now().Unix(),
+		Doc:   doc,
+	}
+	_, err := dbc.UpsertId(rev.ID, &rev)
+	if err != nil {
+		Log.Warnf("%v save revision of id=%v, seq=%v error: %v", p.Biz, id, seq, err)
+		return
+	}
+
+	max := p.MaxRevisions
+	if max <= 0 {
+		max = defaultMaxRevisions
+	}
+	var expired []revision
+	err = dbc.Find(bson.M{"doc_id": id}).Sort("-mtime").Skip(max).Select(bson.M{"_id": 1}).All(&expired)
+	if err != nil || len(expired) == 0 {
+		return
+	}
+	ids := make([]interface{}, 0, len(expired))
+	for _, r := range expired {
+		ids = append(ids, r.ID)
+	}
+	if _, err = dbc.RemoveAll(bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+		Log.Warnf("%v remove expired revisions of id=%v error: %v", p.Biz, id, err)
+	}
+}
+
+func (p *Processor) defaultRevert() Handler {
+	return func(vars map[string]string, query url.Values, body []byte) *Rsp {
+		var err error
+		id := vars["id"]
+
+		begin := time.Now()
+		reqID := query.Get("reqid")
+		if reqID == "" {
+			reqID = "sys_" + RandString(8)
+		}
+		Log.Debugf("[req] %v POST %v/%v/__revert query=%v", reqID, p.URLPath, id, query)
+
+		if !p.KeepRevisions {
+			Log.Warnf("[rsp] %v POST %v/%v/__revert revisions not kept", reqID, p.URLPath, id)
+			return genRsp(http.StatusNotFound, "revisions not kept", nil)
+		}
+
+		var req struct {
+			Seq string `json:"seq"`
+		}
+		err = json.Unmarshal(body, &req)
+		if err != nil || req.Seq == "" {
+			Log.Warnf("[rsp] %v POST %v/%v/__revert need seq", reqID, p.URLPath, id)
+			return genRsp(http.StatusBadRequest, "need seq", nil)
+		}
+
+		dbs := gCfg.MgoSess.Clone()
+		defer dbs.Close()
+		db := dbs.DB(p.GetDbName(query))
+		dbc := db.C(p.GetTableName(query))
+
+		var rev revision
+		err = db.C(p.revisionTable(query)).Find(bson.M{"doc_id": id, "seq": req.Seq}).One(&rev)
+		if err != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__revert get revision seq=%v error, %v", reqID, p.URLPath, id, req.Seq, err)
+			if err == mgo.ErrNotFound {
+				return genRsp(http.StatusNotFound, "revision not found", nil)
+			}
+			return genRsp(http.StatusInternalServerError, "db access fail", nil)
+		}
+
+		var old map[string]interface{}
+		err = dbc.Find(p.liveSelector(bson.M{"_id": id})).One(&old)
+		if err != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__revert get id=%s error, %v", reqID, p.URLPath, id, id, err)
+			if err == mgo.ErrNotFound {
+				return genRsp(http.StatusNotFound, "id not found", nil)
+			}
+			return genRsp(http.StatusInternalServerError, "db access fail", nil)
+		}
+		// If-Match: "seq"
+		if len(query["if_match"]) > 0 && !matchIfMatch(query, GetString(old["seq"])) {
+			Log.Warnf("[rsp] %v POST %v/%v/__revert seq conflict", reqID, p.URLPath, id)
+			return genRsp(http.StatusPreconditionFailed, "seq conflict", nil)
+		}
+		seq := old["seq"]
+		if _, err = p.FieldSet.Migrate(old); err != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__revert %v", reqID, p.URLPath, id, err)
+			return genRsp(http.StatusInternalServerError, "migrate fail", nil)
+		}
+		p.FieldSet.apiNames(old)
+
+		// restored as a new write checked as PUT, internal fields are set again,
+		// passwords and read only fields keep the values stored
+		info := rev.Doc
+		if _, err = p.FieldSet.Migrate(info); err != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__revert revision seq=%v %v", reqID, p.URLPath, id, req.Seq, err)
+			return genRsp(http.StatusInternalServerError, "revision migrate fail", nil)
+		}
+		p.FieldSet.apiNames(info)
+		delete(info, "_id")
+		for _, field := range internalFields {
+			delete(info, field)
+		}
+		for _, field := range append(append([]string{}, p.PasswordFields...), p.ReadOnlyFields...) {
+			removePath(info, field)
+		}
+		info["id"] = id
+		if err = p.checkReplaceRoles(query, info, old); err != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__revert %v", reqID, p.URLPath, id, err)
+			return genRsp(http.StatusForbidden, err.Error(), nil)
+		}
+		if err = p.ApplyProfile(query, info, true); err != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__revert profile check fail, err=%v", reqID, p.URLPath, id, err)
+			return genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+		p.keepRestricted(query, info, old)
+		if err = p.ValidateCreate(info); err != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__revert invalid field exists, biz=%v err=%v", reqID, p.URLPath, id, p.Biz, err)
+			return genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+		for _, field := range p.ReadOnlyFields {
+			if _, ok := lookupPath(info, field); ok {
+				continue
+			}
+			if v, ok := lookupPath(old, field); ok {
+				setPath(info, field, copyValue(v))
+			}
+		}
+		// conditions checked atomically with the write
+		guard := &writeGuard{}
+		if errRsp := p.checkImmutable(dbc, id, info, nil, true, guard); errRsp != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__revert %v", reqID, p.URLPath, id, errRsp.Msg)
+			return errRsp
+		}
+		if errRsp := p.validateDocument(old, info); errRsp != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__revert invalid doc, err=%v", reqID, p.URLPath, id, errRsp.Msg)
+			return errRsp
+		}
+		ApplyInternalFields(info, old)
+		p.keepPasswords(info, old)
+		p.applySchemaVersion(info)
+
+		doc := p.FieldSet.InSort(&info)
+		err = p.applyWrite(query, dbc, guard.selector(p.liveSelector(bson.M{"_id": id, "seq": seq})), &doc, false)
+		if err != nil {
+			Log.Warnf("[rsp] %v POST %v/%v/__revert db access fail, err=%v", reqID, p.URLPath, id, err)
+			if err == mgo.ErrNotFound {
+				if reason := guard.failure(dbc, id); reason != "" {
+					return genRsp(http.StatusConflict, reason, nil)
+				}
+				return genRsp(http.StatusPreconditionFailed, "seq conflict", nil)
+			}
+			if field := p.duplicateField(err); field != "" {
+				return genRsp(http.StatusConflict, "duplicate "+field, nil)
+			}
+			return genRsp(http.StatusInternalServerError, "db access fail", nil)
+		}
+
+		p.writeDone("PUT", vars, query, info)
+
+		costMs := time.Since(begin).Nanoseconds() / int64(time.Millisecond)
+		Log.Warnf("[rsp] %v success, cost %vms", reqID, costMs)
+		return genRsp(http.StatusOK, "revert ok", map[string]interface{}{"id": id, "seq": info["seq"]})
+	}
+}
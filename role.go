@@ -0,0 +1,178 @@
+package restful
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// setRoles sets the roles of caller by GlobalConfig.GetRoles as URL Query 'roles'
+// roles sent by client are always dropped, as they grant access to fields
+func setRoles(r *http.Request, query url.Values) {
+	query.Del("roles")
+	if gCfg.GetRoles == nil {
+		return
+	}
+	for _, role := range gCfg.GetRoles(r) {
+		query.Add("roles", role)
+	}
+}
+
+// hasRole check the caller of request has one of roles or not
+func hasRole(query url.Values, roles []string) bool {
+	for _, role := range query["roles"] {
+		for _, allowed := range roles {
+			if role == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkFieldReadRoles check the fields of Processor.FieldReadRoles when init
+func (p *Processor) checkFieldReadRoles(report *InitReport) {
+	for field := range p.FieldReadRoles {
+		if _, ok := p.FieldSet.FMap[field]; !ok || field == "id" {
+			report.Add(p.Biz, "field read roles field %s invalid", field)
+		}
+	}
+}
+
+// redactFields removes the fields the caller has no role to read from docs rendered,
+// and masks MaskedFields if MaskResponses
+func (p *Processor) redactFields(query url.Values, docs []interface{}) {
+	for field, roles := range p.FieldReadRoles {
+		if hasRole(query, roles) {
+			continue
+		}
+		for _, doc := range docs {
+			removePath(doc, field)
+		}
+	}
+	if p.MaskResponses {
+		for _, field := range p.MaskedFields {
+			for _, doc := range docs {
+				maskPath(doc, field)
+			}
+		}
+	}
+}
+
+// isFieldReadable check the caller can read the field or not, neither hidden nor restricted by Processor.FieldReadRoles,
+// a field containing restricted members is not readable as a whole
+func (p *Processor) isFieldReadable(query url.Values, field string) bool {
+	if p.FieldSet.IsFieldHidden(field) {
+		return false
+	}
+	for restricted, roles := range p.FieldReadRoles {
+		if field != restricted && !strings.HasPrefix(field, restricted+".") && !strings.HasPrefix(restricted, field+".") {
+			continue
+		}
+		if !hasRole(query, roles) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkFieldWriteRoles check the fields of Processor.FieldWriteRoles when init
+func (p *Processor) checkFieldWriteRoles(report *InitReport) {
+	for field := range p.FieldWriteRoles {
+		if _, ok := p.FieldSet.FMap[field]; !ok || field == "id" {
+			report.Add(p.Biz, "field write roles field %s invalid", field)
+		}
+	}
+}
+
+// restrictedSelector get the selector of fields the caller has no role to write, read from the doc stored before replacing it
+func (p *Processor) restrictedSelector(query url.Values, selector bson.M) bson.M {
+	for field, roles := range p.FieldWriteRoles {
+		if !hasRole(query, roles) {
+			selector[p.FieldSet.storageField(field)] = 1
+		}
+	}
+	return selector
+}
+
+// keepRestricted keeps the values stored of fields the caller has no role to write in info replacing the doc,
+// or the caller erases them by leaving them out, info and old are by names in API
+func (p *Processor) keepRestricted(query url.Values, info map[string]interface{}, old map[string]interface{}) {
+	for field, roles := range p.FieldWriteRoles {
+		if hasRole(query, roles) {
+			continue
+		}
+		removePath(info, field)
+		if v, ok := lookupPath(old, field); ok {
+			setPath(info, field, copyValue(v))
+		}
+	}
+}
+
+// checkReplaceRoles checks the caller has roles to write the fields changed by info replacing old,
+// for docs not from the caller as a whole like revisions reverted, fields absent in info are not changed,
+// info and old are by names in API
+func (p *Processor) checkReplaceRoles(query url.Values, info map[string]interface{}, old map[string]interface{}) error {
+	changed := make(map[string]interface{})
+	for field := range p.FieldWriteRoles {
+		v, ok := lookupPath(info, field)
+		if !ok {
+			continue
+		}
+		if stored, ok := lookupPath(old, field); !ok || !sameValue(stored, v) {
+			changed[field] = v
+		}
+	}
+	return p.CheckWriteRoles(query, changed)
+}
+
+// isFieldWritten check the field or its members are written by info or not
+// keys of info can be paths like a.b as PATCH
+func isFieldWritten(info map[string]interface{}, field string) bool {
+	if _, ok := lookupPath(info, field); ok {
+		return true
+	}
+	for k := range info {
+		if strings.HasPrefix(k, field+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckWriteRoles checks the caller has roles to write the fields in info by Processor.FieldWriteRoles
+// info is the body of POST or PUT, or the fields of an update operator of PATCH
+func (p *Processor) CheckWriteRoles(query url.Values, info map[string]interface{}) error {
+	denied := make([]string, 0)
+	for field, roles := range p.FieldWriteRoles {
+		if !hasRole(query, roles) && isFieldWritten(info, field) {
+			denied = append(denied, field)
+		}
+	}
+	if len(denied) > 0 {
+		sort.Strings(denied)
+		return fmt.Errorf("no role to write fields %v", denied)
+	}
+	return nil
+}
+
+// checkUpdateRoles checks the caller has roles to write the fields of all update operators of PATCH
+func (p *Processor) checkUpdateRoles(query url.Values, update map[string]interface{}) error {
+	for _, v := range update {
+		switch fields := v.(type) {
+		case map[string]interface{}:
+			if err := p.CheckWriteRoles(query, fields); err != nil {
+				return err
+			}
+		case bson.M:
+			if err := p.CheckWriteRoles(query, fields); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package restful
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// max size of random sample
+const sampleMaxSize = 1000
+
+func (p *Processor) defaultSample() Handler {
+	return func(vars map[string]string, query url.Values, body []byte) *Rsp {
+		begin := time.Now()
+		reqID := query.Get("reqid")
+		if reqID == "" {
+			reqID = "sys_" + RandString(8)
+		}
+		Log.Debugf("[req] %v GET %v/__sample query=%v", reqID, p.URLPath, query)
+
+		size, err := strconv.Atoi(query.Get("size"))
+		if err != nil || size <= 0 || size > sampleMaxSize {
+			Log.Warnf("[rsp] %v GET %v/__sample size error", reqID, p.URLPath)
+			return genRsp(http.StatusBadRequest, "need size or size invalid", nil)
+		}
+
+		condition, empty, errRsp := p.buildCondition(reqID, query)
+		if errRsp != nil {
+			return errRsp
+		}
+		if err := p.checkIndexedQuery(condition, nil); err != nil {
+			Log.Warnf("[rsp] %v GET %v/__sample %v", reqID, p.URLPath, err)
+			return genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+		if empty {
+			infos := make([]interface{}, 0)
+			return genRsp(http.StatusOK, "no results found", RspGetPageData{Total: 0, Hits: infos})
+		}
+
+		pipeline := []bson.M{{"$match": countCondition(condition)}, {"$sample": bson.M{"size": size}}}
+		if query.Get("select") != "" {
+			var selSlice []string
+			err := json.Unmarshal([]byte(query.Get("select")), &selSlice)
+			if err != nil {
+				Log.Warnf("[rsp] %v GET %v/__sample unmarshal select error: %v", reqID, p.URLPath, err)
+				return genRsp(http.StatusBadRequest, "select invalid", nil)
+			}
+			selector := make(map[string]interface{})
+			err = p.FieldSet.BuildSelectObj(selSlice, selector)
+			if err != nil {
+				Log.Warnf("[rsp] %v GET %v/__sample select param invalid, %v", reqID, p.URLPath, err)
+				return genRsp(http.StatusBadRequest, err.Error(), nil)
+			}
+			p.FieldSet.InReplace(&selector)
+			pipeline = append(pipeline, bson.M{"$project": selector})
+		} else {
+			p.FieldSet.recordRead(nil)
+		}
+		Log.Debugf("[req] %v pipeline=%v", reqID, pipeline)
+
+		dbs := readSession()
+		defer dbs.Close()
+		dbc := dbs.DB(p.GetDbName(query)).C(p.GetTableName(query))
+
+		var infos []interface{}
+		err = limitRegexPipe(dbc.Pipe(pipeline), pipeline).All(&infos)
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v/__sample error: %v", reqID, p.URLPath, err)
+			return genRsp(http.StatusInternalServerError, "db access fail", nil)
+		}
+		if infos == nil {
+			infos = make([]interface{}, 0)
+		}
+		if err = p.FieldSet.OutReplaceArray(infos); err != nil {
+			Log.Warnf("[rsp] %v GET %v/__sample %v", reqID, p.URLPath, err)
+			return genRsp(http.StatusInternalServerError, "migrate fail", nil)
+		}
+		p.redactFields(query, infos)
+		if isExtJSON(query) {
+			infos = ToExtJSON(infos).([]interface{})
+		}
+
+		costMs := time.Since(begin).Nanoseconds() / int64(time.Millisecond)
+		Log.Warnf("[rsp] %v success, cost %vms", reqID, costMs)
+		return genRsp(http.StatusOK, "sample ok", RspGetPageData{Total: int64(len(infos)), Hits: infos})
+	}
+}
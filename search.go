@@ -0,0 +1,171 @@
+package restful
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// RspSearchGroup is the hits of a Processor in `data` field for global search request
+type RspSearchGroup struct {
+	Biz  string        `json:"biz"`
+	IDs  []string      `json:"ids"`
+	Hits []interface{} `json:"hits,omitempty"`
+}
+
+// RspSearchData is a general returning structure in `data` field for global search request
+type RspSearchData struct {
+	Total  int64            `json:"total"`
+	Groups []RspSearchGroup `json:"groups"`
+}
+
+// globalSearch searches across Processors by es
+// e.g.: /__search?q=hello&bizs=["movie","book"]&page=1&size=20&hydrate=true
+func globalSearch() Handler {
+	return func(vars map[string]string, query url.Values, body []byte) *Rsp {
+		begin := time.Now()
+		reqID := query.Get("reqid")
+		if reqID == "" {
+			reqID = "sys_" + RandString(8)
+		}
+		Log.Debugf("[req] %v GET /__search query=%v", reqID, query)
+
+		search := query.Get("q")
+		if search == "" {
+			Log.Warnf("[rsp] %v GET /__search need q", reqID)
+			return genRsp(http.StatusBadRequest, "need q", nil)
+		}
+
+		size := 20
+		if query.Get("size") != "" {
+			var err error
+			size, err = strconv.Atoi(query.Get("size"))
+			if err != nil || size <= 0 || size > 2000 {
+				Log.Warnf("[rsp] %v GET /__search size error", reqID)
+				return genRsp(http.StatusBadRequest, "size invalid", nil)
+			}
+		}
+		page := 1
+		if query.Get("page") != "" {
+			var err error
+			page, err = strconv.Atoi(query.Get("page"))
+			if err != nil || page <= 0 {
+				Log.Warnf("[rsp] %v GET /__search page error", reqID)
+				return genRsp(http.StatusBadRequest, "page invalid", nil)
+			}
+		}
+
+		// processors to search
+		processors := make([]*Processor, 0)
+		if query.Get("bizs") != "" {
+			var bizs []string
+			err := json.Unmarshal([]byte(query.Get("bizs")), &bizs)
+			if err != nil {
+				Log.Warnf("[rsp] %v GET /__search unmarshal bizs error: %v", reqID, err)
+				return genRsp(http.StatusBadRequest, "bizs invalid", nil)
+			}
+			for _, biz := range RemoveDupArray(bizs) {
+				p, ok := gProcessors[biz]
+				if !ok || len(p.SearchFields) == 0 {
+					Log.Warnf("[rsp] %v GET /__search biz %v not searchable", reqID, biz)
+					return genRsp(http.StatusBadRequest, "biz "+biz+" not searchable", nil)
+				}
+				processors = append(processors, p)
+			}
+		} else {
+			for _, p := range gProcessors {
+				if len(p.SearchFields) > 0 {
+					processors = append(processors, p)
+				}
+			}
+		}
+		if len(processors) == 0 {
+			Log.Warnf("[rsp] %v GET /__search no biz searchable", reqID)
+			return genRsp(http.StatusBadRequest, "no biz searchable", nil)
+		}
+
+		tables := make([]esTable, 0, len(processors))
+		tableMap := make(map[esTable]*Processor)
+		for _, p := range processors {
+			t := esTable{Db: p.GetDbName(query), Table: p.GetTableName(query)}
+			tables = append(tables, t)
+			tableMap[t] = p
+		}
+		hits, total, err := esSearchTables(tables, search, size, size*(page-1))
+		if err != nil {
+			Log.Warnf("[rsp] %v GET /__search EsSearch err, %v", reqID, err)
+			return genRsp(http.StatusInternalServerError, err.Error(), nil)
+		}
+
+		// group hits by processor, keep the order of relevance
+		groups := make([]RspSearchGroup, 0)
+		groupIdx := make(map[string]int)
+		for _, hit := range hits {
+			p, ok := tableMap[esTable{Db: hit.Db, Table: hit.Table}]
+			if !ok {
+				continue
+			}
+			i, ok := groupIdx[p.Biz]
+			if !ok {
+				i = len(groups)
+				groupIdx[p.Biz] = i
+				groups = append(groups, RspSearchGroup{Biz: p.Biz, IDs: make([]string, 0)})
+			}
+			groups[i].IDs = append(groups[i].IDs, hit.ID)
+		}
+
+		if strings.ToLower(query.Get("hydrate")) == "true" && len(groups) > 0 {
+			dbs := readSession()
+			defer dbs.Close()
+			for i := range groups {
+				p := gProcessors[groups[i].Biz]
+				selector := make(map[string]interface{})
+				err = p.FieldSet.BuildSelectObj(p.SearchSummaryFields, selector)
+				if err != nil {
+					Log.Warnf("[rsp] %v GET /__search biz %v select invalid, %v", reqID, p.Biz, err)
+					return genRsp(http.StatusInternalServerError, err.Error(), nil)
+				}
+				p.FieldSet.InReplace(&selector)
+				dbc := dbs.DB(p.GetDbName(query)).C(p.GetTableName(query))
+				var infos []interface{}
+				// soft-deleted docs stale in es are not hits
+				err = dbc.Find(p.liveSelector(bson.M{"_id": bson.M{"$in": groups[i].IDs}})).Select(selector).All(&infos)
+				if err != nil {
+					Log.Warnf("[rsp] %v GET /__search biz %v get summary error: %v", reqID, p.Biz, err)
+					return genRsp(http.StatusInternalServerError, "db access fail", nil)
+				}
+				if err = p.FieldSet.OutReplaceArray(infos); err != nil {
+					Log.Warnf("[rsp] %v GET /__search biz %v %v", reqID, p.Biz, err)
+					return genRsp(http.StatusInternalServerError, "migrate fail", nil)
+				}
+				p.redactFields(query, infos)
+				p.auditReads(reqID, query, infos)
+				infoMap := make(map[string]interface{})
+				for _, info := range infos {
+					if m, ok := info.(bson.M); ok {
+						infoMap[GetString(m["id"])] = m
+					}
+				}
+				// ids not read are dropped
+				ids := make([]string, 0, len(infos))
+				groups[i].Hits = make([]interface{}, 0, len(infos))
+				for _, id := range groups[i].IDs {
+					if info, ok := infoMap[id]; ok {
+						ids = append(ids, id)
+						groups[i].Hits = append(groups[i].Hits, info)
+					}
+				}
+				groups[i].IDs = ids
+			}
+		}
+
+		costMs := time.Since(begin).Nanoseconds() / int64(time.Millisecond)
+		Log.Warnf("[rsp] %v success, cost %vms", reqID, costMs)
+		return genRsp(http.StatusOK, "search ok", RspSearchData{Total: total, Groups: groups})
+	}
+}
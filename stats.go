@@ -0,0 +1,145 @@
+package restful
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// window in seconds of the recent rate of requests
+const rateWindow = 60
+
+// RspStatsData is the returning structure in `data` field of GET /{biz}/__stats
+type RspStatsData struct {
+	Count            int64            `json:"count"`                       // docs count
+	Size             int64            `json:"size"`                        // bytes of docs uncompressed
+	StorageSize      int64            `json:"storage_size"`                // bytes of storage allocated
+	AvgObjSize       int64            `json:"avg_obj_size"`                // average bytes of a doc
+	TotalIndexSize   int64            `json:"total_index_size"`            // bytes of all indexes
+	IndexSizes       map[string]int64 `json:"index_sizes"`                 // bytes of each index, key: index name
+	Reads            RateStat         `json:"reads"`                       // GET, HEAD and count requests served
+	Writes           RateStat         `json:"writes"`                      // POST, PUT, PATCH and DELETE requests served
+	DeprecatedWrites map[string]int64 `json:"deprecated_writes,omitempty"` // writes of each deprecated field
+}
+
+// RateStat is the requests observed by the package since started
+type RateStat struct {
+	Total  int64   `json:"total"`  // requests since started
+	Rate   float64 `json:"rate"`   // average requests per second since started
+	Recent float64 `json:"recent"` // requests per second in the last minute
+}
+
+// rateCounter counts requests in total and in slots of recent seconds
+type rateCounter struct {
+	sync.Mutex
+	begin int64
+	total int64
+	slots [rateWindow]int64
+	secs  [rateWindow]int64
+}
+
+func newRateCounter() *rateCounter {
+	return &rateCounter{begin: time.Now().Unix()}
+}
+
+func (c *rateCounter) add() {
+	now := time.Now().Unix()
+	i := now % rateWindow
+	c.Lock()
+	defer c.Unlock()
+	if c.secs[i] != now {
+		c.secs[i] = now
+		c.slots[i] = 0
+	}
+	c.slots[i]++
+	c.total++
+}
+
+func (c *rateCounter) stat() RateStat {
+	now := time.Now().Unix()
+	c.Lock()
+	defer c.Unlock()
+	recent := int64(0)
+	for i := range c.slots {
+		if now-c.secs[i] < rateWindow {
+			recent += c.slots[i]
+		}
+	}
+	elapsed := now - c.begin
+	if elapsed <= 0 {
+		elapsed = 1
+	}
+	window := int64(rateWindow)
+	if elapsed < window {
+		window = elapsed
+	}
+	return RateStat{
+		Total:  c.total,
+		Rate:   float64(c.total) / float64(elapsed),
+		Recent: float64(recent) / float64(window),
+	}
+}
+
+// rateHandler counts the requests served successfully
+func (p *Processor) rateHandler(h Handler, write bool) Handler {
+	counter := p.reads
+	if write {
+		counter = p.writes
+	}
+	return func(vars map[string]string, query url.Values, body []byte) *Rsp {
+		rsp := h(vars, query, body)
+		if rsp != nil && rsp.Code < http.StatusBadRequest {
+			counter.add()
+		}
+		return rsp
+	}
+}
+
+func (p *Processor) defaultStats() Handler {
+	return func(vars map[string]string, query url.Values, body []byte) *Rsp {
+		begin := time.Now()
+		reqID := query.Get("reqid")
+		if reqID == "" {
+			reqID = "sys_" + RandString(8)
+		}
+		Log.Debugf("[req] %v GET %v/__stats query=%v", reqID, p.URLPath, query)
+
+		dbs := readSession()
+		defer dbs.Close()
+
+		var result struct {
+			Count          int64            `bson:"count"`
+			Size           int64            `bson:"size"`
+			StorageSize    int64            `bson:"storageSize"`
+			AvgObjSize     int64            `bson:"avgObjSize"`
+			TotalIndexSize int64            `bson:"totalIndexSize"`
+			IndexSizes     map[string]int64 `bson:"indexSizes"`
+		}
+		err := dbs.DB(p.GetDbName(query)).Run(bson.D{{Name: "collStats", Value: p.GetTableName(query)}}, &result)
+		if err != nil {
+			Log.Warnf("[rsp] %v GET %v/__stats db access fail, err=%v", reqID, p.URLPath, err)
+			return genRsp(http.StatusInternalServerError, "db access fail", nil)
+		}
+		data := RspStatsData{
+			Count:            result.Count,
+			Size:             result.Size,
+			StorageSize:      result.StorageSize,
+			AvgObjSize:       result.AvgObjSize,
+			TotalIndexSize:   result.TotalIndexSize,
+			IndexSizes:       result.IndexSizes,
+			Reads:            p.reads.stat(),
+			Writes:           p.writes.stat(),
+			DeprecatedWrites: p.DeprecatedWrites(),
+		}
+		if data.IndexSizes == nil {
+			data.IndexSizes = make(map[string]int64)
+		}
+
+		costMs := time.Since(begin).Nanoseconds() / int64(time.Millisecond)
+		Log.Warnf("[rsp] %v success, cost %vms", reqID, costMs)
+		return genRsp(http.StatusOK, "get stats ok", data)
+	}
+}
@@ -0,0 +1,122 @@
+package restful
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/mux"
+)
+
+// docs fetched in one batch of cursor when streaming GET list
+const streamBatchSize = 500
+
+// isNDJSONPage matches GET list of all docs accepting NDJSON, e.g.:
+// GET /{biz}?size=-1 with header Accept: application/x-ndjson
+func isNDJSONPage(r *http.Request, rm *mux.RouteMatch) bool {
+	if r.URL.Query().Get("size") != "-1" {
+		return false
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if i := strings.Index(accept, ";"); i >= 0 {
+			accept = accept[:i]
+		}
+		if strings.TrimSpace(accept) == "application/x-ndjson" {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultStreamPage streams all docs matched one per line from a batched cursor,
+// instead of materializing them in memory like GET list
+func (p *Processor) defaultStreamPage() StreamHandler {
+	return func(vars map[string]string, query url.Values, r *http.Request, w http.ResponseWriter) *Rsp {
+		begin := time.Now()
+		reqID := query.Get("reqid")
+		if reqID == "" {
+			reqID = "sys_" + RandString(8)
+		}
+		Log.Debugf("[req] %v GET STREAM %v query=%v", reqID, p.URLPath, query)
+
+		if maxSize := p.getMaxPageSize(); maxSize > 0 && !p.AllowAllPage {
+			Log.Warnf("[rsp] %v GET %v size -1 not allowed", reqID, p.URLPath)
+			return genRsp(http.StatusBadRequest, fmt.Sprintf("size -1 not allowed, max size %d", maxSize), nil)
+		}
+		for _, param := range []string{"after", "summary", "expand"} {
+			if query.Get(param) != "" {
+				Log.Warnf("[rsp] %v GET %v %v with ndjson", reqID, p.URLPath, param)
+				return genRsp(http.StatusBadRequest, param+" not support when streaming ndjson", nil)
+			}
+		}
+
+		condition, empty, errRsp := p.buildCondition(reqID, query)
+		if errRsp != nil {
+			return errRsp
+		}
+		sort, errRsp := p.buildSort(reqID, query, false)
+		if errRsp != nil {
+			return errRsp
+		}
+		if err := p.checkIndexedQuery(condition, sort); err != nil {
+			Log.Warnf("[rsp] %v GET %v %v", reqID, p.URLPath, err)
+			return genRsp(http.StatusBadRequest, err.Error(), nil)
+		}
+		orderFields := p.FieldSet.OrderArray2Slice(&sort)
+		selector, errRsp := p.buildSelector(reqID, query)
+		if errRsp != nil {
+			return errRsp
+		}
+		Log.Debugf("[req] %v condition=%v order=%v select=%v", reqID, condition, orderFields, selector)
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		flusher, _ := w.(http.Flusher)
+		extJSON := isExtJSON(query)
+
+		count := 0
+		if !empty {
+			dbs := readSession()
+			defer dbs.Close()
+			dbc := dbs.DB(p.GetDbName(query)).C(p.GetTableName(query))
+
+			iter := limitRegex(dbc.Find(condition), condition).Collation(p.getCollation(query)).Sort(orderFields...).Select(selector).Batch(streamBatchSize).Iter()
+			var doc bson.M
+			for iter.Next(&doc) {
+				info := map[string]interface{}(doc)
+				if err := p.FieldSet.OutReplace(&info); err != nil {
+					// body is partially written, can only be logged
+					Log.Warnf("[rsp] %v GET %v stream stopped after %d docs: %v", reqID, p.URLPath, count, err)
+					break
+				}
+				p.redactFields(query, []interface{}{info})
+				p.auditReads(reqID, query, []interface{}{info})
+				var line []byte
+				if extJSON {
+					line, _ = json.Marshal(ToExtJSON(info))
+				} else {
+					line, _ = json.Marshal(info)
+				}
+				w.Write(append(line, '\n'))
+				count++
+				if count%streamBatchSize == 0 && flusher != nil {
+					flusher.Flush()
+				}
+				doc = nil
+			}
+			if err := iter.Close(); err != nil {
+				// body is partially written, can only be logged
+				Log.Warnf("[rsp] %v GET %v stream iter error after %d docs: %v", reqID, p.URLPath, count, err)
+			}
+		}
+		p.reads.add()
+
+		costMs := time.Since(begin).Nanoseconds() / int64(time.Millisecond)
+		Log.Warnf("[rsp] %v success, %d docs streamed, cost %vms", reqID, count, costMs)
+		return nil
+	}
+}
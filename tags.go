@@ -0,0 +1,297 @@
+package restful
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Constraints of fields declared by `restful` tag of DataStruct, e.g.:
+//   Age   int     `json:"age" restful:"min=0,max=150"`
+//   Score float64 `json:"score" restful:"min=0"`
+//   Name  string  `json:"name" restful:"minlen=1,maxlen=32,pattern=^[a-z][a-z0-9_]*$"`
+//   State string  `json:"state" restful:"enum=draft|published|archived"`
+//   Email string  `json:"email" restful:"trim,lower"`
+//   Tags  []string `json:"tags" restful:"maxitems=20,maxlen=32"`
+// constraints on int, uint, float or string fields also apply to elements of array or map of them
+// minlen and maxlen of binary fields are sizes in bytes
+// minitems and maxitems of array fields are numbers of elements, also checked for $push, $addToSet and $pull of PATCH
+// pattern takes the rest of tag as regexp, so it should be the last one
+// normalization directives trim, lower and collapse rewrite string values before constraints checked
+
+// parseFieldTag parse the `restful` tag of the field at path into its Field
+func (fs *FieldSet) parseFieldTag(path string, tag string) {
+	f, ok := fs.FMap[path]
+	if !ok || tag == "" {
+		return
+	}
+	items := strings.Split(tag, ",")
+	for i := 0; i < len(items); i++ {
+		item := strings.TrimSpace(items[i])
+		if item == "" {
+			continue
+		}
+		key, value := item, ""
+		if j := strings.Index(item, "="); j >= 0 {
+			key, value = item[:j], item[j+1:]
+		}
+		if key == "pattern" {
+			// regexp may contain commas
+			value = strings.Join(append([]string{value}, items[i+1:]...), ",")
+			i = len(items)
+		}
+		if key == "store" {
+			// storage name, see names.go
+			if err := fs.setStore(path, value); err != nil {
+				fs.tagErrors = append(fs.tagErrors, fmt.Sprintf("field %s tag %s", path, err.Error()))
+			}
+			continue
+		}
+		if err := f.setTag(key, value); err != nil {
+			fs.tagErrors = append(fs.tagErrors, fmt.Sprintf("field %s tag %s", path, err.Error()))
+		}
+	}
+	if f.Min != nil && f.Max != nil && *f.Min > *f.Max {
+		fs.tagErrors = append(fs.tagErrors, fmt.Sprintf("field %s tag min greater than max", path))
+	}
+	if f.MinLen != nil && f.MaxLen != nil && *f.MinLen > *f.MaxLen {
+		fs.tagErrors = append(fs.tagErrors, fmt.Sprintf("field %s tag minlen greater than maxlen", path))
+	}
+	if f.MinItems != nil && f.MaxItems != nil && *f.MinItems > *f.MaxItems {
+		fs.tagErrors = append(fs.tagErrors, fmt.Sprintf("field %s tag minitems greater than maxitems", path))
+	}
+	fs.FMap[path] = f
+}
+
+// setTag set a constraint of `restful` tag
+func (f *Field) setTag(key, value string) error {
+	switch key {
+	case "min", "max":
+		if !isNumberKind(elemKind(f.Kind)) {
+			return fmt.Errorf("%s only for int, uint or float", key)
+		}
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%s %s not number", key, value)
+		}
+		if key == "min" {
+			f.Min = &n
+		} else {
+			f.Max = &n
+		}
+	case "minlen", "maxlen":
+		if elemKind(f.Kind) != KindString && f.Kind != KindBinary {
+			return fmt.Errorf("%s only for string or binary", key)
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("%s %s not non-negative int", key, value)
+		}
+		if key == "minlen" {
+			f.MinLen = &n
+		} else {
+			f.MaxLen = &n
+		}
+	case "minitems", "maxitems":
+		if f.Kind <= KindArrayBase || f.Kind >= KindArrayEnd {
+			return fmt.Errorf("%s only for array", key)
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("%s %s not non-negative int", key, value)
+		}
+		if key == "minitems" {
+			f.MinItems = &n
+		} else {
+			f.MaxItems = &n
+		}
+	case "pattern":
+		if elemKind(f.Kind) != KindString {
+			return fmt.Errorf("%s only for string", key)
+		}
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return fmt.Errorf("%s %s invalid", key, value)
+		}
+		f.Pattern = re
+	case "enum":
+		kind := elemKind(f.Kind)
+		if kind != KindString && kind != KindInt && kind != KindUint {
+			return fmt.Errorf("%s only for string, int or uint", key)
+		}
+		f.Enum = make([]interface{}, 0)
+		for _, elem := range strings.Split(value, "|") {
+			if kind == KindString {
+				f.Enum = append(f.Enum, elem)
+				continue
+			}
+			n, err := strconv.ParseInt(elem, 10, 64)
+			if err != nil || (kind == KindUint && n < 0) {
+				return fmt.Errorf("%s %s not %s", key, elem, KindName(kind))
+			}
+			f.Enum = append(f.Enum, n)
+		}
+	case "trim", "lower", "collapse":
+		if elemKind(f.Kind) != KindString {
+			return fmt.Errorf("%s only for string", key)
+		}
+		switch key {
+		case "trim":
+			f.Trim = true
+		case "lower":
+			f.Lower = true
+		case "collapse":
+			f.Collapse = true
+		}
+	default:
+		return fmt.Errorf("%s unknown", key)
+	}
+	return nil
+}
+
+// CheckFieldTags check the `restful` tags of DataStruct parsed ok or not
+func (fs *FieldSet) CheckFieldTags() error {
+	errs := append(append([]string{}, fs.tagErrors...), fs.checkStores()...)
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// elemKind get the kind of elements of array or map, or the kind itself
+func elemKind(kind uint) uint {
+	switch {
+	case kind > KindArrayBase && kind < KindArrayEnd:
+		return kind - KindArrayBase
+	case kind > KindMapBase && kind < KindMapEnd:
+		return kind - KindMapBase
+	}
+	return kind
+}
+
+// isNumberKind check the kind is int, uint or float or not
+func isNumberKind(kind uint) bool {
+	return kind == KindInt || kind == KindUint || kind == KindFloat
+}
+
+// checkConstraint check the value parsed by kind meets the constraints of field
+// return the reason if not, empty if ok
+func (f Field) checkConstraint(value interface{}) string {
+	switch v := value.(type) {
+	case []byte:
+		if f.MinLen != nil && len(v) < *f.MinLen {
+			return fmt.Sprintf("size %d less than minlen %d", len(v), *f.MinLen)
+		}
+		if f.MaxLen != nil && len(v) > *f.MaxLen {
+			return fmt.Sprintf("size %d greater than maxlen %d", len(v), *f.MaxLen)
+		}
+		return ""
+	case []interface{}:
+		if f.MinItems != nil && len(v) < *f.MinItems {
+			return fmt.Sprintf("items %d less than minitems %d", len(v), *f.MinItems)
+		}
+		if f.MaxItems != nil && len(v) > *f.MaxItems {
+			return fmt.Sprintf("items %d greater than maxitems %d", len(v), *f.MaxItems)
+		}
+		for i, elem := range v {
+			if reason := f.checkConstraint(elem); reason != "" {
+				return fmt.Sprintf("element %d %s", i, reason)
+			}
+		}
+		return ""
+	case map[string]interface{}:
+		if f.Kind > KindMapBase && f.Kind < KindMapEnd {
+			for k, elem := range v {
+				if reason := f.checkConstraint(elem); reason != "" {
+					return fmt.Sprintf("key %s %s", k, reason)
+				}
+			}
+		}
+		return ""
+	}
+	if str, ok := value.(string); ok && elemKind(f.Kind) == KindString {
+		n := StringLength(str)
+		if f.MinLen != nil && n < *f.MinLen {
+			return fmt.Sprintf("length %d less than minlen %d", n, *f.MinLen)
+		}
+		if f.MaxLen != nil && n > *f.MaxLen {
+			return fmt.Sprintf("length %d greater than maxlen %d", n, *f.MaxLen)
+		}
+		if f.Pattern != nil && !f.Pattern.MatchString(str) {
+			return fmt.Sprintf("%q not match pattern %s", str, f.Pattern.String())
+		}
+		return f.checkEnum(str)
+	}
+	if n := CheckFloat(value); n != nil && isNumberKind(elemKind(f.Kind)) {
+		if f.Min != nil && n.(float64) < *f.Min {
+			return fmt.Sprintf("%v less than min %v", value, *f.Min)
+		}
+		if f.Max != nil && n.(float64) > *f.Max {
+			return fmt.Sprintf("%v greater than max %v", value, *f.Max)
+		}
+		return f.checkEnum(n)
+	}
+	return ""
+}
+
+// checkEnum check the string, or number as float64, is one of enum values
+func (f Field) checkEnum(value interface{}) string {
+	if f.Enum == nil {
+		return ""
+	}
+	for _, elem := range f.Enum {
+		if n, ok := elem.(int64); ok {
+			elem = float64(n)
+		}
+		if elem == value {
+			return ""
+		}
+	}
+	return fmt.Sprintf("%v not in enum %v", value, f.Enum)
+}
+
+// patternString get the regexp of pattern, empty if nil
+func patternString(re *regexp.Regexp) string {
+	if re == nil {
+		return ""
+	}
+	return re.String()
+}
+
+// spaces collapsed into one
+var spacesRegexp = regexp.MustCompile(`\s+`)
+
+// normalize rewrite the string value, or strings in array or map value, by normalization directives of field
+// trim leading and trailing whitespace, collapse whitespace runs into one space, then lowercase
+func (f Field) normalize(value interface{}) interface{} {
+	if !f.Trim && !f.Lower && !f.Collapse {
+		return value
+	}
+	switch v := value.(type) {
+	case string:
+		if f.Trim {
+			v = strings.TrimSpace(v)
+		}
+		if f.Collapse {
+			v = spacesRegexp.ReplaceAllString(v, " ")
+		}
+		if f.Lower {
+			v = strings.ToLower(v)
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = f.normalize(v[i])
+		}
+		return v
+	case map[string]interface{}:
+		if f.Kind > KindMapBase && f.Kind < KindMapEnd {
+			for k := range v {
+				v[k] = f.normalize(v[k])
+			}
+		}
+		return v
+	}
+	return value
+}
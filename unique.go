@@ -0,0 +1,56 @@
+package restful
+
+import (
+	"regexp"
+
+	"github.com/globalsign/mgo"
+)
+
+// index name in duplicate key error, e.g.: E11000 duplicate key error collection: db.user index: email_1 dup key: { ... }
+var dupIndexRegexp = regexp.MustCompile(`index: (\S+) dup key`)
+
+// checkUniqueFields check the fields of Processor.UniqueFields, and appends their unique indexes
+func (p *Processor) checkUniqueFields(report *InitReport) {
+	for _, field := range RemoveDupArray(p.UniqueFields) {
+		if field == "id" {
+			report.Add(p.Biz, "unique field id needless")
+			continue
+		}
+		kind, ok := p.FieldSet.IsFieldMember(field)
+		if !ok {
+			report.Add(p.Biz, "unique field %s unknown", field)
+			continue
+		}
+		if kind == KindObject || kind == KindGeo || kind > KindMapBase && kind < KindMapEnd {
+			report.Add(p.Biz, "unique field %s not simple or array", field)
+			continue
+		}
+		exist := false
+		for i, index := range p.Indexes {
+			if len(index.Key) == 1 && index.Key[0] == field {
+				p.Indexes[i].Unique = true
+				exist = true
+			}
+		}
+		if !exist {
+			p.Indexes = append(p.Indexes, Index{Key: []string{field}, Unique: true})
+		}
+	}
+}
+
+// duplicateField get the unique field conflicting of duplicate key error, empty if not
+func (p *Processor) duplicateField(err error) string {
+	if err == nil || !mgo.IsDup(err) {
+		return ""
+	}
+	m := dupIndexRegexp.FindStringSubmatch(err.Error())
+	if m == nil {
+		return ""
+	}
+	for _, field := range p.UniqueFields {
+		if m[1] == p.FieldSet.storageField(field)+"_1" {
+			return field
+		}
+	}
+	return ""
+}
@@ -1,10 +1,14 @@
 package restful
 
 import (
+	"fmt"
 	"github.com/globalsign/mgo/bson"
 	"github.com/jimdn/objectid"
 	"github.com/nu7hatch/gouuid"
+	"golang.org/x/text/unicode/norm"
+	"math"
 	"math/rand"
+	"unicode/utf8"
 )
 
 // RandString is an function to gen a rand string
@@ -127,6 +131,99 @@ func CheckUint(value interface{}) interface{} {
 	return nil
 }
 
+// CheckIntegral check the number value can be stored as int64, or uint64 if unsigned, without loss
+// return the reason if not, empty if ok or value is not a number
+func CheckIntegral(value interface{}, unsigned bool) string {
+	var f float64
+	switch v := value.(type) {
+	case float32:
+		f = float64(v)
+	case float64:
+		f = v
+	case int:
+		f = float64(v)
+	case int8:
+		f = float64(v)
+	case int16:
+		f = float64(v)
+	case int32:
+		f = float64(v)
+	case int64:
+		if unsigned && v < 0 {
+			return fmt.Sprintf("negative %d for uint", v)
+		}
+		return ""
+	case uint64:
+		if !unsigned && v > math.MaxInt64 {
+			return fmt.Sprintf("%d out of int range", v)
+		}
+		return ""
+	default:
+		return ""
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return fmt.Sprintf("%v not a number", f)
+	}
+	if f != math.Trunc(f) {
+		return fmt.Sprintf("%v not integral", f)
+	}
+	if unsigned {
+		if f < 0 {
+			return fmt.Sprintf("negative %v for uint", f)
+		}
+		if f >= math.MaxUint64 {
+			return fmt.Sprintf("%v out of uint range", f)
+		}
+	} else if f < math.MinInt64 || f >= math.MaxInt64 {
+		return fmt.Sprintf("%v out of int range", f)
+	}
+	return ""
+}
+
+// CheckFinite check the number value is not NaN or Inf
+// return the reason if not, empty if ok or value is not a float
+func CheckFinite(value interface{}) string {
+	var f float64
+	switch v := value.(type) {
+	case float32:
+		f = float64(v)
+	case float64:
+		f = v
+	default:
+		return ""
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return fmt.Sprintf("%v not a number", f)
+	}
+	return ""
+}
+
+// RoundFloat rounds the float value, or floats in array or map value, to decimal places
+// value returned as is if not float
+func RoundFloat(value interface{}, places int) interface{} {
+	switch v := value.(type) {
+	case float64:
+		pow := math.Pow10(places)
+		r := math.Round(v*pow) / pow
+		if math.IsInf(r, 0) || math.IsNaN(r) {
+			return v
+		}
+		return r
+	case []interface{}:
+		r := make([]interface{}, 0, len(v))
+		for _, elem := range v {
+			r = append(r, RoundFloat(elem, places))
+		}
+		return r
+	case map[string]interface{}:
+		for k, elem := range v {
+			v[k] = RoundFloat(elem, places)
+		}
+		return v
+	}
+	return value
+}
+
 // CheckFloat check value type
 // if value is any type represent FLOAT, return FLOAT64 value
 // if value is not any type represent FLOAT, return nil
@@ -239,6 +336,32 @@ func IsEmptyObject(value interface{}) bool {
 	return false
 }
 
+// NormalizeNFC normalize the string value to unicode NFC form
+// value can be STRING, ARRAY of STRING or MAP of STRING
+func NormalizeNFC(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return norm.NFC.String(v)
+	case []interface{}:
+		for i := range v {
+			v[i] = NormalizeNFC(v[i])
+		}
+		return v
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = NormalizeNFC(v[k])
+		}
+		return v
+	}
+	return value
+}
+
+// StringLength count the length of string in runes
+// so CJK or emoji character is counted as 1
+func StringLength(s string) int {
+	return utf8.RuneCountInString(s)
+}
+
 // RemoveDupArray remove duplicate elements
 func RemoveDupArray(s []string) []string {
 	m := make(map[string]bool)
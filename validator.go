@@ -0,0 +1,46 @@
+package restful
+
+// Validator is a business rule of a field checked when written, e.g. valid ISBN, phone format
+// value is parsed by the kind of field, return an error as the reason if invalid
+type Validator func(value interface{}) error
+
+// RegisterValidator register a validator of the field run during CheckObject, replacing the previous one
+// PATCH of a map member like "extra.key" validates {"key": value} by the validator of "extra"
+// it should be called before serving, e.g. right after Init
+func (fs *FieldSet) RegisterValidator(path string, fn func(value interface{}) error) {
+	if fs.validators == nil {
+		fs.validators = make(map[string]Validator)
+	}
+	if fn == nil {
+		delete(fs.validators, path)
+		return
+	}
+	fs.validators[path] = fn
+}
+
+// validate run the validator of field, return the reason if invalid, empty if ok
+func (fs *FieldSet) validate(path string, value interface{}) string {
+	fn, ok := fs.validators[path]
+	if !ok {
+		return ""
+	}
+	if err := fn(value); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// checkValidators check the fields of Processor.Validators and registers them
+func (p *Processor) checkValidators(report *InitReport) {
+	for field, fn := range p.Validators {
+		if _, ok := p.FieldSet.FMap[field]; !ok {
+			report.Add(p.Biz, "validator field %s unknown", field)
+			continue
+		}
+		if fn == nil {
+			report.Add(p.Biz, "validator of field %s nil", field)
+			continue
+		}
+		p.FieldSet.RegisterValidator(field, fn)
+	}
+}